@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const auditLogLimit = 100
+
+type AuditEntry struct {
+	id        int
+	AdminID   int       `json:"admin_id"`
+	Action    string    `json:"action"`
+	Target    string    `json:"target"`
+	Details   string    `json:"details"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type balanceAdjustment struct {
+	Asset  string  `json:"asset_type"`
+	Amount float64 `json:"amount"`
+	Reason string  `json:"reason"`
+}
+
+// adminOnly must be wrapped by an authentication middleware.
+func (api api) adminOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := mustUserID(r)
+		if err != nil {
+			RespondWithError(w, http.StatusForbidden, err)
+			return
+		}
+		user, err := api.db.UserByID(r.Context(), userID)
+		if err != nil {
+			RespondWithError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if user.Role != roleAdmin {
+			RespondWithError(w, http.StatusForbidden, ErrAdminRequired)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+}
+
+// auditEntry describes an admin action, the store saves it in the transaction of the action so neither is recorded
+// without the other. adminOnly made sure the request is authenticated.
+func auditEntry(r *http.Request, action, target, details string) *AuditEntry {
+	adminID, _ := mustUserID(r)
+	return &AuditEntry{
+		AdminID:   adminID,
+		Action:    action,
+		Target:    target,
+		Details:   details,
+		CreatedAt: time.Now().UTC(),
+	}
+}
+
+func (api api) userFromPath(w http.ResponseWriter, r *http.Request) (User, bool) {
+	user, err := api.db.User(r.Context(), r.PathValue("username"))
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			RespondWithError(w, http.StatusNotFound, ErrUserNotFound)
+			return User{}, false
+		}
+		RespondWithError(w, http.StatusInternalServerError, err)
+		return User{}, false
+	}
+	return user, true
+}
+
+func (api api) adminUsers(w http.ResponseWriter, r *http.Request) {
+	users, err := api.db.Users(r.Context())
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err)
+		return
+	}
+	RespondWithJSON(w, http.StatusOK, users)
+}
+
+func (api api) disableUser(w http.ResponseWriter, r *http.Request) {
+	api.setUserDisabled(w, r, true)
+}
+
+func (api api) enableUser(w http.ResponseWriter, r *http.Request) {
+	api.setUserDisabled(w, r, false)
+}
+
+func (api api) setUserDisabled(w http.ResponseWriter, r *http.Request, disabled bool) {
+	user, ok := api.userFromPath(w, r)
+	if !ok {
+		return
+	}
+	action := "enable_user"
+	if disabled {
+		action = "disable_user"
+	}
+	if err := api.db.SetUserDisabledAudited(r.Context(), user.id, disabled, auditEntry(r, action, user.Username, "")); err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err)
+		return
+	}
+	user.Disabled = disabled
+	RespondWithJSON(w, http.StatusOK, user)
+}
+
+func (api api) adjustBalance(w http.ResponseWriter, r *http.Request) {
+	user, ok := api.userFromPath(w, r)
+	if !ok {
+		return
+	}
+	var req balanceAdjustment
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		RespondWithError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.Reason == "" {
+		RespondWithError(w, http.StatusBadRequest, "a reason is required")
+		return
+	}
+	if req.Amount == 0 {
+		RespondWithError(w, http.StatusBadRequest, "amount must not be zero")
+		return
+	}
+	if !api.traded(req.Asset) {
+		RespondWithError(w, http.StatusBadRequest, ErrUnknownAsset)
+		return
+	}
+	details := fmt.Sprintf("%+g %s: %s", req.Amount, req.Asset, req.Reason)
+	entry := auditEntry(r, "adjust_balance", user.Username, details)
+	asset, err := api.db.AdjustAssetAudited(r.Context(), user.id, req.Asset, req.Amount, entry)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, ErrInsufficientFunds) {
+			status = http.StatusBadRequest
+		}
+		RespondWithError(w, status, err)
+		return
+	}
+	RespondWithJSON(w, http.StatusOK, asset)
+}
+
+// traded reports whether a configured pair trades the asset.
+func (api api) traded(asset string) bool {
+	for _, engine := range api.engines {
+		if engine.pair.Base == asset || engine.pair.Quote == asset {
+			return true
+		}
+	}
+	return false
+}
+
+func (api api) adminUserOrders(w http.ResponseWriter, r *http.Request) {
+	user, ok := api.userFromPath(w, r)
+	if !ok {
+		return
+	}
+	api.listOrders(w, r, user.id)
+}
+
+func (api api) forceCancel(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		RespondWithError(w, http.StatusBadRequest, "invalid order id")
+		return
+	}
+	order, err := api.db.Order(r.Context(), id)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			RespondWithError(w, http.StatusNotFound, ErrOrderNotFound)
+			return
+		}
+		RespondWithError(w, http.StatusInternalServerError, err)
+		return
+	}
+	order, err = api.cancelOrder(r.Context(), order, auditEntry(r, "cancel_order", strconv.Itoa(order.ID), ""))
+	if err != nil {
+		RespondWithError(w, cancelStatus(err), err)
+		return
+	}
+	RespondWithJSON(w, http.StatusOK, order)
+}
+
+type pairStateRequest struct {
+	State string `json:"state"`
+}
+
+func (api api) haltPair(w http.ResponseWriter, r *http.Request) {
+	api.changePairState(w, r, pairHalted)
+}
+
+func (api api) resumePair(w http.ResponseWriter, r *http.Request) {
+	api.changePairState(w, r, pairOpen)
+}
+
+func (api api) setPairState(w http.ResponseWriter, r *http.Request) {
+	var req pairStateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		RespondWithError(w, http.StatusBadRequest, err)
+		return
+	}
+	api.changePairState(w, r, req.State)
+}
+
+func (api api) changePairState(w http.ResponseWriter, r *http.Request, state string) {
+	pair := r.PathValue("pair")
+	engine, ok := api.engines[pair]
+	if !ok {
+		RespondWithError(w, http.StatusNotFound, ErrUnknownPair)
+		return
+	}
+	ctx := r.Context()
+	err := engine.SetState(ctx, state, func(ctx context.Context) error {
+		return api.db.SavePairState(ctx, pair, state, auditEntry(r, "set_pair_state", pair, state))
+	})
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, ErrInvalidPairState) {
+			status = http.StatusBadRequest
+		}
+		RespondWithError(w, status, err)
+		return
+	}
+	if state == pairClosed {
+		slog.InfoContext(ctx, "pair closed, pending orders cancelled", "pair", pair)
+	}
+	RespondWithJSON(w, http.StatusOK, pairStateRequest{State: state})
+}
+
+func (api api) auditLog(w http.ResponseWriter, r *http.Request) {
+	entries, err := api.db.AuditLog(r.Context(), auditLogLimit)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err)
+		return
+	}
+	RespondWithJSON(w, http.StatusOK, entries)
+}
@@ -2,43 +2,199 @@ package main
 
 import (
 	"context"
-	"crypto/sha256"
-	"crypto/subtle"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"log/slog"
 	"net/http"
 	"sort"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 var ErrInsufficientFunds = errors.New("insufficient funds")
 
 type api struct {
-	db         store
-	matchmaker matchmaker
+	db             store
+	engines        map[string]*engine
+	replays        *replayCache
+	deadman        *deadmanSwitch
+	health         *health
+	hasher         passwordHasher
+	idempotencyTTL time.Duration
+	maxBatchSize   int
+	timeouts       timeoutsConfig
+	limiters       map[string]*rateLimiter
+	lockout        *loginLockout
 }
 
-func newAPI(db store) api {
-	pending, err := db.PendingOrders("EUR-USD")
+// newAPI creates the engines of the configured pairs with empty books, restore must be called to load the pending
+// orders before the api reports ready and accepts requests.
+func newAPI(db store, hasher passwordHasher, cfg Config) api {
+	engines := make(map[string]*engine)
+	for _, pair := range cfg.Pairs {
+		engines[pair.Name] = newEngine(pair, newMatchMaker(pair.TickSize, nil))
+	}
+	return api{
+		db:             db,
+		engines:        engines,
+		replays:        newReplayCache(),
+		deadman:        newDeadmanSwitch(),
+		health:         &health{},
+		hasher:         hasher,
+		idempotencyTTL: time.Duration(cfg.Limits.IdempotencyTTL),
+		maxBatchSize:   cfg.Limits.MaxBatchSize,
+		timeouts:       cfg.Timeouts,
+		limiters: map[string]*rateLimiter{
+			classOrders:        newRateLimiter(cfg.RateLimits.Orders),
+			classQueries:       newRateLimiter(cfg.RateLimits.Queries),
+			classAuthFailures:  newRateLimiter(cfg.RateLimits.AuthFailures),
+			classRegistrations: newRateLimiter(cfg.RateLimits.Registrations),
+		},
+		lockout: newLoginLockout(cfg.RateLimits.Lockout),
+	}
+}
+
+// restore rebuilds the books from the pending orders, settles the matches left over and warms the tickers.
+func (api api) restore(ctx context.Context) error {
+	states, err := api.db.PairStates(ctx)
 	if err != nil {
-		panic(err)
+		return err
 	}
-	m := newMatchMaker(pending)
-	matches := m.VerifyMatch()
-	for _, match := range matches {
-		if err := db.FillOrder(match); err != nil {
-			panic(err)
+	for name, engine := range api.engines {
+		if state, ok := states[name]; ok {
+			if err := engine.SetState(ctx, state, nil); err != nil {
+				return err
+			}
 		}
+		pending, err := api.db.PendingOrders(ctx, name)
+		if err != nil {
+			return err
+		}
+		m := newMatchMaker(engine.pair.TickSize, pending)
+		matches := m.VerifyMatch(ctx)
+		for i, execution := range executions(name, matches, time.Now()) {
+			// neither order triggered the match, both are makers
+			fee := engine.pair.Fees.MakerPercent
+			if err := api.db.FillOrders(ctx, Fill{Order: matches[2*i], FeePercent: fee}, Fill{Order: matches[2*i+1], FeePercent: fee}); err != nil {
+				settlementFailures.WithLabelValues(name).Inc()
+				return err
+			}
+			// recorded before the warm-up below reads the trades back
+			api.recordExecution(ctx, execution)
+		}
+		engine.Load(m)
+		now := time.Now()
+		trades, err := api.db.Trades(ctx, name, now.Add(-tickerWindow), now)
+		if err != nil {
+			return err
+		}
+		engine.Warm(trades)
 	}
-	return api{db: db, matchmaker: m}
+	api.health.loaded.Store(true)
+	return nil
 }
 
 func (api api) routes() http.Handler {
 	mux := http.NewServeMux()
-	mux.HandleFunc("GET /assets", api.basicAuth(api.assets))
-	mux.HandleFunc("POST /orders", api.basicAuth(api.order))
-	mux.HandleFunc("GET /orders", api.basicAuth(api.orders))
-	return mux
+	// the routes with a request body in openapi.json must validate it
+	validated := func(next http.HandlerFunc) http.HandlerFunc {
+		return validateRequest(mux, next)
+	}
+	mux.Handle("GET /metrics", promhttp.Handler())
+	mux.HandleFunc("GET /healthz", api.healthz)
+	mux.HandleFunc("GET /readyz", api.readyz)
+	mux.HandleFunc("GET /openapi.json", api.openAPI)
+	mux.HandleFunc("GET /pairs", api.limit(classQueries, api.pairs))
+	mux.HandleFunc("GET /ticker", api.limit(classQueries, api.tickers))
+	mux.HandleFunc("GET /ticker/{pair}", api.limit(classQueries, api.ticker))
+	mux.HandleFunc("GET /candles/{pair}", api.limit(classQueries, api.candles))
+	mux.HandleFunc("GET /assets", api.auth(scopeRead, api.limit(classQueries, api.assets)))
+	mux.HandleFunc("POST /orders", api.auth(scopeTrade, api.limit(classOrders, validated(api.idempotent(api.order)))))
+	mux.HandleFunc("GET /orders", api.auth(scopeRead, api.limit(classQueries, api.orders)))
+	mux.HandleFunc("GET /orders/{id}", api.auth(scopeRead, api.limit(classQueries, api.userOrder)))
+	mux.HandleFunc("POST /orders/batch", api.auth(scopeTrade, api.limit(classOrders, validated(api.idempotent(api.placeOrders)))))
+	mux.HandleFunc("DELETE /orders/batch", api.auth(scopeTrade, api.limit(classOrders, validated(api.cancelOrders))))
+	mux.HandleFunc("DELETE /orders", api.auth(scopeTrade, api.limit(classOrders, api.cancelAllOrders)))
+	mux.HandleFunc("POST /orders/deadman", api.auth(scopeTrade, api.limit(classOrders, validated(api.heartbeat))))
+	mux.HandleFunc("POST /apikeys", api.basicAuth(validated(api.createAPIKey)))
+	mux.HandleFunc("GET /apikeys", api.basicAuth(api.apiKeys))
+	mux.HandleFunc("DELETE /apikeys/{key}", api.basicAuth(api.revokeAPIKey))
+	mux.HandleFunc("POST /users", api.limit(classRegistrations, validated(api.register)))
+	mux.HandleFunc("POST /users/me/password", api.basicAuth(validated(api.changePassword)))
+	mux.HandleFunc("GET /admin/users", api.basicAuth(api.adminOnly(api.adminUsers)))
+	mux.HandleFunc("POST /admin/users/{username}/disable", api.basicAuth(api.adminOnly(api.disableUser)))
+	mux.HandleFunc("POST /admin/users/{username}/enable", api.basicAuth(api.adminOnly(api.enableUser)))
+	mux.HandleFunc("POST /admin/users/{username}/balance", api.basicAuth(api.adminOnly(validated(api.adjustBalance))))
+	mux.HandleFunc("GET /admin/users/{username}/orders", api.basicAuth(api.adminOnly(api.adminUserOrders)))
+	mux.HandleFunc("DELETE /admin/orders/{id}", api.basicAuth(api.adminOnly(api.forceCancel)))
+	mux.HandleFunc("POST /admin/pairs/{pair}/halt", api.basicAuth(api.adminOnly(api.haltPair)))
+	mux.HandleFunc("POST /admin/pairs/{pair}/resume", api.basicAuth(api.adminOnly(api.resumePair)))
+	mux.HandleFunc("POST /admin/pairs/{pair}/state", api.basicAuth(api.adminOnly(validated(api.setPairState))))
+	mux.HandleFunc("GET /admin/audit", api.basicAuth(api.adminOnly(api.auditLog)))
+	return instrument(mux, withRequestID(logRequests(mux, limitBody(api.whenLoaded(api.withDeadline(mux, mux))))))
+}
+
+// maxBodySize bounds the request bodies, the largest legitimate one is a full batch of orders.
+const maxBodySize = 1 << 20
+
+// limitBody fails the reads of the request bodies larger than maxBodySize.
+func limitBody(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Body = http.MaxBytesReader(w, r.Body, maxBodySize)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// readBody reads the whole request body, it answers the request and returns false when it cannot.
+func readBody(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			RespondWithError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("request body is larger than %d bytes", tooLarge.Limit))
+			return nil, false
+		}
+		RespondWithError(w, http.StatusBadRequest, err)
+		return nil, false
+	}
+	return body, true
+}
+
+// withDeadline bounds the request context by the timeout of its route, the store queries still running when it
+// expires are cancelled and the request is answered with a 503.
+func (api api) withDeadline(mux *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, route := mux.Handler(r)
+		timeout, ok := api.timeouts.Routes[route]
+		if !ok {
+			timeout = api.timeouts.Default
+		}
+		if timeout <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), time.Duration(timeout))
+		defer cancel()
+		next.ServeHTTP(&deadlineWriter{ResponseWriter: w, ctx: ctx}, r.WithContext(ctx))
+	})
+}
+
+// deadlineWriter reports the server errors written once the deadline expired as 503s, they are caused by the timeout
+// rather than by a fault of the server.
+type deadlineWriter struct {
+	http.ResponseWriter
+	ctx context.Context
+}
+
+func (w *deadlineWriter) WriteHeader(code int) {
+	if code == http.StatusInternalServerError && errors.Is(w.ctx.Err(), context.DeadlineExceeded) {
+		code = http.StatusServiceUnavailable
+	}
+	w.ResponseWriter.WriteHeader(code)
 }
 
 func (api api) assets(w http.ResponseWriter, r *http.Request) {
@@ -47,7 +203,7 @@ func (api api) assets(w http.ResponseWriter, r *http.Request) {
 		RespondWithError(w, http.StatusForbidden, err)
 		return
 	}
-	assets, err := api.db.Assets(userID)
+	assets, err := api.db.Assets(r.Context(), userID)
 	if err != nil {
 		RespondWithError(w, http.StatusInternalServerError, err)
 		return
@@ -64,34 +220,91 @@ func (api api) orders(w http.ResponseWriter, r *http.Request) {
 		RespondWithError(w, http.StatusForbidden, err)
 		return
 	}
-	orders, err := api.db.UserOrders(userID)
-	if err != nil {
-		RespondWithError(w, http.StatusInternalServerError, err)
+	if clientOrderID := r.URL.Query().Get("client_order_id"); clientOrderID != "" {
+		order, err := api.db.OrderByClientID(r.Context(), userID, clientOrderID)
+		switch {
+		case errors.Is(err, ErrNotFound):
+			RespondWithJSON(w, http.StatusOK, []Order{})
+		case err != nil:
+			RespondWithError(w, http.StatusInternalServerError, err)
+		default:
+			RespondWithJSON(w, http.StatusOK, []Order{order})
+		}
 		return
 	}
-	RespondWithJSON(w, http.StatusOK, orders)
+	api.listOrders(w, r, userID)
 }
 
-func (api api) verifyLiquidity(order Order) error {
-	assets, err := api.db.Assets(order.userID)
+func (api api) userOrder(w http.ResponseWriter, r *http.Request) {
+	userID, err := mustUserID(r)
 	if err != nil {
-		return err
+		RespondWithError(w, http.StatusForbidden, err)
+		return
+	}
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		RespondWithError(w, http.StatusBadRequest, "invalid order id")
+		return
+	}
+	order, err := api.db.Order(r.Context(), id)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		RespondWithError(w, http.StatusInternalServerError, err)
+		return
+	}
+	// other users' orders are reported as missing
+	if err != nil || order.userID != userID {
+		RespondWithError(w, http.StatusNotFound, ErrOrderNotFound)
+		return
 	}
-	symbol := order.AssetPair[0:3]
-	amount := order.Amount * order.Price
+	RespondWithJSON(w, http.StatusOK, order)
+}
+
+// cost returns the asset and the amount the order spends once filled.
+func cost(order Order) (asset string, amount float64) {
 	if order.Side == "SELL" {
-		symbol = order.AssetPair[4:]
-		amount = order.Amount
+		return order.AssetPair[4:], order.Amount
 	}
+	return order.AssetPair[0:3], order.Amount * order.Price
+}
+
+func (api api) balances(ctx context.Context, userID int) (map[string]float64, error) {
+	assets, err := api.db.Assets(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	balances := make(map[string]float64)
 	for _, asset := range assets {
-		if asset.Asset != symbol {
-			continue
-		}
-		if asset.Amount >= amount {
-			return nil
-		}
+		balances[asset.Asset] += asset.Amount
+	}
+	return balances, nil
+}
+
+// available returns the balances of the user minus the holds of its pending orders, the funds new orders may commit.
+func (api api) available(ctx context.Context, userID int) (map[string]float64, error) {
+	balances, err := api.balances(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	pending, err := api.db.UserOrders(ctx, userID, OrderFilter{Status: statusPending})
+	if err != nil {
+		return nil, err
+	}
+	for _, order := range pending {
+		asset, amount := cost(order)
+		balances[asset] -= amount
 	}
-	return ErrInsufficientFunds
+	return balances, nil
+}
+
+func (api api) verifyLiquidity(ctx context.Context, order Order) error {
+	balances, err := api.available(ctx, order.userID)
+	if err != nil {
+		return err
+	}
+	if asset, amount := cost(order); balances[asset] < amount {
+		return ErrInsufficientFunds
+	}
+	return nil
 }
 
 func (api api) order(w http.ResponseWriter, r *http.Request) {
@@ -107,7 +320,12 @@ func (api api) order(w http.ResponseWriter, r *http.Request) {
 	}
 	order.userID = userID
 
-	if err := api.verifyLiquidity(order); err != nil {
+	engine, status, err := api.checkOrder(order)
+	if err != nil {
+		RespondWithError(w, status, err)
+		return
+	}
+	if err := api.verifyLiquidity(r.Context(), order); err != nil {
 		status := http.StatusInternalServerError
 		if errors.Is(err, ErrInsufficientFunds) {
 			status = http.StatusBadRequest
@@ -116,17 +334,12 @@ func (api api) order(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := api.db.SaveOrder(&order); err != nil {
-		RespondWithError(w, http.StatusInternalServerError, err)
+	placed, status, err := api.placeOrder(r.Context(), engine, order)
+	if err != nil {
+		RespondWithError(w, status, err)
 		return
 	}
-	matches := api.matchmaker.AddOrderAndMatch(order)
-	for _, match := range matches {
-		if err := api.db.FillOrder(match); err != nil {
-			RespondWithError(w, http.StatusInternalServerError, err)
-			return
-		}
-	}
+	RespondWithJSON(w, http.StatusOK, placed)
 }
 
 const userIDKey = "userID"
@@ -139,48 +352,92 @@ func mustUserID(r *http.Request) (int, error) {
 	return v.(int), nil
 }
 
+// contextWithUserID also hands the user to logRequests, which logs the request once it's served.
+func contextWithUserID(ctx context.Context, id int) context.Context {
+	if entry, ok := ctx.Value(requestLogKey).(*requestLog); ok {
+		entry.userID = id
+	}
+	return context.WithValue(ctx, userIDKey, id)
+}
+
+// basicAuth counts the failed logins against the client address, and against the username to lock it out.
 func (api api) basicAuth(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		if api.authBlocked(w, r) {
+			return
+		}
 		username, password, ok := r.BasicAuth()
 		if ok {
-			passwordHash := sha256.Sum256([]byte(password))
-			id, hash, err := api.db.User(username)
+			// the lockout and the response don't depend on whether the username exists
+			now := time.Now()
+			if wait := api.lockout.lockedFor(username, now); wait > 0 {
+				tooManyRequests(w, ErrLoginLocked, wait)
+				return
+			}
+			user, err := api.db.User(r.Context(), username)
+			if err != nil && !errors.Is(err, ErrNotFound) {
+				RespondWithError(w, http.StatusInternalServerError, err)
+				return
+			}
+			var match, rehash bool
+			if err == nil {
+				match, rehash, err = api.hasher.Verify(password, user.password)
+			} else {
+				// hash anyway, an unknown username takes as long to reject as a wrong password
+				_, err = api.hasher.Hash(password)
+			}
 			if err != nil {
-				if errors.Is(err, ErrNotFound) {
-					w.Header().Set("WWW-Authenticate", `Basic realm="restricted", charset="UTF-8"`)
-					http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				RespondWithError(w, http.StatusInternalServerError, err)
+				return
+			}
+			if match {
+				api.lockout.reset(username)
+				if user.Disabled {
+					RespondWithError(w, http.StatusForbidden, ErrUserDisabled)
 					return
 				}
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-			}
-			if subtle.ConstantTimeCompare(passwordHash[:], hash[:]) == 1 {
-				next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userIDKey, id)))
+				if rehash {
+					api.upgradePassword(r.Context(), user.id, password)
+				}
+				next.ServeHTTP(w, r.WithContext(contextWithUserID(r.Context(), user.id)))
 				return
 			}
+			api.lockout.fail(username, now)
+			api.authFailed(r)
 		}
 		w.Header().Set("WWW-Authenticate", `Basic realm="restricted", charset="UTF-8"`)
-		http.Error(w, "Unauthorized", http.StatusForbidden)
+		RespondWithError(w, http.StatusForbidden, ErrUnauthorized)
+	}
+}
+
+// upgradePassword replaces a legacy or outdated password hash, failing to do so doesn't prevent the login.
+func (api api) upgradePassword(ctx context.Context, userID int, password string) {
+	hash, err := api.hasher.Hash(password)
+	if err == nil {
+		err = api.db.UpdatePassword(ctx, userID, hash)
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "cannot upgrade password hash", "user", userID, "err", err)
 	}
 }
 
 func RespondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
 	response, _ := json.Marshal(payload)
-	w.Header().Set("Content-Type", "api/json")
+	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(code)
 	_, _ = w.Write(response)
 }
 
+// RespondWithError reports msg, an error or a message, with its code from the catalogue in errors.go.
 func RespondWithError(w http.ResponseWriter, code int, msg interface{}) {
-	var message string
-	switch m := msg.(type) {
-	case error:
-		message = m.Error()
-	case string:
-		message = m
-	}
-	RespondWithJSON(w, code, JSONError{Error: message})
+	code, jsonError := newJSONError(w.Header().Get(requestIDHeader), code, msg)
+	RespondWithJSON(w, code, jsonError)
 }
 
+// JSONError is the body of every error response.
 type JSONError struct {
-	Error string `json:"error,omitempty"`
+	Code      string       `json:"code"`
+	Error     string       `json:"error"`
+	RequestID string       `json:"request_id,omitempty"`
+	Fields    []FieldError `json:"fields,omitempty"`
 }
@@ -2,17 +2,23 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"reflect"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func Test_api(t *testing.T) {
+	ctx := context.Background()
 	tests := []struct {
 		name   string
 		db     string
@@ -31,15 +37,70 @@ func Test_api(t *testing.T) {
 			assets: []Asset{{Asset: "EUR", Amount: 1}, {Asset: "USD", Amount: 2}},
 			orders: []Order{{Side: "BUY", AssetPair: "EUR-USD", Amount: 1, Price: 1, Status: statusPending}},
 		},
+		{
+			name:   "sqlite",
+			db:     "sqlite",
+			assets: []Asset{{Asset: "EUR", Amount: 1}, {Asset: "USD", Amount: 2}},
+			orders: []Order{{Side: "BUY", AssetPair: "EUR-USD", Amount: 1, Price: 1, Status: statusPending}},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			db := storeFactory(t, tt.db)
 			user, id := randomTestUser(t, db)
-			api := api{db: db, matchmaker: fakeMatcher{}}
+			api := newTestAPI(db, fakeMatcher{})
 			server := httptest.NewServer(api.routes())
 			defer server.Close()
 
+			t.Run("pairs", func(t *testing.T) {
+				resp, err := http.Get(server.URL + "/pairs")
+				if err != nil {
+					t.Fatal(err)
+				}
+				var infos []pairInfo
+				if err := json.NewDecoder(resp.Body).Decode(&infos); err != nil {
+					t.Fatal(err)
+				}
+				if got, want := infos, []pairInfo{{Pair: defaultPairs[0], State: pairOpen}}; !reflect.DeepEqual(got, want) {
+					t.Errorf("got %v want %v", got, want)
+				}
+			})
+
+			t.Run("candles", func(t *testing.T) {
+				resp, err := http.Get(server.URL + "/candles/EUR-USD?interval=1h")
+				if err != nil {
+					t.Fatal(err)
+				}
+				var candles []Candle
+				if err := json.NewDecoder(resp.Body).Decode(&candles); err != nil {
+					t.Fatal(err)
+				}
+				if got, want := resp.StatusCode, http.StatusOK; got != want {
+					t.Errorf("got %v want %v", got, want)
+				}
+
+				for _, query := range []string{"interval=2m", "from=yesterday", "interval=1m&from=2020-01-01T00:00:00Z"} {
+					resp, err := http.Get(server.URL + "/candles/EUR-USD?" + query)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if got, want := resp.StatusCode, http.StatusBadRequest; got != want {
+						t.Errorf("%s: got %v want %v", query, got, want)
+					}
+				}
+			})
+
+			t.Run("metrics", func(t *testing.T) {
+				resp, err := http.Get(server.URL + "/metrics")
+				if err != nil {
+					t.Fatal(err)
+				}
+				b, _ := io.ReadAll(resp.Body)
+				if want := `http_requests_total{code="200",method="GET",route="GET /pairs"}`; !strings.Contains(string(b), want) {
+					t.Errorf("missing %s in\n%s", want, b)
+				}
+			})
+
 			t.Run("no auth", func(t *testing.T) {
 				req, _ := http.NewRequest("GET", server.URL+"/assets", nil)
 
@@ -56,21 +117,56 @@ func Test_api(t *testing.T) {
 			t.Run("wrong auth", func(t *testing.T) {
 				req, _ := http.NewRequest("GET", server.URL+"/assets", nil)
 				req.Header.Add("Authorization", "Basic "+basicAuth("foo", "bar"))
+				req.Header.Add(requestIDHeader, "trace-1")
 
 				resp, err := http.DefaultClient.Do(req)
 				if err != nil {
 					t.Fatal(err)
 				}
 
-				if got, want := resp.StatusCode, http.StatusUnauthorized; got != want {
+				// an unknown username is answered like a wrong password
+				if got, want := resp.StatusCode, http.StatusForbidden; got != want {
+					t.Errorf("got %v want %v", got, want)
+				}
+				if got, want := resp.Header.Get("Content-Type"), "application/json"; got != want {
+					t.Errorf("got %v want %v", got, want)
+				}
+				var jsonError JSONError
+				if err := json.NewDecoder(resp.Body).Decode(&jsonError); err != nil {
+					t.Fatal(err)
+				}
+				if got, want := jsonError, (JSONError{Code: "UNAUTHORIZED", Error: ErrUnauthorized.Error(), RequestID: "trace-1"}); !reflect.DeepEqual(got, want) {
+					t.Errorf("got %+v want %+v", got, want)
+				}
+				if got, want := resp.Header.Get(requestIDHeader), "trace-1"; got != want {
 					t.Errorf("got %v want %v", got, want)
 				}
 			})
 
+			t.Run("legacy password upgraded", func(t *testing.T) {
+				user, _ := randomTestUser(t, db)
+				req, _ := http.NewRequest("GET", server.URL+"/assets", nil)
+				req.Header.Add("Authorization", "Basic "+basicAuth(user, user))
+				if got, want := do(t, req), http.StatusOK; got != want {
+					t.Errorf("got %v want %v", got, want)
+				}
+
+				u, err := db.User(ctx, user)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !strings.HasPrefix(string(u.password), argon2idPrefix) {
+					t.Errorf("password hash not upgraded: %x", u.password)
+				}
+				if got, want := do(t, req), http.StatusOK; got != want {
+					t.Errorf("login after upgrade: got %v want %v", got, want)
+				}
+			})
+
 			t.Run("assets", func(t *testing.T) {
 				for _, asset := range tt.assets {
 					asset.userID = id
-					_ = db.SaveAsset(asset)
+					_ = db.SaveAsset(ctx, asset)
 				}
 
 				req, _ := http.NewRequest("GET", server.URL+"/assets", nil)
@@ -91,7 +187,8 @@ func Test_api(t *testing.T) {
 			})
 
 			t.Run("orders", func(t *testing.T) {
-				for _, order := range tt.orders {
+				want := make([]Order, len(tt.orders))
+				for i, order := range tt.orders {
 					b, _ := json.Marshal(order)
 
 					req, _ := http.NewRequest("POST", server.URL+"/orders", bytes.NewBuffer(b))
@@ -105,6 +202,16 @@ func Test_api(t *testing.T) {
 					if got, want := resp.StatusCode, http.StatusOK; got != want {
 						t.Errorf("got %v want %v", got, want)
 					}
+					var created orderResponse
+					if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+						t.Fatal(err)
+					}
+					want[i] = order
+					want[i].ID = created.ID
+					want[i].CreatedAt = created.CreatedAt
+					if got, want := created.Order, want[i]; !reflect.DeepEqual(got, want) {
+						t.Errorf("got %v want %v", got, want)
+					}
 				}
 
 				req, _ := http.NewRequest("GET", server.URL+"/orders", nil)
@@ -119,7 +226,485 @@ func Test_api(t *testing.T) {
 				if err := json.NewDecoder(resp.Body).Decode(&orders); err != nil {
 					t.Fatal(err)
 				}
-				if got, want := orders, tt.orders; !reflect.DeepEqual(got, want) {
+				if got, want := orders, want; !reflect.DeepEqual(got, want) {
+					t.Errorf("got %v want %v", got, want)
+				}
+
+				req, _ = http.NewRequest("GET", server.URL+"/orders/"+strconv.Itoa(want[0].ID), nil)
+				req.Header.Add("Authorization", "Basic "+basicAuth(user, user))
+				if got, want := do(t, req), http.StatusOK; got != want {
+					t.Errorf("by id: got %v want %v", got, want)
+				}
+				other, _ := randomTestUser(t, db)
+				req.Header.Set("Authorization", "Basic "+basicAuth(other, other))
+				if got, want := do(t, req), http.StatusNotFound; got != want {
+					t.Errorf("other user: got %v want %v", got, want)
+				}
+
+				for _, query := range []string{"status=open", "side=buy", "pair=FOO-BAR", "limit=0", "cursor=x", "from=today"} {
+					req, _ := http.NewRequest("GET", server.URL+"/orders?"+query, nil)
+					req.Header.Add("Authorization", "Basic "+basicAuth(user, user))
+					if got, want := do(t, req), http.StatusBadRequest; got != want {
+						t.Errorf("%s: got %v want %v", query, got, want)
+					}
+				}
+			})
+
+			t.Run("client order id", func(t *testing.T) {
+				user, id := randomTestUser(t, db, Asset{Asset: "EUR", Amount: 10})
+				place := func(clientOrderID string) int {
+					b, _ := json.Marshal(Order{ClientOrderID: clientOrderID, Side: "BUY", AssetPair: "EUR-USD", Amount: 1, Price: 1})
+					req, _ := http.NewRequest("POST", server.URL+"/orders", bytes.NewBuffer(b))
+					req.Header.Add("Authorization", "Basic "+basicAuth(user, user))
+					return do(t, req)
+				}
+				if got, want := place("quote-1"), http.StatusOK; got != want {
+					t.Errorf("got %v want %v", got, want)
+				}
+				if got, want := place("quote-1"), http.StatusConflict; got != want {
+					t.Errorf("duplicate: got %v want %v", got, want)
+				}
+				if got, want := place(strings.Repeat("a", maxClientOrderIDSize+1)), http.StatusBadRequest; got != want {
+					t.Errorf("too long: got %v want %v", got, want)
+				}
+
+				req, _ := http.NewRequest("GET", server.URL+"/orders?client_order_id=quote-1", nil)
+				req.Header.Add("Authorization", "Basic "+basicAuth(user, user))
+				resp, err := http.DefaultClient.Do(req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var orders []Order
+				if err := json.NewDecoder(resp.Body).Decode(&orders); err != nil {
+					t.Fatal(err)
+				}
+				stored, err := db.OrderByClientID(ctx, id, "quote-1")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got, want := orders, []Order{stored}; len(got) != 1 || got[0].ID != want[0].ID {
+					t.Errorf("got %v want %v", got, want)
+				}
+			})
+
+			t.Run("orders batch", func(t *testing.T) {
+				user, _ := randomTestUser(t, db, Asset{Asset: "EUR", Amount: 2})
+				send := func(method string, body any) []batchResult {
+					b, _ := json.Marshal(body)
+					req, _ := http.NewRequest(method, server.URL+"/orders/batch", bytes.NewBuffer(b))
+					req.Header.Add("Authorization", "Basic "+basicAuth(user, user))
+					resp, err := http.DefaultClient.Do(req)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if got, want := resp.StatusCode, http.StatusOK; got != want {
+						t.Fatalf("got %v want %v", got, want)
+					}
+					var results []batchResult
+					if err := json.NewDecoder(resp.Body).Decode(&results); err != nil {
+						t.Fatal(err)
+					}
+					return results
+				}
+				codes := func(results []batchResult) (codes []int) {
+					for _, result := range results {
+						codes = append(codes, result.Code)
+					}
+					return
+				}
+
+				buy := Order{Side: "BUY", AssetPair: "EUR-USD", Amount: 1, Price: 1}
+				// off the tick size, the order is well formed but rejected by the pair
+				invalid := Order{Side: "BUY", AssetPair: "EUR-USD", Amount: 1, Price: 1.00001}
+				placed := send("POST", []Order{buy, invalid, buy, buy})
+				// the third buy exceeds the balance once the first two are accounted for
+				if got, want := codes(placed), []int{200, 400, 200, 400}; !reflect.DeepEqual(got, want) {
+					t.Fatalf("got %v want %v", got, want)
+				}
+				if placed[1].Fields == nil || placed[3].Error != ErrInsufficientFunds.Error() {
+					t.Errorf("unexpected errors %+v", placed)
+				}
+
+				// the funds held by the pending orders of the first batch are not available to the next one
+				if got, want := codes(send("POST", []Order{buy})), []int{400}; !reflect.DeepEqual(got, want) {
+					t.Errorf("committed funds: got %v want %v", got, want)
+				}
+
+				cancelled := send("DELETE", []int{placed[0].Order.ID, placed[2].Order.ID, placed[0].Order.ID, -1})
+				if got, want := codes(cancelled), []int{200, 200, 409, 404}; !reflect.DeepEqual(got, want) {
+					t.Errorf("got %v want %v", got, want)
+				}
+				// the cancellations released them
+				if got, want := codes(send("POST", []Order{buy})), []int{200}; !reflect.DeepEqual(got, want) {
+					t.Errorf("released funds: got %v want %v", got, want)
+				}
+				if got, want := cancelled[0].Order.Status, statusCancelled; got != want {
+					t.Errorf("got %v want %v", got, want)
+				}
+
+				tooMany := make([]Order, defaultMaxBatchSize+1)
+				for i := range tooMany {
+					tooMany[i] = buy
+				}
+				b, _ := json.Marshal(tooMany)
+				req, _ := http.NewRequest("POST", server.URL+"/orders/batch", bytes.NewBuffer(b))
+				req.Header.Add("Authorization", "Basic "+basicAuth(user, user))
+				if got, want := do(t, req), http.StatusBadRequest; got != want {
+					t.Errorf("too many orders: got %v want %v", got, want)
+				}
+				b, _ = json.Marshal([]Order{buy, {Side: "HOLD", AssetPair: "EUR-USD", Amount: 1, Price: 1}})
+				req, _ = http.NewRequest("POST", server.URL+"/orders/batch", bytes.NewBuffer(b))
+				req.Header.Add("Authorization", "Basic "+basicAuth(user, user))
+				if got, want := do(t, req), http.StatusBadRequest; got != want {
+					t.Errorf("malformed order: got %v want %v", got, want)
+				}
+			})
+
+			t.Run("cancel all", func(t *testing.T) {
+				user, id := randomTestUser(t, db, Asset{Asset: "EUR", Amount: 10})
+				place := func() Order {
+					b, _ := json.Marshal(Order{Side: "BUY", AssetPair: "EUR-USD", Amount: 1, Price: 1})
+					req, _ := http.NewRequest("POST", server.URL+"/orders", bytes.NewBuffer(b))
+					req.Header.Add("Authorization", "Basic "+basicAuth(user, user))
+					resp, err := http.DefaultClient.Do(req)
+					if err != nil {
+						t.Fatal(err)
+					}
+					var placed orderResponse
+					if err := json.NewDecoder(resp.Body).Decode(&placed); err != nil {
+						t.Fatal(err)
+					}
+					return placed.Order
+				}
+				cancelAll := func(query string) (int, []Order) {
+					req, _ := http.NewRequest("DELETE", server.URL+"/orders"+query, nil)
+					req.Header.Add("Authorization", "Basic "+basicAuth(user, user))
+					resp, err := http.DefaultClient.Do(req)
+					if err != nil {
+						t.Fatal(err)
+					}
+					var orders []Order
+					_ = json.NewDecoder(resp.Body).Decode(&orders)
+					return resp.StatusCode, orders
+				}
+
+				place()
+				place()
+				if got, _ := cancelAll("?pair=FOO-BAR"); got != http.StatusBadRequest {
+					t.Errorf("unknown pair: got %v want %v", got, http.StatusBadRequest)
+				}
+				if _, orders := cancelAll("?pair=EUR-USD"); len(orders) != 2 {
+					t.Errorf("got %v cancelled orders want 2", len(orders))
+				}
+				if _, orders := cancelAll(""); len(orders) != 0 {
+					t.Errorf("got %v cancelled orders want 0", len(orders))
+				}
+
+				heartbeat := func(timeout string) int {
+					req, _ := http.NewRequest("POST", server.URL+"/orders/deadman", strings.NewReader(`{"timeout":"`+timeout+`"}`))
+					req.Header.Add("Authorization", "Basic "+basicAuth(user, user))
+					return do(t, req)
+				}
+				if got, want := heartbeat("10ms"), http.StatusBadRequest; got != want {
+					t.Errorf("got %v want %v", got, want)
+				}
+				if got, want := heartbeat("1m"), http.StatusOK; got != want {
+					t.Errorf("got %v want %v", got, want)
+				}
+				if got, want := heartbeat("0s"), http.StatusOK; got != want {
+					t.Errorf("got %v want %v", got, want)
+				}
+
+				timers := &fakeTimers{}
+				api.deadman.afterFunc = timers.afterFunc
+				order := place()
+				api.armDeadman(id, time.Second)
+				timers.advance(time.Second)
+				if order, err := db.Order(ctx, order.ID); err != nil || order.Status != statusCancelled {
+					t.Errorf("after timeout: got %+v, %v want a cancelled order", order, err)
+				}
+			})
+
+			t.Run("api key", func(t *testing.T) {
+				b, _ := json.Marshal(apiKeyRequest{Scopes: []string{scopeRead}})
+				req, _ := http.NewRequest("POST", server.URL+"/apikeys", bytes.NewBuffer(b))
+				req.Header.Add("Authorization", "Basic "+basicAuth(user, user))
+
+				resp, err := http.DefaultClient.Do(req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var key APIKey
+				if err := json.NewDecoder(resp.Body).Decode(&key); err != nil {
+					t.Fatal(err)
+				}
+				if key.Key == "" || key.Secret == "" {
+					t.Fatalf("missing key or secret in %+v", key)
+				}
+
+				now := time.Now().Unix()
+				read := signedRequest(t, key, "GET", server.URL+"/assets", nil, now)
+				if got, want := do(t, read), http.StatusOK; got != want {
+					t.Errorf("got %v want %v", got, want)
+				}
+				if got, want := do(t, read), http.StatusUnauthorized; got != want {
+					t.Errorf("replay: got %v want %v", got, want)
+				}
+				if got, want := do(t, signedRequest(t, key, "GET", server.URL+"/assets", nil, now-60)), http.StatusUnauthorized; got != want {
+					t.Errorf("expired: got %v want %v", got, want)
+				}
+				forged := signedRequest(t, APIKey{Key: key.Key, Secret: "wrong"}, "GET", server.URL+"/assets", nil, now)
+				if got, want := do(t, forged), http.StatusUnauthorized; got != want {
+					t.Errorf("forged: got %v want %v", got, want)
+				}
+				trade := signedRequest(t, key, "POST", server.URL+"/orders", []byte(`{}`), now)
+				if got, want := do(t, trade), http.StatusForbidden; got != want {
+					t.Errorf("scope: got %v want %v", got, want)
+				}
+
+				req, _ = http.NewRequest("DELETE", server.URL+"/apikeys/"+key.Key, nil)
+				req.Header.Add("Authorization", "Basic "+basicAuth(user, user))
+				if got, want := do(t, req), http.StatusNoContent; got != want {
+					t.Errorf("revoke: got %v want %v", got, want)
+				}
+				if got, want := do(t, signedRequest(t, key, "GET", server.URL+"/orders", nil, now)), http.StatusUnauthorized; got != want {
+					t.Errorf("revoked: got %v want %v", got, want)
+				}
+			})
+
+			t.Run("users", func(t *testing.T) {
+				username := "new-" + user
+				register := func(username, password string) int {
+					b, _ := json.Marshal(credentials{Username: username, Password: password})
+					req, _ := http.NewRequest("POST", server.URL+"/users", bytes.NewBuffer(b))
+					return do(t, req)
+				}
+				if got, want := register("a", "secret123"), http.StatusBadRequest; got != want {
+					t.Errorf("invalid username: got %v want %v", got, want)
+				}
+				if got, want := register(username, "secret"), http.StatusBadRequest; got != want {
+					t.Errorf("weak password: got %v want %v", got, want)
+				}
+				if got, want := register(username, "secret123"), http.StatusCreated; got != want {
+					t.Errorf("register: got %v want %v", got, want)
+				}
+				if got, want := register(username, "secret123"), http.StatusConflict; got != want {
+					t.Errorf("duplicate: got %v want %v", got, want)
+				}
+
+				b, _ := json.Marshal(credentials{Password: "secret456"})
+				req, _ := http.NewRequest("POST", server.URL+"/users/me/password", bytes.NewBuffer(b))
+				req.Header.Add("Authorization", "Basic "+basicAuth(username, "secret123"))
+				if got, want := do(t, req), http.StatusNoContent; got != want {
+					t.Errorf("change password: got %v want %v", got, want)
+				}
+				assets := func(password string) int {
+					req, _ := http.NewRequest("GET", server.URL+"/assets", nil)
+					req.Header.Add("Authorization", "Basic "+basicAuth(username, password))
+					return do(t, req)
+				}
+				if got, want := assets("secret123"), http.StatusForbidden; got != want {
+					t.Errorf("old password: got %v want %v", got, want)
+				}
+				if got, want := assets("secret456"), http.StatusOK; got != want {
+					t.Errorf("new password: got %v want %v", got, want)
+				}
+
+				disable := func(admin string) int {
+					req, _ := http.NewRequest("POST", server.URL+"/admin/users/"+username+"/disable", nil)
+					req.Header.Add("Authorization", "Basic "+basicAuth(admin, admin))
+					return do(t, req)
+				}
+				if got, want := disable(user), http.StatusForbidden; got != want {
+					t.Errorf("disable without admin role: got %v want %v", got, want)
+				}
+				admin, adminID := randomTestUser(t, db)
+				if err := db.SetUserRole(ctx, adminID, roleAdmin); err != nil {
+					t.Fatal(err)
+				}
+				if got, want := disable(admin), http.StatusOK; got != want {
+					t.Errorf("disable: got %v want %v", got, want)
+				}
+				if got, want := assets("secret456"), http.StatusForbidden; got != want {
+					t.Errorf("disabled user: got %v want %v", got, want)
+				}
+			})
+
+			t.Run("admin", func(t *testing.T) {
+				admin, adminID := randomTestUser(t, db)
+				if err := db.SetUserRole(ctx, adminID, roleAdmin); err != nil {
+					t.Fatal(err)
+				}
+				trader, traderID := randomTestUser(t, db, Asset{Asset: "EUR", Amount: 10}, Asset{Asset: "USD", Amount: 10})
+				call := func(method, path string, body any) *http.Response {
+					b, _ := json.Marshal(body)
+					req, _ := http.NewRequest(method, server.URL+path, bytes.NewBuffer(b))
+					req.Header.Add("Authorization", "Basic "+basicAuth(admin, admin))
+					resp, err := http.DefaultClient.Do(req)
+					if err != nil {
+						t.Fatal(err)
+					}
+					return resp
+				}
+
+				resp := call("POST", "/admin/users/"+trader+"/balance", balanceAdjustment{Asset: "EUR", Amount: 5, Reason: "deposit"})
+				var asset Asset
+				if err := json.NewDecoder(resp.Body).Decode(&asset); err != nil {
+					t.Fatal(err)
+				}
+				if got, want := asset.Amount, 15.0; got != want {
+					t.Errorf("credit: got %v want %v", got, want)
+				}
+				resp = call("POST", "/admin/users/"+trader+"/balance", balanceAdjustment{Asset: "EUR", Amount: -20, Reason: "withdraw"})
+				if got, want := resp.StatusCode, http.StatusBadRequest; got != want {
+					t.Errorf("debit over balance: got %v want %v", got, want)
+				}
+				resp = call("POST", "/admin/users/"+trader+"/balance", balanceAdjustment{Asset: "EUR", Amount: -5})
+				if got, want := resp.StatusCode, http.StatusBadRequest; got != want {
+					t.Errorf("missing reason: got %v want %v", got, want)
+				}
+				resp = call("POST", "/admin/users/"+trader+"/balance", balanceAdjustment{Asset: "EUT", Amount: 5, Reason: "typo"})
+				var jsonError JSONError
+				if err := json.NewDecoder(resp.Body).Decode(&jsonError); err != nil {
+					t.Fatal(err)
+				}
+				if resp.StatusCode != http.StatusBadRequest || jsonError.Code != "UNKNOWN_ASSET" {
+					t.Errorf("unknown asset: got %v %v", resp.StatusCode, jsonError.Code)
+				}
+				if assets, err := db.Assets(ctx, traderID); err != nil || len(assets) != 2 {
+					t.Errorf("got %+v, %v want the EUR and USD balances only", assets, err)
+				}
+
+				order := Order{userID: traderID, Side: "BUY", AssetPair: "EUR-USD", Amount: 1, Price: 1}
+				if err := db.SaveOrder(ctx, &order); err != nil {
+					t.Fatal(err)
+				}
+				resp = call("GET", "/admin/users/"+trader+"/orders", nil)
+				var orders []Order
+				if err := json.NewDecoder(resp.Body).Decode(&orders); err != nil {
+					t.Fatal(err)
+				}
+				if got, want := len(orders), 1; got != want {
+					t.Errorf("user orders: got %v want %v", got, want)
+				}
+				resp = call("DELETE", "/admin/orders/"+strconv.Itoa(order.ID), nil)
+				if got, want := resp.StatusCode, http.StatusOK; got != want {
+					t.Errorf("cancel: got %v want %v", got, want)
+				}
+				resp = call("DELETE", "/admin/orders/"+strconv.Itoa(order.ID), nil)
+				if got, want := resp.StatusCode, http.StatusConflict; got != want {
+					t.Errorf("cancel twice: got %v want %v", got, want)
+				}
+
+				resp = call("POST", "/admin/pairs/EUR-USD/halt", nil)
+				if got, want := resp.StatusCode, http.StatusOK; got != want {
+					t.Errorf("halt: got %v want %v", got, want)
+				}
+				b, _ := json.Marshal(Order{Side: "BUY", AssetPair: "EUR-USD", Amount: 1, Price: 1})
+				req, _ := http.NewRequest("POST", server.URL+"/orders", bytes.NewBuffer(b))
+				req.Header.Add("Authorization", "Basic "+basicAuth(trader, trader))
+				if got, want := do(t, req), http.StatusConflict; got != want {
+					t.Errorf("order on halted pair: got %v want %v", got, want)
+				}
+				call("POST", "/admin/pairs/EUR-USD/resume", nil)
+				req, _ = http.NewRequest("POST", server.URL+"/orders", bytes.NewBuffer(b))
+				req.Header.Add("Authorization", "Basic "+basicAuth(trader, trader))
+				if got, want := do(t, req), http.StatusOK; got != want {
+					t.Errorf("order on resumed pair: got %v want %v", got, want)
+				}
+
+				resp = call("GET", "/admin/audit", nil)
+				var entries []AuditEntry
+				if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+					t.Fatal(err)
+				}
+				var actions []string
+				for _, entry := range entries {
+					if entry.AdminID == adminID {
+						actions = append(actions, entry.Action)
+					}
+				}
+				if got, want := actions, []string{"set_pair_state", "set_pair_state", "cancel_order", "adjust_balance"}; !reflect.DeepEqual(got, want) {
+					t.Errorf("got %v want %v", got, want)
+				}
+			})
+
+			t.Run("orders idempotency", func(t *testing.T) {
+				user, id := randomTestUser(t, db, Asset{Asset: "EUR", Amount: 100}, Asset{Asset: "USD", Amount: 100})
+				post := func(key string, order Order) *http.Response {
+					b, _ := json.Marshal(order)
+					req, _ := http.NewRequest("POST", server.URL+"/orders", bytes.NewBuffer(b))
+					req.Header.Add("Authorization", "Basic "+basicAuth(user, user))
+					req.Header.Add(idempotencyKeyHeader, key)
+					resp, err := http.DefaultClient.Do(req)
+					if err != nil {
+						t.Fatal(err)
+					}
+					return resp
+				}
+				order := Order{Side: "BUY", AssetPair: "EUR-USD", Amount: 1, Price: 1}
+
+				first := post("key-1", order)
+				retry := post("key-1", order)
+				if got, want := retry.StatusCode, first.StatusCode; got != want {
+					t.Errorf("got %v want %v", got, want)
+				}
+				if retry.Header.Get(idempotentReplayed) != "true" {
+					t.Errorf("response not replayed")
+				}
+				orders, err := db.UserOrders(ctx, id, OrderFilter{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got, want := len(orders), 1; got != want {
+					t.Errorf("got %v orders want %v", got, want)
+				}
+
+				order.Amount = 2
+				if got, want := post("key-1", order).StatusCode, http.StatusUnprocessableEntity; got != want {
+					t.Errorf("reused key: got %v want %v", got, want)
+				}
+
+				expiring := newTestAPI(db, fakeMatcher{})
+				expiring.idempotencyTTL = 0
+				server := httptest.NewServer(expiring.routes())
+				defer server.Close()
+				b, _ := json.Marshal(order)
+				req, _ := http.NewRequest("POST", server.URL+"/orders", bytes.NewBuffer(b))
+				req.Header.Add("Authorization", "Basic "+basicAuth(user, user))
+				req.Header.Add(idempotencyKeyHeader, "key-1")
+				if got, want := do(t, req), http.StatusOK; got != want {
+					t.Errorf("expired key: got %v want %v", got, want)
+				}
+				if orders, _ = db.UserOrders(ctx, id, OrderFilter{}); len(orders) != 2 {
+					t.Errorf("got %v orders want 2", len(orders))
+				}
+			})
+
+			t.Run("orders validation", func(t *testing.T) {
+				b, _ := json.Marshal(Order{Side: "HOLD", AssetPair: "EUR-USD", Amount: -1, Price: 0})
+				req, _ := http.NewRequest("POST", server.URL+"/orders", bytes.NewBuffer(b))
+				req.Header.Add("Authorization", "Basic "+basicAuth(user, user))
+
+				resp, err := http.DefaultClient.Do(req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got, want := resp.StatusCode, http.StatusBadRequest; got != want {
+					t.Errorf("got %v want %v", got, want)
+				}
+				var jsonError JSONError
+				if err := json.NewDecoder(resp.Body).Decode(&jsonError); err != nil {
+					t.Fatal(err)
+				}
+				if got, want := jsonError.Code, "VALIDATION_FAILED"; got != want {
+					t.Errorf("got %v want %v", got, want)
+				}
+				var fields []string
+				for _, f := range jsonError.Fields {
+					fields = append(fields, f.Field)
+				}
+				if got, want := fields, []string{"amount", "price", "side"}; !reflect.DeepEqual(got, want) {
 					t.Errorf("got %v want %v", got, want)
 				}
 			})
@@ -127,7 +712,7 @@ func Test_api(t *testing.T) {
 			t.Run("orders insufficient funds", func(t *testing.T) {
 				user, _ := randomTestUser(t, db)
 				for _, side := range []string{"SELL", "BUY"} {
-					b, _ := json.Marshal(Order{Amount: 1, AssetPair: "EUR-USD", Side: side})
+					b, _ := json.Marshal(Order{Amount: 1, Price: 1, AssetPair: "EUR-USD", Side: side})
 
 					req, _ := http.NewRequest("POST", server.URL+"/orders", bytes.NewBuffer(b))
 					req.Header.Add("Authorization", "Basic "+basicAuth(user, user))
@@ -149,18 +734,591 @@ func Test_api(t *testing.T) {
 	}
 }
 
+func TestReadiness(t *testing.T) {
+	ctx := context.Background()
+	for _, name := range []string{"mem", "postgres", "sqlite"} {
+		t.Run(name, func(t *testing.T) {
+			db := storeFactory(t, name)
+			_, id := randomTestUser(t, db)
+			if err := db.SaveOrder(ctx, &Order{userID: id, Side: "BUY", AssetPair: "EUR-USD", Amount: 1, Price: 1}); err != nil {
+				t.Fatal(err)
+			}
+			api := newAPI(db, newArgon2idHasher(), defaultConfig())
+			handler := api.routes()
+			get := func(path string) (int, readiness) {
+				w := httptest.NewRecorder()
+				handler.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+				var status readiness
+				_ = json.NewDecoder(w.Body).Decode(&status)
+				return w.Code, status
+			}
+
+			if got, _ := get("/healthz"); got != http.StatusOK {
+				t.Errorf("healthz: got %v want %v", got, http.StatusOK)
+			}
+			code, status := get("/readyz")
+			if code != http.StatusServiceUnavailable || status.Components["books"].Ready || !status.Components["database"].Ready {
+				t.Errorf("before restore: got %v %+v", code, status)
+			}
+			if got, _ := get("/pairs"); got != http.StatusServiceUnavailable {
+				t.Errorf("pairs before restore: got %v want %v", got, http.StatusServiceUnavailable)
+			}
+
+			if err := api.restore(ctx); err != nil {
+				t.Fatal(err)
+			}
+			if code, status := get("/readyz"); code != http.StatusOK || !status.Ready {
+				t.Errorf("after restore: got %v %+v", code, status)
+			}
+			if buy, _ := api.engines["EUR-USD"].Depth(); buy != 1 {
+				t.Errorf("got %v buy orders want 1", buy)
+			}
+		})
+	}
+}
+
+func TestRestoreMatches(t *testing.T) {
+	ctx := context.Background()
+	for _, name := range []string{"mem", "postgres", "sqlite"} {
+		t.Run(name, func(t *testing.T) {
+			db := storeFactory(t, name)
+			_, buyer := randomTestUser(t, db, Asset{Asset: "EUR", Amount: 10}, Asset{Asset: "USD", Amount: 10})
+			_, seller := randomTestUser(t, db, Asset{Asset: "EUR", Amount: 10}, Asset{Asset: "USD", Amount: 10})
+			// crossing orders left pending by a crash before their settlement
+			for _, order := range []Order{
+				{userID: buyer, Side: "BUY", AssetPair: "EUR-USD", Amount: 1, Price: 1.5},
+				{userID: seller, Side: "SELL", AssetPair: "EUR-USD", Amount: 1, Price: 1.5},
+			} {
+				if err := db.SaveOrder(ctx, &order); err != nil {
+					t.Fatal(err)
+				}
+			}
+			api := newTestAPI(db, newMatchMaker(defaultPairs[0].TickSize, nil))
+			start := time.Now().Add(-time.Minute)
+			if err := api.restore(ctx); err != nil {
+				t.Fatal(err)
+			}
+
+			trades, err := db.Trades(ctx, "EUR-USD", start, time.Now().Add(time.Minute))
+			if err != nil || len(trades) != 1 || trades[0].Price != 1.5 {
+				t.Errorf("got %+v, %v want the restored trade", trades, err)
+			}
+			candles, err := db.Candles(ctx, "EUR-USD", "1m", start, time.Now().Add(time.Minute))
+			if err != nil || len(candles) != 1 || candles[0].Close != 1.5 {
+				t.Errorf("got %+v, %v want the candle of the restored trade", candles, err)
+			}
+			if got, want := api.engines["EUR-USD"].Ticker().LastPrice, 1.5; got != want {
+				t.Errorf("got %v want %v", got, want)
+			}
+		})
+	}
+}
+
+// unreachableStore fails its pings with a driver error naming the server.
+type unreachableStore struct {
+	store
+}
+
+func (unreachableStore) Ping(context.Context) error {
+	return errors.New("failed to connect to `user=tranched database=tranched`: 10.0.0.5:5432: server error")
+}
+
+func TestReadinessDatabaseError(t *testing.T) {
+	w := httptest.NewRecorder()
+	newTestAPI(unreachableStore{newMem()}, fakeMatcher{}).routes().ServeHTTP(w, httptest.NewRequest("GET", "/readyz", nil))
+	var status readiness
+	if err := json.NewDecoder(w.Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := w.Code, http.StatusServiceUnavailable; got != want {
+		t.Errorf("got %v want %v", got, want)
+	}
+	if got, want := status.Components["database"].Error, ErrDatabaseUnreachable.Error(); got != want {
+		t.Errorf("got %q want %q", got, want)
+	}
+}
+
+func TestDeadline(t *testing.T) {
+	for _, name := range []string{"mem", "postgres", "sqlite"} {
+		t.Run(name, func(t *testing.T) {
+			db := storeFactory(t, name)
+			username, _ := randomTestUser(t, db, Asset{Asset: "EUR", Amount: 1})
+			api := newTestAPI(db, fakeMatcher{})
+			api.timeouts = timeoutsConfig{
+				Default: duration(time.Minute),
+				Routes:  map[string]duration{"GET /orders": duration(time.Nanosecond)},
+			}
+			handler := api.routes()
+			get := func(path string) int {
+				req := httptest.NewRequest("GET", path, nil)
+				req.Header.Add("Authorization", "Basic "+basicAuth(username, username))
+				w := httptest.NewRecorder()
+				handler.ServeHTTP(w, req)
+				return w.Code
+			}
+
+			if got, want := get("/orders"), http.StatusServiceUnavailable; got != want {
+				t.Errorf("got %v want %v", got, want)
+			}
+			if got, want := get("/assets"), http.StatusOK; got != want {
+				t.Errorf("got %v want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestPairStates(t *testing.T) {
+	ctx := context.Background()
+	for _, name := range []string{"mem", "postgres", "sqlite"} {
+		t.Run(name, func(t *testing.T) {
+			db := storeFactory(t, name)
+			admin, adminID := randomTestUser(t, db)
+			if err := db.SetUserRole(ctx, adminID, roleAdmin); err != nil {
+				t.Fatal(err)
+			}
+			trader, _ := randomTestUser(t, db, Asset{Asset: "EUR", Amount: 100}, Asset{Asset: "USD", Amount: 100})
+			bot, botID := randomTestUser(t, db, Asset{Asset: "EUR", Amount: 100}, Asset{Asset: "USD", Amount: 100})
+			api := newTestAPI(db, newMatchMaker(defaultPairs[0].TickSize, nil))
+			timers := &fakeTimers{}
+			api.deadman.afterFunc = timers.afterFunc
+			handler := api.routes()
+			call := func(username, method, path, body string) *httptest.ResponseRecorder {
+				req := httptest.NewRequest(method, path, strings.NewReader(body))
+				req.Header.Add("Authorization", "Basic "+basicAuth(username, username))
+				w := httptest.NewRecorder()
+				handler.ServeHTTP(w, req)
+				return w
+			}
+			placeAs := func(username string) (Order, int) {
+				w := call(username, "POST", "/orders", `{"side":"BUY","asset_pair":"EUR-USD","amount":1,"price":1.5}`)
+				var order Order
+				_ = json.NewDecoder(w.Body).Decode(&order)
+				return order, w.Code
+			}
+			place := func() (Order, int) {
+				return placeAs(trader)
+			}
+			setState := func(state string) {
+				if w := call(admin, "POST", "/admin/pairs/EUR-USD/state", `{"state":"`+state+`"}`); w.Code != http.StatusOK {
+					t.Fatalf("%s: got %v: %s", state, w.Code, w.Body)
+				}
+			}
+			forceCancel := func(order Order) int {
+				return call(admin, "DELETE", "/admin/orders/"+strconv.Itoa(order.ID), "").Code
+			}
+			first, _ := place()
+			second, _ := place()
+			quote, _ := placeAs(bot)
+
+			// halted freezes the book, cancellations included
+			setState(pairHalted)
+			if _, got := place(); got != http.StatusConflict {
+				t.Errorf("order on halted pair: got %v want %v", got, http.StatusConflict)
+			}
+			if got, want := forceCancel(first), http.StatusConflict; got != want {
+				t.Errorf("cancel on halted pair: got %v want %v", got, want)
+			}
+			// but the dead man's switch pulls the quotes of a client that gave up, before the pair reopens
+			api.armDeadman(botID, time.Second)
+			timers.advance(time.Second)
+			if order, err := db.Order(ctx, quote.ID); err != nil || order.Status != statusCancelled {
+				t.Errorf("got %+v, %v want a cancelled order", order, err)
+			}
+			if buy, _ := api.engines["EUR-USD"].Depth(); buy != 2 {
+				t.Errorf("got %v orders in the book want 2", buy)
+			}
+
+			setState(pairCancelOnly)
+			if _, got := place(); got != http.StatusConflict {
+				t.Errorf("order on cancel-only pair: got %v want %v", got, http.StatusConflict)
+			}
+			if got, want := forceCancel(first), http.StatusOK; got != want {
+				t.Errorf("cancel on cancel-only pair: got %v want %v", got, want)
+			}
+
+			// closed empties the book and cancels the pending orders
+			setState(pairClosed)
+			if got, want := forceCancel(second), http.StatusConflict; got != want {
+				t.Errorf("cancel on closed pair: got %v want %v", got, want)
+			}
+			if order, err := db.Order(ctx, second.ID); err != nil || order.Status != statusCancelled {
+				t.Errorf("got %+v, %v", order, err)
+			}
+			if buy, _ := api.engines["EUR-USD"].Depth(); buy != 0 {
+				t.Errorf("got %v orders in the book want 0", buy)
+			}
+
+			// the state survives a restart
+			restarted := newTestAPI(db, newMatchMaker(defaultPairs[0].TickSize, nil))
+			if err := restarted.restore(ctx); err != nil {
+				t.Fatal(err)
+			}
+			if got, want := restarted.engines["EUR-USD"].State(), pairClosed; got != want {
+				t.Errorf("got %v want %v", got, want)
+			}
+		})
+	}
+}
+
+// TestCancelWhileMatching races the cancellation of a resting order with a crossing order, the resting order must end
+// up either cancelled or filled with its match, in the book as in the store.
+func TestCancelWhileMatching(t *testing.T) {
+	ctx := context.Background()
+	for _, name := range []string{"mem", "postgres", "sqlite"} {
+		t.Run(name, func(t *testing.T) {
+			db := storeFactory(t, name)
+			maker, makerID := randomTestUser(t, db, Asset{Asset: "EUR", Amount: 1000}, Asset{Asset: "USD", Amount: 1000})
+			taker, takerID := randomTestUser(t, db, Asset{Asset: "EUR", Amount: 1000}, Asset{Asset: "USD", Amount: 1000})
+			api := newTestAPI(db, newMatchMaker(defaultPairs[0].TickSize, nil))
+			handler := api.routes()
+			call := func(username, method, path, body string) *httptest.ResponseRecorder {
+				req := httptest.NewRequest(method, path, strings.NewReader(body))
+				req.Header.Add("Authorization", "Basic "+basicAuth(username, username))
+				w := httptest.NewRecorder()
+				handler.ServeHTTP(w, req)
+				return w
+			}
+
+			for i := 0; i < 20; i++ {
+				w := call(maker, "POST", "/orders", `{"side":"SELL","asset_pair":"EUR-USD","amount":1,"price":1}`)
+				var resting Order
+				if err := json.NewDecoder(w.Body).Decode(&resting); err != nil || w.Code != http.StatusOK {
+					t.Fatalf("got %v, %v", w.Code, err)
+				}
+				var cancel, cross *httptest.ResponseRecorder
+				var wg sync.WaitGroup
+				wg.Add(2)
+				go func() {
+					defer wg.Done()
+					cancel = call(maker, "DELETE", "/orders/batch", "["+strconv.Itoa(resting.ID)+"]")
+				}()
+				go func() {
+					defer wg.Done()
+					cross = call(taker, "POST", "/orders", `{"side":"BUY","asset_pair":"EUR-USD","amount":1,"price":1}`)
+				}()
+				wg.Wait()
+
+				var results []batchResult
+				if err := json.NewDecoder(cancel.Body).Decode(&results); err != nil || len(results) != 1 {
+					t.Fatalf("got %v, %v", results, err)
+				}
+				var crossing orderResponse
+				if err := json.NewDecoder(cross.Body).Decode(&crossing); err != nil || cross.Code != http.StatusOK {
+					t.Fatalf("got %v, %v", cross.Code, err)
+				}
+				stored, err := db.Order(ctx, resting.ID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				switch results[0].Code {
+				case http.StatusOK:
+					if stored.Status != statusCancelled || crossing.Status != statusPending {
+						t.Errorf("cancelled: got %v and a %v crossing order", stored.Status, crossing.Status)
+					}
+					// the crossing order rests in place of the cancelled one, it is left for the next round
+					if w := call(taker, "DELETE", "/orders/batch", "["+strconv.Itoa(crossing.ID)+"]"); w.Code != http.StatusOK {
+						t.Fatalf("got %v", w.Code)
+					}
+				case http.StatusConflict:
+					if stored.Status != statusFilled || crossing.Status != statusFilled {
+						t.Errorf("matched: got %v and a %v crossing order", stored.Status, crossing.Status)
+					}
+				default:
+					t.Fatalf("got %v", results[0].Code)
+				}
+			}
+
+			if buy, sell := api.engines["EUR-USD"].Depth(); buy != 0 || sell != 0 {
+				t.Errorf("got %v buy and %v sell orders in the book want none", buy, sell)
+			}
+			for _, id := range []int{makerID, takerID} {
+				if pending, err := db.UserOrders(ctx, id, OrderFilter{Status: statusPending}); err != nil || len(pending) != 0 {
+					t.Errorf("got %v pending orders, %v want none", len(pending), err)
+				}
+			}
+		})
+	}
+}
+
+func TestIdempotentFailure(t *testing.T) {
+	for _, name := range []string{"mem", "postgres", "sqlite"} {
+		t.Run(name, func(t *testing.T) {
+			db := storeFactory(t, name)
+			_, id := randomTestUser(t, db)
+			api := newTestAPI(db, fakeMatcher{})
+			failure := "panic"
+			handler := api.idempotent(func(w http.ResponseWriter, r *http.Request) {
+				switch failure {
+				case "panic":
+					panic("handler failed")
+				case "unavailable":
+					RespondWithError(w, http.StatusServiceUnavailable, context.DeadlineExceeded)
+				default:
+					RespondWithJSON(w, http.StatusOK, "done")
+				}
+			})
+			serve := func() (code int, replayed, panicked bool) {
+				defer func() {
+					panicked = recover() != nil
+				}()
+				req := httptest.NewRequest("POST", "/orders", strings.NewReader("{}"))
+				req.Header.Add(idempotencyKeyHeader, "key")
+				req = req.WithContext(contextWithUserID(req.Context(), id))
+				w := httptest.NewRecorder()
+				handler(w, req)
+				return w.Code, w.Header().Get(idempotentReplayed) != "", false
+			}
+
+			if _, _, panicked := serve(); !panicked {
+				t.Fatal("the panic was swallowed")
+			}
+			// the key was released, the retry is handled instead of reported in progress
+			failure = "unavailable"
+			if code, _, _ := serve(); code != http.StatusServiceUnavailable {
+				t.Errorf("got %v want %v", code, http.StatusServiceUnavailable)
+			}
+			// the server error was not stored, the retry runs again
+			failure = ""
+			if code, replayed, _ := serve(); code != http.StatusOK || replayed {
+				t.Errorf("got %v, replayed %v want %v handled", code, replayed, http.StatusOK)
+			}
+			if code, replayed, _ := serve(); code != http.StatusOK || !replayed {
+				t.Errorf("got %v, replayed %v want %v replayed", code, replayed, http.StatusOK)
+			}
+		})
+	}
+}
+
+func TestBodyLimit(t *testing.T) {
+	db := newMem()
+	username, _ := randomTestUser(t, db)
+	handler := newTestAPI(db, fakeMatcher{}).routes()
+	for _, tt := range []struct {
+		name string
+		size int
+		code int
+	}{
+		{name: "small", size: 10, code: http.StatusBadRequest},
+		{name: "too large", size: maxBodySize + 1, code: http.StatusRequestEntityTooLarge},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			body := `{"orders":"` + strings.Repeat("a", tt.size) + `"}`
+			req := httptest.NewRequest("POST", "/orders/batch", strings.NewReader(body))
+			req.Header.Add("Authorization", "Basic "+basicAuth(username, username))
+			req.Header.Add(idempotencyKeyHeader, "key-"+tt.name)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			if got, want := w.Code, tt.code; got != want {
+				t.Errorf("got %v want %v: %s", got, want, w.Body)
+			}
+		})
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	for _, name := range []string{"mem", "postgres", "sqlite"} {
+		t.Run(name, func(t *testing.T) {
+			db := storeFactory(t, name)
+			username, _ := randomTestUser(t, db, Asset{Asset: "EUR", Amount: 1})
+			api := newTestAPI(db, fakeMatcher{})
+			api.limiters = map[string]*rateLimiter{
+				classQueries:       newRateLimiter(bucketConfig{Rate: 1, Burst: 2}),
+				classAuthFailures:  newRateLimiter(bucketConfig{Rate: 1, Burst: 3}),
+				classRegistrations: newRateLimiter(bucketConfig{Rate: 0.01, Burst: 1}),
+			}
+			api.lockout = newLoginLockout(lockoutConfig{MaxFailures: 2, Duration: duration(time.Minute)})
+			handler := api.routes()
+			get := func(path, username, password, addr string) *httptest.ResponseRecorder {
+				req := httptest.NewRequest("GET", path, nil)
+				req.RemoteAddr = addr
+				if username != "" {
+					req.Header.Add("Authorization", "Basic "+basicAuth(username, password))
+				}
+				w := httptest.NewRecorder()
+				handler.ServeHTTP(w, req)
+				return w
+			}
+
+			t.Run("queries", func(t *testing.T) {
+				for i, want := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+					w := get("/assets", username, username, "192.0.2.1:1234")
+					if w.Code != want {
+						t.Fatalf("request %d: got %v want %v", i, w.Code, want)
+					}
+					if got, want := w.Header().Get(rateLimitHeader), "2"; got != want {
+						t.Errorf("got %v want %v", got, want)
+					}
+					if w.Code == http.StatusTooManyRequests {
+						if got, want := w.Header().Get("Retry-After"), "1"; got != want {
+							t.Errorf("got %v want %v", got, want)
+						}
+						var jsonError JSONError
+						if err := json.NewDecoder(w.Body).Decode(&jsonError); err != nil {
+							t.Fatal(err)
+						}
+						if got, want := jsonError.Code, "RATE_LIMITED"; got != want {
+							t.Errorf("got %v want %v", got, want)
+						}
+					}
+				}
+				// the user is limited from any address, and the address for any user or on the public routes
+				other, _ := randomTestUser(t, db)
+				for _, tt := range []struct {
+					name, username, addr string
+					want                 int
+				}{
+					{name: "same user, other address", username: username, addr: "192.0.2.9:1234", want: http.StatusTooManyRequests},
+					{name: "other user, same address", username: other, addr: "192.0.2.1:1234", want: http.StatusTooManyRequests},
+					{name: "other user, other address", username: other, addr: "192.0.2.9:1234", want: http.StatusOK},
+				} {
+					if got := get("/assets", tt.username, tt.username, tt.addr).Code; got != tt.want {
+						t.Errorf("%s: got %v want %v", tt.name, got, tt.want)
+					}
+				}
+				if got, want := get("/pairs", "", "", "192.0.2.1:1234").Code, http.StatusTooManyRequests; got != want {
+					t.Errorf("got %v want %v", got, want)
+				}
+				if got, want := get("/pairs", "", "", "192.0.2.10:1234").Code, http.StatusOK; got != want {
+					t.Errorf("got %v want %v", got, want)
+				}
+			})
+
+			t.Run("lockout", func(t *testing.T) {
+				for i, want := range []int{http.StatusForbidden, http.StatusForbidden, http.StatusTooManyRequests} {
+					if got := get("/apikeys", username, "wrong", "192.0.2.2:1234").Code; got != want {
+						t.Errorf("request %d: got %v want %v", i, got, want)
+					}
+				}
+				w := get("/apikeys", username, username, "192.0.2.3:1234")
+				if got, want := w.Code, http.StatusTooManyRequests; got != want {
+					t.Errorf("got %v want %v", got, want)
+				}
+				var jsonError JSONError
+				if err := json.NewDecoder(w.Body).Decode(&jsonError); err != nil {
+					t.Fatal(err)
+				}
+				if got, want := jsonError.Code, "LOGIN_LOCKED"; got != want {
+					t.Errorf("got %v want %v", got, want)
+				}
+			})
+
+			t.Run("unknown username", func(t *testing.T) {
+				// locked out like an existing username, not to tell them apart
+				for i, want := range []int{http.StatusForbidden, http.StatusForbidden, http.StatusTooManyRequests} {
+					if got := get("/apikeys", "nobody-"+username, "wrong", "192.0.2.6:1234").Code; got != want {
+						t.Errorf("request %d: got %v want %v", i, got, want)
+					}
+				}
+			})
+
+			t.Run("registrations", func(t *testing.T) {
+				register := func(username, addr string) int {
+					req := httptest.NewRequest("POST", "/users", strings.NewReader(`{"username":"`+username+`","password":"secret123"}`))
+					req.RemoteAddr = addr
+					w := httptest.NewRecorder()
+					handler.ServeHTTP(w, req)
+					return w.Code
+				}
+				for i, want := range []int{http.StatusCreated, http.StatusTooManyRequests} {
+					if got := register("reg-"+strconv.Itoa(i)+"-"+username, "192.0.2.7:1234"); got != want {
+						t.Errorf("request %d: got %v want %v", i, got, want)
+					}
+				}
+				if got, want := register("reg-other-"+username, "192.0.2.8:1234"), http.StatusCreated; got != want {
+					t.Errorf("got %v want %v", got, want)
+				}
+			})
+
+			t.Run("auth failures", func(t *testing.T) {
+				other, _ := randomTestUser(t, db)
+				for i, want := range []int{http.StatusForbidden, http.StatusForbidden, http.StatusForbidden, http.StatusTooManyRequests} {
+					// a username each, for the lockout not to kick in first
+					if got := get("/apikeys", "nobody-"+strconv.Itoa(i), "wrong", "192.0.2.4:1234").Code; got != want {
+						t.Errorf("request %d: got %v want %v", i, got, want)
+					}
+				}
+				if got, want := get("/apikeys", other, other, "192.0.2.4:1234").Code, http.StatusTooManyRequests; got != want {
+					t.Errorf("got %v want %v", got, want)
+				}
+				if got, want := get("/apikeys", other, other, "192.0.2.5:1234").Code, http.StatusOK; got != want {
+					t.Errorf("got %v want %v", got, want)
+				}
+			})
+		})
+	}
+}
+
+func newTestAPI(db store, m matchmaker) api {
+	h := &health{}
+	h.loaded.Store(true)
+	return api{
+		db:      db,
+		engines: map[string]*engine{"EUR-USD": newEngine(defaultPairs[0], m)},
+		replays: newReplayCache(),
+		deadman: newDeadmanSwitch(),
+		health:  h,
+		hasher:  newArgon2idHasher(),
+
+		idempotencyTTL: defaultIdempotencyTTL,
+		maxBatchSize:   defaultMaxBatchSize,
+	}
+}
+
 func basicAuth(username, password string) string {
 	auth := username + ":" + password
 	return base64.StdEncoding.EncodeToString([]byte(auth))
 }
 
+func signedRequest(t *testing.T, key APIKey, method, url string, body []byte, timestamp int64) *http.Request {
+	t.Helper()
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := strconv.FormatInt(timestamp, 10)
+	req.Header.Add(apiKeyHeader, key.Key)
+	req.Header.Add(timestampHeader, ts)
+	req.Header.Add(signatureHeader, sign(key.Secret, ts, method, req.URL.RequestURI(), body))
+	return req
+}
+
+func do(t *testing.T, req *http.Request) int {
+	t.Helper()
+	if req.GetBody != nil {
+		req.Body, _ = req.GetBody()
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	return resp.StatusCode
+}
+
+// fakeMatcher holds every order and never matches.
 type fakeMatcher struct {
 }
 
-func (f fakeMatcher) VerifyMatch() []Order {
+func (f fakeMatcher) VerifyMatch(context.Context) []Order {
 	return nil
 }
 
-func (f fakeMatcher) AddOrderAndMatch(Order) []Order {
+func (f fakeMatcher) AddOrderAndMatch(context.Context, Order) []Order {
 	return nil
 }
+
+func (f fakeMatcher) Cancel(int) bool {
+	return true
+}
+
+func (f fakeMatcher) Contains(int) bool {
+	return true
+}
+
+func (f fakeMatcher) Depth() (int, int) {
+	return 0, 0
+}
+
+func (f fakeMatcher) BestPrices() (float64, float64) {
+	return 0, 0
+}
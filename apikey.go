@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	scopeRead     = "read"
+	scopeTrade    = "trade"
+	scopeWithdraw = "withdraw"
+
+	apiKeyHeader    = "X-API-Key"
+	timestampHeader = "X-API-Timestamp"
+	signatureHeader = "X-API-Signature"
+
+	// signatureWindow is how far the request timestamp may drift from the server clock.
+	signatureWindow = 30 * time.Second
+)
+
+var scopes = []string{scopeRead, scopeTrade, scopeWithdraw}
+
+type APIKey struct {
+	id        int
+	userID    int
+	Key       string    `json:"key"`
+	Secret    string    `json:"secret,omitempty"`
+	Scopes    []string  `json:"scopes"`
+	Revoked   bool      `json:"revoked"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (k APIKey) allows(scope string) bool {
+	return slices.Contains(k.Scopes, scope)
+}
+
+func newAPIKey(userID int, scopes []string) (APIKey, error) {
+	key, err := randomHex(16)
+	if err != nil {
+		return APIKey{}, err
+	}
+	secret, err := randomHex(32)
+	if err != nil {
+		return APIKey{}, err
+	}
+	return APIKey{
+		userID:    userID,
+		Key:       key,
+		Secret:    secret,
+		Scopes:    scopes,
+		CreatedAt: time.Now().UTC(),
+	}, nil
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("cannot generate random bytes: %v", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// sign returns the hex encoded HMAC-SHA256 of timestamp, method, request uri and body joined by newlines. None of the
+// first three may hold a newline, so no byte can move from a field to the next without changing the signature.
+func sign(secret, timestamp, method, uri string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "\n" + method + "\n" + uri + "\n"))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// replayCache remembers the signatures seen during the signature window, so a captured request
+// cannot be sent twice while its timestamp is still valid.
+type replayCache struct {
+	mu   sync.Mutex
+	seen map[string]time.Time
+}
+
+func newReplayCache() *replayCache {
+	return &replayCache{seen: make(map[string]time.Time)}
+}
+
+func (c *replayCache) add(signature string, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for sig, expire := range c.seen {
+		if now.After(expire) {
+			delete(c.seen, sig)
+		}
+	}
+	if _, exist := c.seen[signature]; exist {
+		return false
+	}
+	c.seen[signature] = now.Add(2 * signatureWindow)
+	return true
+}
+
+// auth authenticates the request with a signed api key when one is provided, and falls back to basic auth.
+func (api api) auth(scope string, next http.HandlerFunc) http.HandlerFunc {
+	basic := api.basicAuth(next)
+	signed := api.apiKeyAuth(scope, next)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(apiKeyHeader) != "" {
+			signed(w, r)
+			return
+		}
+		basic(w, r)
+	}
+}
+
+func (api api) apiKeyAuth(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if api.authBlocked(w, r) {
+			return
+		}
+		key, err := api.db.APIKey(r.Context(), r.Header.Get(apiKeyHeader))
+		if err != nil {
+			if errors.Is(err, ErrNotFound) {
+				api.authFailed(r)
+				RespondWithError(w, http.StatusUnauthorized, ErrUnauthorized)
+				return
+			}
+			RespondWithError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if key.Revoked {
+			api.authFailed(r)
+			RespondWithError(w, http.StatusUnauthorized, ErrUnauthorized)
+			return
+		}
+
+		now := time.Now()
+		timestamp := r.Header.Get(timestampHeader)
+		seconds, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil {
+			api.authFailed(r)
+			RespondWithError(w, http.StatusUnauthorized, ErrUnauthorized)
+			return
+		}
+		if drift := now.Sub(time.Unix(seconds, 0)); drift > signatureWindow || drift < -signatureWindow {
+			api.authFailed(r)
+			RespondWithError(w, http.StatusUnauthorized, ErrUnauthorized)
+			return
+		}
+
+		body, ok := readBody(w, r)
+		if !ok {
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		expected := sign(key.Secret, timestamp, r.Method, r.URL.RequestURI(), body)
+		signature := r.Header.Get(signatureHeader)
+		if !hmac.Equal([]byte(expected), []byte(signature)) {
+			api.authFailed(r)
+			RespondWithError(w, http.StatusUnauthorized, ErrUnauthorized)
+			return
+		}
+		if !api.replays.add(signature, now) {
+			api.authFailed(r)
+			RespondWithError(w, http.StatusUnauthorized, ErrUnauthorized)
+			return
+		}
+		if !key.allows(scope) {
+			RespondWithError(w, http.StatusForbidden, ErrMissingScope)
+			return
+		}
+		user, err := api.db.UserByID(r.Context(), key.userID)
+		if err != nil {
+			RespondWithError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if user.Disabled {
+			RespondWithError(w, http.StatusForbidden, ErrUserDisabled)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(contextWithUserID(r.Context(), key.userID)))
+	}
+}
+
+type apiKeyRequest struct {
+	Scopes []string `json:"scopes"`
+}
+
+func (api api) createAPIKey(w http.ResponseWriter, r *http.Request) {
+	userID, err := mustUserID(r)
+	if err != nil {
+		RespondWithError(w, http.StatusForbidden, err)
+		return
+	}
+	var req apiKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		RespondWithError(w, http.StatusBadRequest, err)
+		return
+	}
+	if len(req.Scopes) == 0 {
+		RespondWithError(w, http.StatusBadRequest, "at least one scope is required")
+		return
+	}
+	for _, scope := range req.Scopes {
+		if !slices.Contains(scopes, scope) {
+			RespondWithError(w, http.StatusBadRequest, fmt.Sprintf("unknown scope %q", scope))
+			return
+		}
+	}
+	key, err := newAPIKey(userID, req.Scopes)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := api.db.SaveAPIKey(r.Context(), &key); err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err)
+		return
+	}
+	// the secret is only disclosed once, at creation
+	RespondWithJSON(w, http.StatusOK, key)
+}
+
+func (api api) apiKeys(w http.ResponseWriter, r *http.Request) {
+	userID, err := mustUserID(r)
+	if err != nil {
+		RespondWithError(w, http.StatusForbidden, err)
+		return
+	}
+	keys, err := api.db.UserAPIKeys(r.Context(), userID)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err)
+		return
+	}
+	for i := range keys {
+		keys[i].Secret = ""
+	}
+	RespondWithJSON(w, http.StatusOK, keys)
+}
+
+func (api api) revokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	userID, err := mustUserID(r)
+	if err != nil {
+		RespondWithError(w, http.StatusForbidden, err)
+		return
+	}
+	if err := api.db.RevokeAPIKey(r.Context(), userID, r.PathValue("key")); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			RespondWithError(w, http.StatusNotFound, ErrAPIKeyNotFound)
+			return
+		}
+		RespondWithError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,28 @@
+package main
+
+import "testing"
+
+func TestSign(t *testing.T) {
+	const secret, timestamp = "secret", "1718000000"
+	signature := sign(secret, timestamp, "POST", "/orders?a", []byte("b"))
+
+	tests := []struct {
+		name            string
+		timestamp, uri  string
+		method, payload string
+	}{
+		{name: "byte moved from the uri to the body", timestamp: timestamp, method: "POST", uri: "/orders?", payload: "ab"},
+		{name: "byte moved from the body to the uri", timestamp: timestamp, method: "POST", uri: "/orders?ab", payload: ""},
+		{name: "byte moved from the timestamp to the method", timestamp: "171800000", method: "0POST", uri: "/orders?a", payload: "b"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if sign(secret, tt.timestamp, tt.method, tt.uri, []byte(tt.payload)) == signature {
+				t.Errorf("same signature as the original request")
+			}
+		})
+	}
+	if got, want := sign(secret, timestamp, "POST", "/orders?a", []byte("b")), signature; got != want {
+		t.Errorf("got %v want %v", got, want)
+	}
+}
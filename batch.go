@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+const defaultMaxBatchSize = 50
+
+var ErrBatchSize = errors.New("invalid batch size")
+
+// batchResult is the outcome of one order of a batch, Code is the status the same request sent alone would get and
+// ErrorCode the code of its error.
+type batchResult struct {
+	Code      int            `json:"code"`
+	Order     *orderResponse `json:"order,omitempty"`
+	ErrorCode string         `json:"error_code,omitempty"`
+	Error     string         `json:"error,omitempty"`
+	Fields    []FieldError   `json:"fields,omitempty"`
+}
+
+func (b *batchResult) fail(id string, code int, err error) {
+	var jsonError JSONError
+	b.Code, jsonError = newJSONError(id, code, err)
+	b.ErrorCode, b.Error, b.Fields = jsonError.Code, jsonError.Error, jsonError.Fields
+}
+
+func (api api) checkBatchSize(n int) error {
+	if n == 0 || n > api.maxBatchSize {
+		return fmt.Errorf("%w: a batch must hold between 1 and %d orders", ErrBatchSize, api.maxBatchSize)
+	}
+	return nil
+}
+
+// placeOrders checks all the orders first, the available balance is verified against the sum of the orders of the
+// batch, then the accepted orders are submitted in the order of the request.
+func (api api) placeOrders(w http.ResponseWriter, r *http.Request) {
+	userID, err := mustUserID(r)
+	if err != nil {
+		RespondWithError(w, http.StatusForbidden, err)
+		return
+	}
+	var orders []Order
+	if err := json.NewDecoder(r.Body).Decode(&orders); err != nil {
+		RespondWithError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := api.checkBatchSize(len(orders)); err != nil {
+		RespondWithError(w, http.StatusBadRequest, err)
+		return
+	}
+	balances, err := api.available(r.Context(), userID)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	results := make([]batchResult, len(orders))
+	engines := make([]*engine, len(orders))
+	spent := make(map[string]float64)
+	for i := range orders {
+		orders[i].userID = userID
+		engine, status, err := api.checkOrder(orders[i])
+		if err != nil {
+			results[i].fail(requestID(r.Context()), status, err)
+			continue
+		}
+		asset, amount := cost(orders[i])
+		if balances[asset] < spent[asset]+amount {
+			results[i].fail(requestID(r.Context()), http.StatusBadRequest, ErrInsufficientFunds)
+			continue
+		}
+		spent[asset] += amount
+		engines[i] = engine
+	}
+
+	for i, order := range orders {
+		if engines[i] == nil {
+			continue
+		}
+		placed, status, err := api.placeOrder(r.Context(), engines[i], order)
+		if err != nil {
+			results[i].fail(requestID(r.Context()), status, err)
+			continue
+		}
+		results[i] = batchResult{Code: status, Order: &placed}
+	}
+	RespondWithJSON(w, http.StatusOK, results)
+}
+
+// cancelOrders cancels the user's orders by id, each cancellation succeeds or fails on its own.
+func (api api) cancelOrders(w http.ResponseWriter, r *http.Request) {
+	userID, err := mustUserID(r)
+	if err != nil {
+		RespondWithError(w, http.StatusForbidden, err)
+		return
+	}
+	var ids []int
+	if err := json.NewDecoder(r.Body).Decode(&ids); err != nil {
+		RespondWithError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := api.checkBatchSize(len(ids)); err != nil {
+		RespondWithError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	results := make([]batchResult, len(ids))
+	for i, id := range ids {
+		order, err := api.db.Order(r.Context(), id)
+		if errors.Is(err, ErrNotFound) || err == nil && order.userID != userID {
+			err = ErrOrderNotFound
+		}
+		if err == nil {
+			order, err = api.cancelOrder(r.Context(), order, nil)
+		}
+		if err != nil {
+			results[i].fail(requestID(r.Context()), cancelStatus(err), err)
+			continue
+		}
+		results[i] = batchResult{Code: http.StatusOK, Order: &orderResponse{Order: order, Fills: []Execution{}}}
+	}
+	RespondWithJSON(w, http.StatusOK, results)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// maxCandles bounds the number of candles returned by a single request.
+const maxCandles = 1000
+
+var ErrUnknownInterval = errors.New("interval must be 1m, 5m, 1h or 1d")
+
+var intervals = map[string]time.Duration{
+	"1m": time.Minute,
+	"5m": 5 * time.Minute,
+	"1h": time.Hour,
+	"1d": 24 * time.Hour,
+}
+
+type Candle struct {
+	Start       time.Time `json:"start"`
+	Open        float64   `json:"open"`
+	High        float64   `json:"high"`
+	Low         float64   `json:"low"`
+	Close       float64   `json:"close"`
+	BaseVolume  float64   `json:"base_volume"`
+	QuoteVolume float64   `json:"quote_volume"`
+	// openedAt and closedAt are the times of the first and last trades, the open and close are theirs whatever the
+	// order the trades are recorded in.
+	openedAt, closedAt time.Time
+}
+
+func (c *Candle) add(e Execution) {
+	base, quote := e.volumes()
+	if c.Open == 0 {
+		c.Open, c.High, c.Low, c.openedAt, c.closedAt = e.Price, e.Price, e.Price, e.Time, e.Time
+	}
+	c.merge(Candle{Open: e.Price, High: e.Price, Low: e.Price, Close: e.Price, BaseVolume: base, QuoteVolume: quote, openedAt: e.Time, closedAt: e.Time})
+}
+
+// merge rolls other, starting at the same time, into the candle.
+func (c *Candle) merge(other Candle) {
+	if other.openedAt.Before(c.openedAt) {
+		c.Open, c.openedAt = other.Open, other.openedAt
+	}
+	if !other.closedAt.Before(c.closedAt) {
+		c.Close, c.closedAt = other.Close, other.closedAt
+	}
+	c.High, c.Low = max(c.High, other.High), min(c.Low, other.Low)
+	c.BaseVolume += other.BaseVolume
+	c.QuoteVolume += other.QuoteVolume
+}
+
+// buildCandles aggregates time ordered executions into candles of the given interval.
+func buildCandles(execs []Execution, interval time.Duration) []Candle {
+	var candles []Candle
+	for _, e := range execs {
+		start := e.Time.Truncate(interval)
+		if n := len(candles); n == 0 || !candles[n-1].Start.Equal(start) {
+			candles = append(candles, Candle{Start: start})
+		}
+		candles[len(candles)-1].add(e)
+	}
+	return candles
+}
+
+// recordExecution persists the trade and rolls it into the candles of every interval, all or nothing. Failing to do
+// so doesn't revert the settlement, it is only logged.
+func (api api) recordExecution(ctx context.Context, e Execution) {
+	candles := make(map[string]Candle, len(intervals))
+	for name, interval := range intervals {
+		c := Candle{Start: e.Time.Truncate(interval)}
+		c.add(e)
+		candles[name] = c
+	}
+	if err := api.db.RecordTrade(ctx, &e, candles); err != nil {
+		slog.ErrorContext(ctx, "cannot record trade", "pair", e.Pair, "price", e.Price, "amount", e.Amount, "err", err)
+	}
+}
+
+// backfillCandles rebuilds the candles of every interval from the trades executed between from and to.
+func backfillCandles(ctx context.Context, db store, pair string, from, to time.Time) error {
+	for name, interval := range intervals {
+		// widen the range to whole candles, partial candles would overwrite complete ones
+		start, end := from.Truncate(interval), to.Truncate(interval).Add(interval)
+		trades, err := db.Trades(ctx, pair, start, end)
+		if err != nil {
+			return err
+		}
+		candles := buildCandles(trades, interval)
+		if err := db.SaveCandles(ctx, pair, name, candles); err != nil {
+			return err
+		}
+		slog.Info("candles backfilled", "pair", pair, "interval", name, "trades", len(trades), "candles", len(candles))
+	}
+	return nil
+}
+
+func (api api) candles(w http.ResponseWriter, r *http.Request) {
+	pair := r.PathValue("pair")
+	if _, ok := api.engines[pair]; !ok {
+		RespondWithError(w, http.StatusNotFound, ErrUnknownPair)
+		return
+	}
+	query := r.URL.Query()
+	name := query.Get("interval")
+	if name == "" {
+		name = "1m"
+	}
+	interval, ok := intervals[name]
+	if !ok {
+		RespondWithError(w, http.StatusBadRequest, ErrUnknownInterval)
+		return
+	}
+
+	to := time.Now()
+	if v := query.Get("to"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			RespondWithError(w, http.StatusBadRequest, fmt.Errorf("invalid to: %v", err))
+			return
+		}
+		to = t
+	}
+	from := to.Add(-maxCandles * interval)
+	if v := query.Get("from"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			RespondWithError(w, http.StatusBadRequest, fmt.Errorf("invalid from: %v", err))
+			return
+		}
+		from = t
+	}
+	if to.Sub(from) > maxCandles*interval {
+		RespondWithError(w, http.StatusBadRequest, fmt.Sprintf("at most %d candles can be requested at once", maxCandles))
+		return
+	}
+
+	candles, err := api.db.Candles(r.Context(), pair, name, from, to)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if candles == nil {
+		candles = []Candle{}
+	}
+	RespondWithJSON(w, http.StatusOK, candles)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCandles(t *testing.T) {
+	ctx := context.Background()
+	start := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	execs := []Execution{
+		{Pair: "EUR-USD", Price: 1.0, Amount: 10, Time: start.Add(10 * time.Second)},
+		{Pair: "EUR-USD", Price: 1.2, Amount: 10, Time: start.Add(30 * time.Second)},
+		{Pair: "EUR-USD", Price: 0.8, Amount: 10, Time: start.Add(50 * time.Second)},
+		{Pair: "EUR-USD", Price: 0.9, Amount: 20, Time: start.Add(3 * time.Minute)},
+		{Pair: "EUR-USD", Price: 1.1, Amount: 10, Time: start.Add(6 * time.Minute)},
+	}
+	expected := map[string][]Candle{
+		"1m": {
+			{Start: start, Open: 1, High: 1.2, Low: 0.8, Close: 0.8, BaseVolume: 10 + 12 + 8, QuoteVolume: 30},
+			{Start: start.Add(3 * time.Minute), Open: 0.9, High: 0.9, Low: 0.9, Close: 0.9, BaseVolume: 18, QuoteVolume: 20},
+			{Start: start.Add(6 * time.Minute), Open: 1.1, High: 1.1, Low: 1.1, Close: 1.1, BaseVolume: 11, QuoteVolume: 10},
+		},
+		"5m": {
+			{Start: start, Open: 1, High: 1.2, Low: 0.8, Close: 0.9, BaseVolume: 10 + 12 + 8 + 18, QuoteVolume: 50},
+			{Start: start.Add(5 * time.Minute), Open: 1.1, High: 1.1, Low: 1.1, Close: 1.1, BaseVolume: 11, QuoteVolume: 10},
+		},
+		"1h": {
+			{Start: start, Open: 1, High: 1.2, Low: 0.8, Close: 1.1, BaseVolume: 10 + 12 + 8 + 18 + 11, QuoteVolume: 60},
+		},
+	}
+
+	for _, storeType := range []string{"mem", "postgres", "sqlite"} {
+		t.Run(storeType+" live", func(t *testing.T) {
+			db := storeFactory(t, storeType)
+			api := newTestAPI(db, fakeMatcher{})
+			for _, e := range execs {
+				api.recordExecution(ctx, e)
+			}
+			for name, want := range expected {
+				got, err := db.Candles(ctx, "EUR-USD", name, start, start.Add(time.Hour))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !equalCandles(got, want) {
+					t.Errorf("%s: got %+v want %+v", name, got, want)
+				}
+			}
+		})
+
+		t.Run(storeType+" backfill", func(t *testing.T) {
+			db := storeFactory(t, storeType)
+			for _, e := range execs {
+				if err := db.SaveTrade(ctx, &e); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// a stale candle is replaced
+			if err := db.SaveCandles(ctx, "EUR-USD", "1m", []Candle{{Start: start, Open: 5}}); err != nil {
+				t.Fatal(err)
+			}
+			if err := backfillCandles(ctx, db, "EUR-USD", start, start.Add(time.Hour)); err != nil {
+				t.Fatal(err)
+			}
+			for name, want := range expected {
+				got, err := db.Candles(ctx, "EUR-USD", name, start, start.Add(time.Hour))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !equalCandles(got, want) {
+					t.Errorf("%s: got %+v want %+v", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+// equalCandles compares candles ignoring the time location and the float rounding of the volumes.
+func equalCandles(got, want []Candle) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		g, w := got[i], want[i]
+		if !g.Start.Equal(w.Start) || math.Abs(g.BaseVolume-w.BaseVolume) > 1e-9 {
+			return false
+		}
+		g.Start, g.BaseVolume, w.BaseVolume = w.Start, 0, 0
+		if !reflect.DeepEqual(g, w) {
+			return false
+		}
+	}
+	return true
+}
@@ -1,18 +1,342 @@
 package main
 
 import (
-	"crypto/sha256"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log/slog"
+	"os"
+	"regexp"
+	"strconv"
+	"time"
 )
 
-func seed(db store) {
+// Config is read from a json file, then overridden by the environment variables documented in the readme.
+type Config struct {
+	Listen     listenConfig     `json:"listen"`
+	Database   databaseConfig   `json:"database"`
+	Pairs      []Pair           `json:"pairs"`
+	Limits     limitsConfig     `json:"limits"`
+	Timeouts   timeoutsConfig   `json:"timeouts"`
+	RateLimits rateLimitsConfig `json:"rate_limits"`
+	// PasswordHasher hashes the new passwords, argon2id or bcrypt
+	PasswordHasher string    `json:"password_hasher"`
+	Log            logConfig `json:"log"`
+}
+
+type listenConfig struct {
+	Addr string    `json:"addr"`
+	TLS  tlsConfig `json:"tls"`
+}
+
+// tlsConfig serves https when both files are set.
+type tlsConfig struct {
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+}
+
+// databaseConfig selects the store. Driver is postgres, sized by the pool settings whose zero values keep the pgx
+// defaults, or sqlite, stored in the file at Path.
+type databaseConfig struct {
+	Driver          string   `json:"driver"`
+	Path            string   `json:"path"`
+	URL             string   `json:"url"`
+	MaxConns        int32    `json:"max_conns"`
+	MinConns        int32    `json:"min_conns"`
+	MaxConnLifetime duration `json:"max_conn_lifetime"`
+}
+
+type limitsConfig struct {
+	MaxBatchSize   int      `json:"max_batch_size"`
+	IdempotencyTTL duration `json:"idempotency_ttl"`
+}
+
+// timeoutsConfig bounds the time spent on a request, Routes are keyed by the route pattern, e.g. "POST /orders", and
+// override Default. A zero timeout leaves the request without deadline.
+type timeoutsConfig struct {
+	Default duration            `json:"default"`
+	Routes  map[string]duration `json:"routes"`
+}
+
+// longest returns the longest timeout, zero when a route has no deadline.
+func (c timeoutsConfig) longest() time.Duration {
+	if c.Default == 0 {
+		return 0
+	}
+	longest := c.Default
+	for _, timeout := range c.Routes {
+		if timeout == 0 {
+			return 0
+		}
+		longest = max(longest, timeout)
+	}
+	return time.Duration(longest)
+}
+
+// rateLimitsConfig sets the token buckets of the route classes, kept per client address, and per user on the
+// authenticated routes.
+type rateLimitsConfig struct {
+	Orders        bucketConfig  `json:"orders"`
+	Queries       bucketConfig  `json:"queries"`
+	AuthFailures  bucketConfig  `json:"auth_failures"`
+	Registrations bucketConfig  `json:"registrations"`
+	Lockout       lockoutConfig `json:"lockout"`
+}
+
+// bucketConfig refills Rate tokens per second up to Burst, a zero rate disables the limit.
+type bucketConfig struct {
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst"`
+}
+
+// lockoutConfig locks a username out for Duration after MaxFailures failed logins in a row, zero disables it.
+type lockoutConfig struct {
+	MaxFailures int      `json:"max_failures"`
+	Duration    duration `json:"duration"`
+}
+
+type logConfig struct {
+	Level  string `json:"level"`
+	Format string `json:"format"`
+}
+
+const (
+	driverPostgres = "postgres"
+	driverSQLite   = "sqlite"
+)
+
+const defaultRequestTimeout = 10 * time.Second
+
+var (
+	pairNameRegexp = regexp.MustCompile(`^[A-Z]{3}-[A-Z]{3}$`)
+	routeRegexp    = regexp.MustCompile(`^[A-Z]+ /`)
+)
+
+func defaultConfig() Config {
+	return Config{
+		Listen:   listenConfig{Addr: ":8080"},
+		Database: databaseConfig{Driver: driverPostgres},
+		Pairs:    defaultPairs,
+		Limits: limitsConfig{
+			MaxBatchSize:   defaultMaxBatchSize,
+			IdempotencyTTL: duration(defaultIdempotencyTTL),
+		},
+		Timeouts: timeoutsConfig{Default: duration(defaultRequestTimeout)},
+		RateLimits: rateLimitsConfig{
+			Orders:        bucketConfig{Rate: 10, Burst: 20},
+			Queries:       bucketConfig{Rate: 20, Burst: 40},
+			AuthFailures:  bucketConfig{Rate: 0.1, Burst: 10},
+			Registrations: bucketConfig{Rate: 0.01, Burst: 5},
+			Lockout:       lockoutConfig{MaxFailures: 5, Duration: duration(15 * time.Minute)},
+		},
+		PasswordHasher: hasherArgon2id,
+		Log:            logConfig{Level: "info", Format: "text"},
+	}
+}
+
+// loadConfig reads the configuration file, if any, applies the environment and validates the result.
+func loadConfig(path string, getenv func(string) string) (Config, error) {
+	cfg := defaultConfig()
+	if path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return cfg, fmt.Errorf("cannot open config: %v", err)
+		}
+		defer f.Close()
+		if err := decodeConfig(f, &cfg); err != nil {
+			return cfg, err
+		}
+	}
+	if err := cfg.applyEnv(getenv); err != nil {
+		return cfg, err
+	}
+	return cfg, cfg.validate()
+}
+
+func decodeConfig(r io.Reader, cfg *Config) error {
+	decoder := json.NewDecoder(r)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(cfg); err != nil {
+		return fmt.Errorf("cannot read config: %v", err)
+	}
+	return nil
+}
+
+func (cfg *Config) applyEnv(getenv func(string) string) error {
+	if v := getenv("PORT"); v != "" {
+		cfg.Listen.Addr = ":" + v
+	}
+	texts := map[string]*string{
+		"LISTEN_ADDR":     &cfg.Listen.Addr,
+		"TLS_CERT_FILE":   &cfg.Listen.TLS.CertFile,
+		"TLS_KEY_FILE":    &cfg.Listen.TLS.KeyFile,
+		"DB_DRIVER":       &cfg.Database.Driver,
+		"DB_PATH":         &cfg.Database.Path,
+		"DB_URL":          &cfg.Database.URL,
+		"LOG_LEVEL":       &cfg.Log.Level,
+		"LOG_FORMAT":      &cfg.Log.Format,
+		"PASSWORD_HASHER": &cfg.PasswordHasher,
+	}
+	for name, field := range texts {
+		if v := getenv(name); v != "" {
+			*field = v
+		}
+	}
+	ints := map[string]*int32{
+		"DB_MAX_CONNS": &cfg.Database.MaxConns,
+		"DB_MIN_CONNS": &cfg.Database.MinConns,
+	}
+	for name, field := range ints {
+		if v := getenv(name); v != "" {
+			n, err := strconv.ParseInt(v, 10, 32)
+			if err != nil {
+				return fmt.Errorf("invalid %s: %v", name, err)
+			}
+			*field = int32(n)
+		}
+	}
+	if v := getenv("REQUEST_TIMEOUT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("invalid REQUEST_TIMEOUT: %v", err)
+		}
+		cfg.Timeouts.Default = duration(d)
+	}
+	return nil
+}
+
+// validate reports every invalid setting at once.
+func (cfg Config) validate() error {
+	var errs []error
+	fail := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	if cfg.Listen.Addr == "" {
+		fail("listen.addr is required")
+	}
+	if (cfg.Listen.TLS.CertFile == "") != (cfg.Listen.TLS.KeyFile == "") {
+		fail("listen.tls needs both cert_file and key_file")
+	}
+	switch cfg.Database.Driver {
+	case driverPostgres:
+	case driverSQLite:
+		if cfg.Database.Path == "" {
+			fail("database.path is required with the sqlite driver")
+		}
+	default:
+		fail("database.driver must be postgres or sqlite")
+	}
+	if cfg.Database.MaxConns < 0 || cfg.Database.MinConns < 0 || cfg.Database.MaxConnLifetime < 0 {
+		fail("database pool settings must be positive")
+	}
+	if cfg.Database.MaxConns > 0 && cfg.Database.MinConns > cfg.Database.MaxConns {
+		fail("database.min_conns must be at most max_conns")
+	}
+
+	if len(cfg.Pairs) == 0 {
+		fail("at least one pair is required")
+	}
+	names := make(map[string]bool)
+	for _, pair := range cfg.Pairs {
+		if !pairNameRegexp.MatchString(pair.Name) || pair.Base != pair.Name[:3] || pair.Quote != pair.Name[4:] {
+			fail("pair %q: name must be BASE-QUOTE with 3 letters codes matching base and quote", pair.Name)
+		}
+		if names[pair.Name] {
+			fail("pair %q is listed twice", pair.Name)
+		}
+		names[pair.Name] = true
+		for name, v := range map[string]float64{
+			"tick_size": pair.TickSize, "lot_size": pair.LotSize, "price_band_percent": pair.PriceBandPercent,
+			"min_amount": pair.MinAmount, "max_amount": pair.MaxAmount,
+			"min_notional": pair.MinNotional, "max_notional": pair.MaxNotional,
+			"circuit_breaker.max_move_percent": pair.CircuitBreaker.MaxMovePercent,
+		} {
+			if v < 0 {
+				fail("pair %q: %s must be positive", pair.Name, name)
+			}
+		}
+		if pair.MaxAmount > 0 && pair.MinAmount > pair.MaxAmount {
+			fail("pair %q: min_amount must be at most max_amount", pair.Name)
+		}
+		if pair.MaxNotional > 0 && pair.MinNotional > pair.MaxNotional {
+			fail("pair %q: min_notional must be at most max_notional", pair.Name)
+		}
+		if cb := pair.CircuitBreaker; cb.MaxMovePercent > 0 && (cb.Window <= 0 || cb.Cooldown <= 0) {
+			fail("pair %q: circuit_breaker needs a window and a cooldown", pair.Name)
+		}
+		for name, v := range map[string]float64{"maker_percent": pair.Fees.MakerPercent, "taker_percent": pair.Fees.TakerPercent} {
+			if v < 0 || v >= 100 {
+				fail("pair %q: fees.%s must be in [0, 100)", pair.Name, name)
+			}
+		}
+	}
+
+	if cfg.Limits.MaxBatchSize < 1 {
+		fail("limits.max_batch_size must be at least 1")
+	}
+	if time.Duration(cfg.Limits.IdempotencyTTL) <= 0 {
+		fail("limits.idempotency_ttl must be positive")
+	}
+	if cfg.Timeouts.Default < 0 {
+		fail("timeouts.default must be positive")
+	}
+	for route, timeout := range cfg.Timeouts.Routes {
+		if !routeRegexp.MatchString(route) {
+			fail("timeouts.routes: %q must be a route pattern like \"GET /orders\"", route)
+		}
+		if timeout < 0 {
+			fail("timeouts.routes: %q must be positive", route)
+		}
+	}
+	for name, bucket := range map[string]bucketConfig{
+		"orders": cfg.RateLimits.Orders, "queries": cfg.RateLimits.Queries, "auth_failures": cfg.RateLimits.AuthFailures,
+		"registrations": cfg.RateLimits.Registrations,
+	} {
+		if bucket.Rate < 0 || bucket.Rate > 0 && bucket.Burst < 1 {
+			fail("rate_limits.%s needs a positive rate and a burst of at least 1", name)
+		}
+	}
+	if lockout := cfg.RateLimits.Lockout; lockout.MaxFailures < 0 || lockout.MaxFailures > 0 && lockout.Duration <= 0 {
+		fail("rate_limits.lockout needs positive max_failures and duration")
+	}
+
+	if cfg.PasswordHasher != hasherArgon2id && cfg.PasswordHasher != hasherBcrypt {
+		fail("password_hasher must be argon2id or bcrypt")
+	}
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(cfg.Log.Level)); err != nil {
+		fail("log.level must be debug, info, warn or error")
+	}
+	if cfg.Log.Format != "text" && cfg.Log.Format != "json" {
+		fail("log.format must be text or json")
+	}
+	return errors.Join(errs...)
+}
+
+// newLogger returns the logger of the configuration, the records logged with a request context carry its id.
+func newLogger(cfg logConfig, w io.Writer) *slog.Logger {
+	var level slog.Level
+	_ = level.UnmarshalText([]byte(cfg.Level))
+	opts := &slog.HandlerOptions{Level: level}
+	if cfg.Format == "json" {
+		return slog.New(contextHandler{slog.NewJSONHandler(w, opts)})
+	}
+	return slog.New(contextHandler{slog.NewTextHandler(w, opts)})
+}
+
+func seed(ctx context.Context, db store, hasher passwordHasher) {
 	seeds := []struct {
 		name     string
 		password string
+		role     string
 		assets   []Asset
 		orders   []Order
 	}{
-		{name: "admin", password: "admin", assets: []Asset{{Asset: "EUR", Amount: 10000}, {Asset: "EUR", Amount: 0}}},
+		{name: "admin", password: "admin", role: roleAdmin, assets: []Asset{{Asset: "EUR", Amount: 10000}, {Asset: "USD", Amount: 0}}},
 		{name: "1", password: "1", assets: []Asset{{Asset: "EUR", Amount: 300}, {Asset: "USD", Amount: 0}}, orders: []Order{{
 			Side:      "BUY",
 			AssetPair: "EUR-USD",
@@ -37,27 +361,28 @@ func seed(db store) {
 		{name: "user1", password: "password1", assets: []Asset{{Asset: "EUR", Amount: 10000}, {Asset: "USD", Amount: 10000}}},
 		{name: "user2", password: "password2", assets: []Asset{{Asset: "EUR", Amount: 10000}, {Asset: "USD", Amount: 10000}}},
 	}
-	if _, pwd, _ := db.User("admin"); len(pwd) != 0 {
+	if _, err := db.User(ctx, "admin"); err == nil {
 		slog.Info("db is already seeded")
 		return
 	}
 	slog.Info("seed db")
 	for _, s := range seeds {
-		pwd := sha256.Sum256([]byte(s.password))
-		id, err := db.SaveUser(s.name, pwd[:])
+		pwd, err := hasher.Hash(s.password)
 		if err != nil {
 			panic(err)
 		}
-		for _, asset := range s.assets {
-			asset.userID = id
-			err := db.SaveAsset(asset)
-			if err != nil {
+		id, err := db.SaveUser(ctx, s.name, pwd, s.assets...)
+		if err != nil {
+			panic(err)
+		}
+		if s.role != "" {
+			if err := db.SetUserRole(ctx, id, s.role); err != nil {
 				panic(err)
 			}
 		}
 		for _, order := range s.orders {
 			order.userID = id
-			err := db.SaveOrder(&order)
+			err := db.SaveOrder(ctx, &order)
 			if err != nil {
 				panic(err)
 			}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestLoadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	file := `{
+		"listen": {"addr": ":9000"},
+		"database": {"url": "postgres://file", "max_conns": 20, "max_conn_lifetime": "1h"},
+		"pairs": [{"name": "EUR-GBP", "base": "EUR", "quote": "GBP", "tick_size": 0.0001, "fees": {"maker_percent": 0.1, "taker_percent": 0.2}}],
+		"limits": {"max_batch_size": 10, "idempotency_ttl": "1h"},
+		"timeouts": {"default": "5s", "routes": {"GET /candles/{pair}": "30s"}},
+		"log": {"level": "debug", "format": "json"}
+	}`
+	if err := os.WriteFile(path, []byte(file), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	env := map[string]string{"PORT": "3000", "DB_URL": "postgres://env", "DB_MIN_CONNS": "5", "REQUEST_TIMEOUT": "2s", "PASSWORD_HASHER": "bcrypt"}
+	cfg, err := loadConfig(path, func(name string) string { return env[name] })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := cfg.Listen.Addr, ":3000"; got != want {
+		t.Errorf("got %v want %v", got, want)
+	}
+	if got, want := cfg.Database, (databaseConfig{Driver: driverPostgres, URL: "postgres://env", MaxConns: 20, MinConns: 5, MaxConnLifetime: duration(time.Hour)}); got != want {
+		t.Errorf("got %+v want %+v", got, want)
+	}
+	if got, want := cfg.Pairs[0].Fees, (feeConfig{MakerPercent: 0.1, TakerPercent: 0.2}); len(cfg.Pairs) != 1 || got != want {
+		t.Errorf("got %+v want %+v", cfg.Pairs, want)
+	}
+	if got, want := cfg.Limits.MaxBatchSize, 10; got != want {
+		t.Errorf("got %v want %v", got, want)
+	}
+	if got, want := cfg.Timeouts.Default, duration(2*time.Second); got != want {
+		t.Errorf("got %v want %v", got, want)
+	}
+	if got, want := cfg.Timeouts.Routes["GET /candles/{pair}"], duration(30*time.Second); got != want {
+		t.Errorf("got %v want %v", got, want)
+	}
+	if got, want := newPasswordHasher(cfg.PasswordHasher), passwordHasher(bcryptHasher{cost: bcrypt.DefaultCost}); got != want {
+		t.Errorf("got %v want %v", got, want)
+	}
+
+	if cfg, err := loadConfig("", func(string) string { return "" }); err != nil || cfg.Listen.Addr != ":8080" {
+		t.Errorf("defaults: got %v %v", cfg.Listen.Addr, err)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		update func(*Config)
+		want   string
+	}{
+		{name: "tls", update: func(c *Config) { c.Listen.TLS.CertFile = "cert.pem" }, want: "listen.tls"},
+		{name: "driver", update: func(c *Config) { c.Database.Driver = "mysql" }, want: "database.driver"},
+		{name: "sqlite path", update: func(c *Config) { c.Database.Driver = driverSQLite }, want: "database.path"},
+		{name: "pool", update: func(c *Config) { c.Database.MaxConns, c.Database.MinConns = 2, 4 }, want: "min_conns"},
+		{name: "no pairs", update: func(c *Config) { c.Pairs = nil }, want: "at least one pair"},
+		{name: "pair name", update: func(c *Config) { c.Pairs = []Pair{{Name: "EURUSD"}} }, want: "BASE-QUOTE"},
+		{name: "duplicate pair", update: func(c *Config) { c.Pairs = append(c.Pairs, c.Pairs[0]) }, want: "twice"},
+		{name: "fees", update: func(c *Config) {
+			c.Pairs = []Pair{{Name: "EUR-USD", Base: "EUR", Quote: "USD", Fees: feeConfig{TakerPercent: 100}}}
+		}, want: "taker_percent"},
+		{name: "batch", update: func(c *Config) { c.Limits.MaxBatchSize = 0 }, want: "max_batch_size"},
+		{name: "timeout", update: func(c *Config) { c.Timeouts.Default = duration(-time.Second) }, want: "timeouts.default"},
+		{name: "route timeout", update: func(c *Config) { c.Timeouts.Routes = map[string]duration{"/orders": 0} }, want: "route pattern"},
+		{name: "burst", update: func(c *Config) { c.RateLimits.Orders.Burst = 0 }, want: "rate_limits.orders"},
+		{name: "lockout", update: func(c *Config) { c.RateLimits.Lockout.Duration = 0 }, want: "rate_limits.lockout"},
+		{name: "password hasher", update: func(c *Config) { c.PasswordHasher = "md5" }, want: "password_hasher"},
+		{name: "log", update: func(c *Config) { c.Log.Format = "xml" }, want: "log.format"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := defaultConfig()
+			cfg.Pairs = append([]Pair(nil), cfg.Pairs...)
+			tt.update(&cfg)
+			if err := cfg.validate(); err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got %v want %v", err, tt.want)
+			}
+		})
+	}
+	if err := defaultConfig().validate(); err != nil {
+		t.Errorf("default config: %v", err)
+	}
+}
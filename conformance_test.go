@@ -0,0 +1,558 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStoreConformance(t *testing.T) {
+	for _, storeType := range []string{"mem", "postgres", "sqlite"} {
+		t.Run(storeType, func(t *testing.T) {
+			testStore(t, func(t *testing.T) store {
+				return storeFactory(t, storeType)
+			})
+		})
+	}
+}
+
+// testStore checks the behaviour every store implementation must share, newStore returns an empty store.
+func testStore(t *testing.T, newStore func(t *testing.T) store) {
+	ctx := context.Background()
+	t.Run("users", func(t *testing.T) {
+		db := newStore(t)
+		id, err := db.SaveUser(ctx, "alice", []byte("hash"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.SaveUser(ctx, "alice", []byte("other")); !errors.Is(err, ErrUserExists) {
+			t.Errorf("got %v want %v", err, ErrUserExists)
+		}
+		bob, err := db.SaveUser(ctx, "bob", []byte("hash"), Asset{Asset: "EUR", Amount: 10}, Asset{Asset: "USD"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assets, err := db.Assets(ctx, bob)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := len(assets), 2; got != want {
+			t.Fatalf("got %v want %v", got, want)
+		}
+		if assets[0].Asset != "EUR" || assets[0].Amount != 10 || assets[1].Asset != "USD" || assets[1].Amount != 0 {
+			t.Errorf("got %+v", assets)
+		}
+		// a failing balance leaves no user behind
+		if _, err := db.SaveUser(ctx, "carol", []byte("hash"), Asset{Asset: "EUR"}, Asset{Asset: "EUR"}); !errors.Is(err, ErrAssetExists) {
+			t.Errorf("got %v want %v", err, ErrAssetExists)
+		}
+
+		user, err := db.User(ctx, "alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if user.id != id || user.Username != "alice" || string(user.password) != "hash" || user.Role != roleUser || user.Disabled {
+			t.Errorf("got %+v", user)
+		}
+		if _, err := db.User(ctx, "carol"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("got %v want %v", err, ErrNotFound)
+		}
+		if _, err := db.UserByID(ctx, bob+1000); !errors.Is(err, ErrNotFound) {
+			t.Errorf("got %v want %v", err, ErrNotFound)
+		}
+
+		if err := db.UpdatePassword(ctx, id, []byte("new")); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.SetUserRole(ctx, id, roleAdmin); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.SetUserDisabled(ctx, id, true); err != nil {
+			t.Fatal(err)
+		}
+		user, err = db.UserByID(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(user.password) != "new" || user.Role != roleAdmin || !user.Disabled {
+			t.Errorf("got %+v", user)
+		}
+		for name, update := range map[string]func() error{
+			"password": func() error { return db.UpdatePassword(ctx, bob+1000, []byte("new")) },
+			"role":     func() error { return db.SetUserRole(ctx, bob+1000, roleAdmin) },
+			"disabled": func() error { return db.SetUserDisabled(ctx, bob+1000, true) },
+		} {
+			if err := update(); !errors.Is(err, ErrNotFound) {
+				t.Errorf("%s: got %v want %v", name, err, ErrNotFound)
+			}
+		}
+
+		users, err := db.Users(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(users) != 2 || users[0].Username != "alice" || users[1].Username != "bob" {
+			t.Errorf("got %+v", users)
+		}
+	})
+
+	t.Run("assets", func(t *testing.T) {
+		db := newStore(t)
+		_, id := randomTestUser(t, db, Asset{Asset: "EUR", Amount: 10}, Asset{Asset: "USD", Amount: 20})
+		if err := db.SaveAsset(ctx, Asset{userID: id, Asset: "EUR", Amount: 1}); !errors.Is(err, ErrAssetExists) {
+			t.Errorf("got %v want %v", err, ErrAssetExists)
+		}
+
+		assets, err := db.Assets(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(assets) != 2 || assets[0].Asset != "EUR" || assets[0].Amount != 10 || assets[1].Asset != "USD" || assets[1].Amount != 20 {
+			t.Fatalf("got %+v", assets)
+		}
+		if assets[0].id == assets[1].id {
+			t.Errorf("assets share the id %v", assets[0].id)
+		}
+
+		asset, err := db.AdjustAsset(ctx, id, "EUR", -4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if asset.id != assets[0].id || asset.Amount != 6 {
+			t.Errorf("got %+v", asset)
+		}
+		if _, err := db.AdjustAsset(ctx, id, "EUR", -7); !errors.Is(err, ErrInsufficientFunds) {
+			t.Errorf("got %v want %v", err, ErrInsufficientFunds)
+		}
+		if _, err := db.AdjustAsset(ctx, id, "GBP", -1); !errors.Is(err, ErrInsufficientFunds) {
+			t.Errorf("got %v want %v", err, ErrInsufficientFunds)
+		}
+		if _, err := db.AdjustAsset(ctx, id, "GBP", 5); err != nil {
+			t.Fatal(err)
+		}
+		assets, err = db.Assets(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := fmt.Sprint(balances(assets)), "map[EUR:6 GBP:5 USD:20]"; got != want {
+			t.Errorf("got %v want %v", got, want)
+		}
+		if assets, err := db.Assets(ctx, id+1000); err != nil || len(assets) != 0 {
+			t.Errorf("got %v, %v for an unknown user", assets, err)
+		}
+	})
+
+	t.Run("orders", func(t *testing.T) {
+		db := newStore(t)
+		_, id := randomTestUser(t, db)
+		_, other := randomTestUser(t, db)
+
+		first := Order{userID: id, ClientOrderID: "first", Side: "BUY", AssetPair: "EUR-USD", Amount: 1, Price: 2}
+		if err := db.SaveOrder(ctx, &first); err != nil {
+			t.Fatal(err)
+		}
+		if first.Status != statusPending || first.CreatedAt.IsZero() {
+			t.Errorf("got %+v", first)
+		}
+		second := Order{userID: id, Side: "SELL", AssetPair: "EUR-USD", Amount: 3, Price: 4}
+		if err := db.SaveOrder(ctx, &second); err != nil {
+			t.Fatal(err)
+		}
+		if first.ID == second.ID {
+			t.Errorf("orders share the id %v", first.ID)
+		}
+		duplicate := Order{userID: id, ClientOrderID: "first", Side: "BUY", AssetPair: "EUR-USD", Amount: 1, Price: 2}
+		if err := db.SaveOrder(ctx, &duplicate); !errors.Is(err, ErrDuplicateClientOrderID) {
+			t.Errorf("got %v want %v", err, ErrDuplicateClientOrderID)
+		}
+		otherOrder := Order{userID: other, ClientOrderID: "first", Side: "BUY", AssetPair: "EUR-USD", Amount: 1, Price: 2}
+		if err := db.SaveOrder(ctx, &otherOrder); err != nil {
+			t.Errorf("client order ids are per user: %v", err)
+		}
+
+		got, err := db.Order(ctx, first.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !sameOrder(got, first) {
+			t.Errorf("got %+v want %+v", got, first)
+		}
+		if _, err := db.Order(ctx, -1); !errors.Is(err, ErrNotFound) {
+			t.Errorf("got %v want %v", err, ErrNotFound)
+		}
+		got, err = db.OrderByClientID(ctx, id, "first")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !sameOrder(got, first) {
+			t.Errorf("got %+v want %+v", got, first)
+		}
+		if _, err := db.OrderByClientID(ctx, id, "unknown"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("got %v want %v", err, ErrNotFound)
+		}
+
+		orders, err := db.UserOrders(ctx, id, OrderFilter{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(orders) != 2 || !sameOrder(orders[0], first) || !sameOrder(orders[1], second) {
+			t.Errorf("got %+v", orders)
+		}
+		pending, err := db.PendingOrders(ctx, "EUR-USD")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pending) != 3 || pending[0].ID != first.ID || pending[1].ID != second.ID || pending[2].ID != otherOrder.ID {
+			t.Errorf("got %+v", pending)
+		}
+
+		if err := db.CancelOrder(ctx, second.ID); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.CancelOrder(ctx, second.ID); !errors.Is(err, ErrOrderNotPending) {
+			t.Errorf("got %v want %v", err, ErrOrderNotPending)
+		}
+		if err := db.CancelOrder(ctx, -1); !errors.Is(err, ErrNotFound) {
+			t.Errorf("got %v want %v", err, ErrNotFound)
+		}
+		if got, err := db.Order(ctx, second.ID); err != nil || got.Status != statusCancelled {
+			t.Errorf("got %+v, %v want a cancelled order", got, err)
+		}
+		if err := db.FillOrders(ctx, Fill{Order: second}); !errors.Is(err, ErrOrderNotPending) {
+			t.Errorf("got %v want %v", err, ErrOrderNotPending)
+		}
+		if err := db.FillOrders(ctx, Fill{Order: Order{ID: -1, userID: id, Side: "BUY", AssetPair: "EUR-USD", Amount: 1, Price: 1}}); !errors.Is(err, ErrNotFound) {
+			t.Errorf("got %v want %v", err, ErrNotFound)
+		}
+	})
+
+	t.Run("fill order", func(t *testing.T) {
+		db := newStore(t)
+		// the buyer has no USD balance yet, it is created by the settlement
+		_, id := randomTestUser(t, db, Asset{Asset: "EUR", Amount: 100})
+		order := Order{userID: id, Side: "BUY", AssetPair: "EUR-USD", Amount: 10, Price: 2}
+		if err := db.SaveOrder(ctx, &order); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.FillOrders(ctx, Fill{Order: order, FeePercent: 1}); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.FillOrders(ctx, Fill{Order: order, FeePercent: 1}); !errors.Is(err, ErrOrderNotPending) {
+			t.Errorf("got %v want %v", err, ErrOrderNotPending)
+		}
+		if got, err := db.Order(ctx, order.ID); err != nil || got.Status != statusFilled {
+			t.Errorf("got %+v, %v want a filled order", got, err)
+		}
+		assets, err := db.Assets(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := fmt.Sprint(balances(assets)), "map[EUR:80 USD:9.9]"; got != want {
+			t.Errorf("got %v want %v", got, want)
+		}
+
+		// both sides of a match are settled together, or not at all
+		_, seller := randomTestUser(t, db, Asset{Asset: "EUR", Amount: 100})
+		sell := Order{userID: seller, Side: "SELL", AssetPair: "EUR-USD", Amount: 10, Price: 2}
+		if err := db.SaveOrder(ctx, &sell); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.FillOrders(ctx, Fill{Order: sell}, Fill{Order: order}); !errors.Is(err, ErrOrderNotPending) {
+			t.Errorf("got %v want %v", err, ErrOrderNotPending)
+		}
+		if got, err := db.Order(ctx, sell.ID); err != nil || got.Status != statusPending {
+			t.Errorf("got %+v, %v want a pending order", got, err)
+		}
+		if assets, err := db.Assets(ctx, seller); err != nil || fmt.Sprint(balances(assets)) != "map[EUR:100]" {
+			t.Errorf("got %+v, %v want the balance unchanged", assets, err)
+		}
+	})
+
+	t.Run("api keys", func(t *testing.T) {
+		db := newStore(t)
+		_, id := randomTestUser(t, db)
+		key := APIKey{userID: id, Key: "key", Secret: "secret", Scopes: []string{scopeRead, scopeTrade}, CreatedAt: time.Now().Truncate(time.Microsecond)}
+		if err := db.SaveAPIKey(ctx, &key); err != nil {
+			t.Fatal(err)
+		}
+		duplicate := key
+		if err := db.SaveAPIKey(ctx, &duplicate); !errors.Is(err, ErrAPIKeyExists) {
+			t.Errorf("got %v want %v", err, ErrAPIKeyExists)
+		}
+		got, err := db.APIKey(ctx, "key")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.userID != id || got.Secret != "secret" || fmt.Sprint(got.Scopes) != fmt.Sprint(key.Scopes) || got.Revoked || !got.CreatedAt.Equal(key.CreatedAt) {
+			t.Errorf("got %+v want %+v", got, key)
+		}
+		if _, err := db.APIKey(ctx, "unknown"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("got %v want %v", err, ErrNotFound)
+		}
+		if err := db.RevokeAPIKey(ctx, id+1000, "key"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("got %v want %v", err, ErrNotFound)
+		}
+		if err := db.RevokeAPIKey(ctx, id, "key"); err != nil {
+			t.Fatal(err)
+		}
+		keys, err := db.UserAPIKeys(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(keys) != 1 || keys[0].Key != "key" || !keys[0].Revoked {
+			t.Errorf("got %+v", keys)
+		}
+	})
+
+	t.Run("trades and candles", func(t *testing.T) {
+		db := newStore(t)
+		start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+		for i, price := range []float64{3, 1, 2} {
+			trade := Execution{Pair: "EUR-USD", Price: price, Amount: 1, Time: start.Add(time.Duration(2-i) * time.Minute)}
+			if err := db.SaveTrade(ctx, &trade); err != nil {
+				t.Fatal(err)
+			}
+		}
+		trades, err := db.Trades(ctx, "EUR-USD", start, start.Add(2*time.Minute))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(trades) != 2 || trades[0].Price != 2 || !trades[0].Time.Equal(start) || trades[1].Price != 1 {
+			t.Errorf("got %+v", trades)
+		}
+
+		// recorded out of order, the open and close are still those of the earliest and latest trades
+		for _, trade := range []Execution{
+			{Pair: "EUR-USD", Price: 3, Amount: 1, Time: start.Add(50 * time.Second)},
+			{Pair: "EUR-USD", Price: 5, Amount: 1, Time: start.Add(30 * time.Second)},
+			{Pair: "EUR-USD", Price: 2, Amount: 1, Time: start.Add(10 * time.Second)},
+		} {
+			candle := Candle{Start: start}
+			candle.add(trade)
+			if err := db.RecordTrade(ctx, &trade, map[string]Candle{"1m": candle}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := db.SaveCandles(ctx, "EUR-USD", "1m", []Candle{{Start: start.Add(time.Minute), Open: 1, High: 1, Low: 1, Close: 1}}); err != nil {
+			t.Fatal(err)
+		}
+		candles, err := db.Candles(ctx, "EUR-USD", "1m", start, start.Add(time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := Candle{Start: start, Open: 2, High: 5, Low: 2, Close: 3, BaseVolume: 10, QuoteVolume: 3}
+		if len(candles) != 2 || !candles[0].Start.Equal(want.Start) || !candles[1].Start.Equal(start.Add(time.Minute)) {
+			t.Fatalf("got %+v", candles)
+		}
+		candles[0].Start = want.Start
+		if candles[0] != want {
+			t.Errorf("got %+v want %+v", candles[0], want)
+		}
+		if candles, err := db.Candles(ctx, "EUR-USD", "5m", start, start.Add(time.Hour)); err != nil || len(candles) != 0 {
+			t.Errorf("got %v, %v for another interval", candles, err)
+		}
+	})
+
+	t.Run("audit", func(t *testing.T) {
+		db := newStore(t)
+		_, admin := randomTestUser(t, db)
+		for _, action := range []string{"first", "second", "third"} {
+			entry := AuditEntry{AdminID: admin, Action: action, Target: "user", Details: "{}", CreatedAt: time.Now()}
+			if err := db.SaveAudit(ctx, &entry); err != nil {
+				t.Fatal(err)
+			}
+		}
+		entries, err := db.AuditLog(ctx, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 2 || entries[0].Action != "third" || entries[1].Action != "second" {
+			t.Errorf("got %+v", entries)
+		}
+	})
+
+	t.Run("audited actions", func(t *testing.T) {
+		db := newStore(t)
+		_, admin := randomTestUser(t, db)
+		_, id := randomTestUser(t, db, Asset{Asset: "EUR", Amount: 10})
+		order := Order{userID: id, Side: "BUY", AssetPair: "EUR-USD", Amount: 1, Price: 1}
+		if err := db.SaveOrder(ctx, &order); err != nil {
+			t.Fatal(err)
+		}
+		entry := func(action string) *AuditEntry {
+			return &AuditEntry{AdminID: admin, Action: action, Target: "user", CreatedAt: time.Now()}
+		}
+
+		if _, err := db.AdjustAssetAudited(ctx, id, "EUR", 5, entry("adjust")); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.SetUserDisabledAudited(ctx, id, true, entry("disable")); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.CancelOrderAudited(ctx, order.ID, entry("cancel")); err != nil {
+			t.Fatal(err)
+		}
+		// the failed actions leave no entry
+		if _, err := db.AdjustAssetAudited(ctx, id, "EUR", -100, entry("failed")); !errors.Is(err, ErrInsufficientFunds) {
+			t.Errorf("got %v want %v", err, ErrInsufficientFunds)
+		}
+		if err := db.SetUserDisabledAudited(ctx, id+1000, true, entry("failed")); !errors.Is(err, ErrNotFound) {
+			t.Errorf("got %v want %v", err, ErrNotFound)
+		}
+		if err := db.CancelOrderAudited(ctx, order.ID, entry("failed")); !errors.Is(err, ErrOrderNotPending) {
+			t.Errorf("got %v want %v", err, ErrOrderNotPending)
+		}
+		if err := db.CancelOrderAudited(ctx, order.ID+1000, entry("failed")); !errors.Is(err, ErrNotFound) {
+			t.Errorf("got %v want %v", err, ErrNotFound)
+		}
+
+		entries, err := db.AuditLog(ctx, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var actions []string
+		for _, e := range entries {
+			actions = append(actions, e.Action)
+		}
+		if got, want := strings.Join(actions, ","), "cancel,disable,adjust"; got != want {
+			t.Errorf("got %v want %v", got, want)
+		}
+		if got, err := db.Order(ctx, order.ID); err != nil || got.Status != statusCancelled {
+			t.Errorf("got %+v, %v", got, err)
+		}
+	})
+
+	t.Run("pair states", func(t *testing.T) {
+		db := newStore(t)
+		_, admin := randomTestUser(t, db)
+		_, id := randomTestUser(t, db, Asset{Asset: "EUR", Amount: 10})
+		pending := Order{userID: id, Side: "BUY", AssetPair: "EUR-USD", Amount: 1, Price: 1}
+		other := Order{userID: id, Side: "BUY", AssetPair: "BTC-EUR", Amount: 1, Price: 1}
+		for _, order := range []*Order{&pending, &other} {
+			if err := db.SaveOrder(ctx, order); err != nil {
+				t.Fatal(err)
+			}
+		}
+		entry := &AuditEntry{AdminID: admin, Action: "set_pair_state", Target: "EUR-USD", CreatedAt: time.Now()}
+		if err := db.SavePairState(ctx, "EUR-USD", pairHalted, entry); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.SavePairState(ctx, "EUR-USD", pairClosed, nil); err != nil {
+			t.Fatal(err)
+		}
+		states, err := db.PairStates(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := states, map[string]string{"EUR-USD": pairClosed}; !reflect.DeepEqual(got, want) {
+			t.Errorf("got %v want %v", got, want)
+		}
+		for order, want := range map[int]string{pending.ID: statusCancelled, other.ID: statusPending} {
+			if got, err := db.Order(ctx, order); err != nil || got.Status != want {
+				t.Errorf("got %+v, %v want %v", got, err, want)
+			}
+		}
+		if entries, err := db.AuditLog(ctx, 10); err != nil || len(entries) != 1 {
+			t.Errorf("got %+v, %v", entries, err)
+		}
+	})
+
+	t.Run("ping", func(t *testing.T) {
+		if err := newStore(t).Ping(ctx); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("cancelled context", func(t *testing.T) {
+		db := newStore(t)
+		_, id := randomTestUser(t, db, Asset{Asset: "EUR", Amount: 10})
+		cancelled, cancel := context.WithCancel(ctx)
+		cancel()
+		if _, err := db.User(cancelled, "alice"); !errors.Is(err, context.Canceled) {
+			t.Errorf("got %v want %v", err, context.Canceled)
+		}
+		if _, err := db.AdjustAsset(cancelled, id, "EUR", 1); !errors.Is(err, context.Canceled) {
+			t.Errorf("got %v want %v", err, context.Canceled)
+		}
+		expired, cancel := context.WithDeadline(ctx, time.Now().Add(-time.Second))
+		defer cancel()
+		if _, err := db.Assets(expired, id); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("got %v want %v", err, context.DeadlineExceeded)
+		}
+		if err := db.Ping(expired); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("got %v want %v", err, context.DeadlineExceeded)
+		}
+		if assets, err := db.Assets(ctx, id); err != nil || len(assets) != 1 || assets[0].Amount != 10 {
+			t.Errorf("got %+v, %v want the balance unchanged", assets, err)
+		}
+	})
+
+	t.Run("concurrent access", func(t *testing.T) {
+		db := newStore(t)
+		_, id := randomTestUser(t, db, Asset{Asset: "EUR", Amount: 0})
+		order := Order{userID: id, Side: "SELL", AssetPair: "EUR-USD", Amount: 1, Price: 1}
+		if err := db.SaveOrder(ctx, &order); err != nil {
+			t.Fatal(err)
+		}
+
+		const n = 20
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		var users, fills, clientOrders int
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if _, err := db.AdjustAsset(ctx, id, "EUR", 1); err != nil {
+					t.Error(err)
+				}
+				_, userErr := db.SaveUser(ctx, "concurrent", []byte("hash"))
+				fillErr := db.FillOrders(ctx, Fill{Order: order})
+				clientOrderErr := db.SaveOrder(ctx, &Order{userID: id, ClientOrderID: "once", Side: "BUY", AssetPair: "EUR-USD", Amount: 1, Price: 1})
+
+				mu.Lock()
+				defer mu.Unlock()
+				for _, result := range []struct {
+					err, expected error
+					count         *int
+				}{
+					{userErr, ErrUserExists, &users},
+					{fillErr, ErrOrderNotPending, &fills},
+					{clientOrderErr, ErrDuplicateClientOrderID, &clientOrders},
+				} {
+					if result.err == nil {
+						*result.count++
+					} else if !errors.Is(result.err, result.expected) {
+						t.Errorf("got %v want %v", result.err, result.expected)
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		if users != 1 || fills != 1 || clientOrders != 1 {
+			t.Errorf("got %v users, %v fills and %v client orders want 1 of each", users, fills, clientOrders)
+		}
+		assets, err := db.Assets(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the order received 1 EUR on top of the n credits
+		if got, want := balances(assets)["EUR"], float64(n+1); got != want {
+			t.Errorf("got %v want %v", got, want)
+		}
+	})
+}
+
+// sameOrder compares orders read back from a store, whose times may be in another location.
+func sameOrder(got, want Order) bool {
+	if !got.CreatedAt.Equal(want.CreatedAt) {
+		return false
+	}
+	got.CreatedAt = want.CreatedAt
+	return got == want
+}
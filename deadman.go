@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	minDeadmanTimeout = time.Second
+	maxDeadmanTimeout = time.Hour
+	// deadmanRetry is the delay before firing again when the orders couldn't all be cancelled
+	deadmanRetry = 5 * time.Second
+)
+
+var ErrDeadmanTimeout = fmt.Errorf("timeout must be 0 or between %v and %v", minDeadmanTimeout, maxDeadmanTimeout)
+
+// stopper is a timer that can be stopped before it fires.
+type stopper interface {
+	Stop() bool
+}
+
+// deadmanSwitch runs a callback for the users that stopped sending heartbeats before their timeout.
+type deadmanSwitch struct {
+	mu     sync.Mutex
+	timers map[int]stopper
+	// afterFunc starts the timers, time.AfterFunc unless replaced by a test
+	afterFunc func(time.Duration, func()) stopper
+}
+
+func newDeadmanSwitch() *deadmanSwitch {
+	return &deadmanSwitch{
+		timers: make(map[int]stopper),
+		afterFunc: func(d time.Duration, f func()) stopper {
+			return time.AfterFunc(d, f)
+		},
+	}
+}
+
+// arm starts or restarts the timer of the user, a zero timeout disarms it.
+func (d *deadmanSwitch) arm(userID int, timeout time.Duration, fire func()) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if timer, ok := d.timers[userID]; ok {
+		timer.Stop()
+		delete(d.timers, userID)
+	}
+	if timeout == 0 {
+		return
+	}
+	d.start(userID, timeout, fire)
+}
+
+// retry starts the timer of the user again after a failed fire, unless a heartbeat armed it in the meantime.
+func (d *deadmanSwitch) retry(userID int, timeout time.Duration, fire func()) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.timers[userID]; ok {
+		return
+	}
+	d.start(userID, timeout, fire)
+}
+
+// start sets the timer of the user, d.mu must be held.
+func (d *deadmanSwitch) start(userID int, timeout time.Duration, fire func()) {
+	var timer stopper
+	timer = d.afterFunc(timeout, func() {
+		d.mu.Lock()
+		// the timer may have been replaced by a heartbeat while firing
+		current := d.timers[userID] == timer
+		if current {
+			delete(d.timers, userID)
+		}
+		d.mu.Unlock()
+		if current {
+			fire()
+		}
+	})
+	d.timers[userID] = timer
+}
+
+type deadmanRequest struct {
+	Timeout duration `json:"timeout"`
+}
+
+type deadmanResponse struct {
+	Timeout  duration   `json:"timeout"`
+	CancelAt *time.Time `json:"cancel_at,omitempty"`
+}
+
+// armDeadman cancels all the orders of the user after timeout, unless armed again before. A failed cancellation is
+// retried until it succeeds or a heartbeat comes back.
+func (api api) armDeadman(userID int, timeout time.Duration) {
+	api.deadman.arm(userID, timeout, api.fireDeadman(userID))
+}
+
+func (api api) fireDeadman(userID int) func() {
+	return func() {
+		cancelled, err := api.cancelAll(context.Background(), userID, "")
+		ids := make([]int, len(cancelled))
+		for i, order := range cancelled {
+			ids[i] = order.ID
+		}
+		if err != nil {
+			slog.Error("cannot cancel orders on heartbeat timeout, retrying", "user", userID, "cancelled", ids, "err", err, "retry", deadmanRetry)
+			api.deadman.retry(userID, deadmanRetry, api.fireDeadman(userID))
+			return
+		}
+		slog.Warn("orders cancelled on heartbeat timeout", "user", userID, "orders", ids)
+	}
+}
+
+// heartbeat arms the dead man's switch of the user, each call pushes the deadline back.
+func (api api) heartbeat(w http.ResponseWriter, r *http.Request) {
+	userID, err := mustUserID(r)
+	if err != nil {
+		RespondWithError(w, http.StatusForbidden, err)
+		return
+	}
+	var req deadmanRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		RespondWithError(w, http.StatusBadRequest, err)
+		return
+	}
+	timeout := time.Duration(req.Timeout)
+	if timeout != 0 && (timeout < minDeadmanTimeout || timeout > maxDeadmanTimeout) {
+		RespondWithError(w, http.StatusBadRequest, ErrDeadmanTimeout)
+		return
+	}
+	api.armDeadman(userID, timeout)
+
+	resp := deadmanResponse{Timeout: req.Timeout}
+	if timeout != 0 {
+		cancelAt := time.Now().Add(timeout)
+		resp.CancelAt = &cancelAt
+	}
+	RespondWithJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeTimers replaces time.AfterFunc, the timers only fire when the test advances the clock.
+type fakeTimers struct {
+	mu     sync.Mutex
+	now    time.Duration
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	timers  *fakeTimers
+	at      time.Duration
+	fire    func()
+	stopped bool
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.timers.mu.Lock()
+	defer t.timers.mu.Unlock()
+	active := !t.stopped
+	t.stopped = true
+	return active
+}
+
+func (c *fakeTimers) afterFunc(d time.Duration, f func()) stopper {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	timer := &fakeTimer{timers: c, at: c.now + d, fire: f}
+	c.timers = append(c.timers, timer)
+	return timer
+}
+
+// advance moves the clock forward and runs the timers due, in the calling goroutine.
+func (c *fakeTimers) advance(d time.Duration) {
+	c.mu.Lock()
+	c.now += d
+	var due []*fakeTimer
+	for _, timer := range c.timers {
+		if !timer.stopped && timer.at <= c.now {
+			timer.stopped = true
+			due = append(due, timer)
+		}
+	}
+	c.mu.Unlock()
+	for _, timer := range due {
+		timer.fire()
+	}
+}
+
+func TestDeadmanSwitch(t *testing.T) {
+	d := newDeadmanSwitch()
+	timers := &fakeTimers{}
+	d.afterFunc = timers.afterFunc
+	fired := 0
+	fire := func() { fired++ }
+
+	// heartbeats keep pushing the deadline back
+	for i := 0; i < 5; i++ {
+		d.arm(1, 50*time.Millisecond, fire)
+		timers.advance(20 * time.Millisecond)
+	}
+	if fired != 0 {
+		t.Errorf("fired %v times before the timeout", fired)
+	}
+	timers.advance(30 * time.Millisecond)
+	if got, want := fired, 1; got != want {
+		t.Errorf("got %v want %v", got, want)
+	}
+	timers.advance(time.Hour)
+	if got, want := fired, 1; got != want {
+		t.Errorf("fired again: got %v want %v", got, want)
+	}
+
+	d.arm(2, 20*time.Millisecond, fire)
+	d.arm(2, 0, fire)
+	timers.advance(time.Hour)
+	if got, want := fired, 1; got != want {
+		t.Errorf("disarmed: got %v want %v", got, want)
+	}
+
+	// a retry doesn't replace the timer of a heartbeat
+	d.retry(3, time.Second, fire)
+	d.arm(4, time.Minute, fire)
+	d.retry(4, time.Second, fire)
+	timers.advance(time.Second)
+	if got, want := fired, 2; got != want {
+		t.Errorf("retried: got %v want %v", got, want)
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// persistTimeout bounds the store writes made under the engine lock, a stuck database must not block the pair for good.
+const persistTimeout = 5 * time.Second
+
+// engine serialises the access to the matchmaker of a pair and enforces the pair state.
+type engine struct {
+	mu         sync.Mutex
+	pair       Pair
+	state      string
+	reopenAt   time.Time
+	stats      tickerStats
+	breaker    circuitBreaker
+	matchmaker matchmaker
+	now        func() time.Time
+	// persistTimeout bounds persist in Cancel and SetState
+	persistTimeout time.Duration
+}
+
+func newEngine(pair Pair, m matchmaker) *engine {
+	return &engine{
+		pair:       pair,
+		state:      pairOpen,
+		breaker:    circuitBreaker{config: pair.CircuitBreaker},
+		matchmaker: m,
+		now:        time.Now,
+
+		persistTimeout: persistTimeout,
+	}
+}
+
+// Submit adds the order to the book, it returns the matched orders and the resulting executions.
+func (e *engine) Submit(ctx context.Context, order Order) ([]Order, []Execution, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := stateError(e.currentState()); err != nil {
+		return nil, nil, err
+	}
+	start := time.Now()
+	matches := e.matchmaker.AddOrderAndMatch(ctx, order)
+	matchingDuration.WithLabelValues(e.pair.Name).Observe(time.Since(start).Seconds())
+	ordersSubmitted.WithLabelValues(e.pair.Name, order.Side).Inc()
+	var execs []Execution
+	if len(matches) > 0 {
+		now := e.now()
+		execs = executions(e.pair.Name, matches, now)
+		orderMatches.WithLabelValues(e.pair.Name).Add(float64(len(execs)))
+		for _, execution := range execs {
+			e.stats.add(execution)
+		}
+		if e.breaker.record(matches[0].Price, now) {
+			slog.WarnContext(ctx, "circuit breaker tripped", "pair", e.pair.Name, "price", matches[0].Price, "cooldown", time.Duration(e.pair.CircuitBreaker.Cooldown))
+			e.state = pairHalted
+			e.reopenAt = now.Add(time.Duration(e.pair.CircuitBreaker.Cooldown))
+			e.breaker.reset()
+		}
+	}
+	return matches, execs, nil
+}
+
+// Cancel removes the order from the book once persist, if not nil, recorded the cancellation, unless the pair state
+// freezes it. It returns ErrOrderNotPending when the order isn't in the book, e.g. matched in the meantime.
+func (e *engine) Cancel(ctx context.Context, id int, persist func(context.Context) error) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := cancelError(e.currentState()); err != nil {
+		return err
+	}
+	return e.cancel(ctx, id, persist)
+}
+
+// Pull is Cancel for the cancel-all and the dead man's switch, it also removes the order from the frozen book of a
+// halted pair so the orders of a client that gave up don't come back live when the pair reopens.
+func (e *engine) Pull(ctx context.Context, id int, persist func(context.Context) error) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := cancelError(e.currentState()); err != nil && err != ErrTradingHalted {
+		return err
+	}
+	return e.cancel(ctx, id, persist)
+}
+
+// cancel removes the order from the book once persisted, e.mu must be held.
+func (e *engine) cancel(ctx context.Context, id int, persist func(context.Context) error) error {
+	if !e.matchmaker.Contains(id) {
+		return ErrOrderNotPending
+	}
+	if err := e.persist(ctx, persist); err != nil {
+		return err
+	}
+	e.matchmaker.Cancel(id)
+	return nil
+}
+
+func (e *engine) Depth() (buy, sell int) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.matchmaker.Depth()
+}
+
+// ReferencePrice is the last trade price, or the mid price when nothing traded yet. It is zero when unknown.
+func (e *engine) ReferencePrice() float64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.stats.last != 0 {
+		return e.stats.last
+	}
+	bid, ask := e.matchmaker.BestPrices()
+	if bid == 0 || ask == 0 {
+		return 0
+	}
+	return (bid + ask) / 2
+}
+
+// Load replaces the book, e.g. once rebuilt from the pending orders.
+func (e *engine) Load(m matchmaker) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.matchmaker = m
+}
+
+// Warm replays past executions into the ticker statistics.
+func (e *engine) Warm(execs []Execution) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, execution := range execs {
+		e.stats.add(execution)
+	}
+}
+
+func (e *engine) Ticker() Ticker {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	bid, ask := e.matchmaker.BestPrices()
+	day := e.stats.window(e.now())
+	ticker := Ticker{
+		Pair:        e.pair.Name,
+		LastPrice:   e.stats.last,
+		BestBid:     bid,
+		BestAsk:     ask,
+		Open:        day.Open,
+		High:        day.High,
+		Low:         day.Low,
+		Close:       day.Close,
+		BaseVolume:  day.BaseVolume,
+		QuoteVolume: day.QuoteVolume,
+	}
+	if day.Open != 0 {
+		ticker.ChangePercent = (day.Close - day.Open) / day.Open * 100
+	}
+	return ticker
+}
+
+// SetState changes the pair state once persist, if not nil, recorded it. Closing the pair empties the book, persist
+// must cancel the pending orders.
+func (e *engine) SetState(ctx context.Context, state string, persist func(context.Context) error) error {
+	if err := stateError(state); err == ErrInvalidPairState {
+		return err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := e.persist(ctx, persist); err != nil {
+		return err
+	}
+	e.state = state
+	e.reopenAt = time.Time{}
+	e.breaker.reset()
+	if state == pairClosed {
+		e.matchmaker = newMatchMaker(e.pair.TickSize, nil)
+	}
+	return nil
+}
+
+func (e *engine) State() string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.currentState()
+}
+
+// persist runs the store write of a book change, if any, e.mu must be held. The request being cancelled doesn't stop
+// it, but it fails after the persist timeout to release the lock.
+func (e *engine) persist(ctx context.Context, persist func(context.Context) error) error {
+	if persist == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), e.persistTimeout)
+	defer cancel()
+	return persist(ctx)
+}
+
+// currentState reopens the pair once the circuit breaker cool-down is over, e.mu must be held.
+func (e *engine) currentState() string {
+	if !e.reopenAt.IsZero() && !e.now().Before(e.reopenAt) {
+		e.state = pairOpen
+		e.reopenAt = time.Time{}
+	}
+	return e.state
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestEngineCircuitBreaker(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	e := newEngine(Pair{
+		Name: "EUR-USD",
+		CircuitBreaker: circuitBreakerConfig{
+			MaxMovePercent: 10,
+			Window:         duration(time.Minute),
+			Cooldown:       duration(5 * time.Minute),
+		},
+	}, newMatchMaker(0.01, nil))
+	e.now = func() time.Time { return now }
+
+	trade := func(id int, price float64) error {
+		if _, _, err := e.Submit(ctx, Order{ID: id, Side: "BUY", Price: price, Amount: 1}); err != nil {
+			return err
+		}
+		matches, _, err := e.Submit(ctx, Order{ID: id + 1, Side: "SELL", Price: price, Amount: 1})
+		if err == nil && len(matches) != 2 {
+			t.Fatalf("expected a match at %v", price)
+		}
+		return err
+	}
+
+	if err := trade(0, 100); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(30 * time.Second)
+	if err := trade(2, 105); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(50 * time.Second)
+	// 100 is out of the window, 115 is less than 10% away from 105
+	if err := trade(4, 115); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := e.State(), pairOpen; got != want {
+		t.Errorf("got %v want %v", got, want)
+	}
+
+	if err := trade(6, 130); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := e.State(), pairHalted; got != want {
+		t.Errorf("got %v want %v", got, want)
+	}
+	if err := trade(8, 130); !errors.Is(err, ErrTradingHalted) {
+		t.Errorf("got %v want %v", err, ErrTradingHalted)
+	}
+
+	now = now.Add(5 * time.Minute)
+	if got, want := e.State(), pairOpen; got != want {
+		t.Errorf("after cool-down: got %v want %v", got, want)
+	}
+	if err := trade(10, 130); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEngineState(t *testing.T) {
+	ctx := context.Background()
+	e := newEngine(Pair{Name: "EUR-USD"}, newMatchMaker(0.01, nil))
+	tests := []struct {
+		state     string
+		err       error
+		cancelErr error
+	}{
+		{state: pairCancelOnly, err: ErrPairCancelOnly, cancelErr: ErrOrderNotPending},
+		{state: pairClosed, err: ErrPairClosed, cancelErr: ErrPairClosed},
+		{state: pairHalted, err: ErrTradingHalted, cancelErr: ErrTradingHalted},
+		{state: pairOpen, cancelErr: ErrOrderNotPending},
+	}
+	for _, tt := range tests {
+		t.Run(tt.state, func(t *testing.T) {
+			if err := e.SetState(ctx, tt.state, nil); err != nil {
+				t.Fatal(err)
+			}
+			if _, _, err := e.Submit(ctx, Order{Side: "BUY", Price: 1, Amount: 1}); !errors.Is(err, tt.err) {
+				t.Errorf("got %v want %v", err, tt.err)
+			}
+			persisted := false
+			if err := e.Cancel(ctx, 1, func(context.Context) error { persisted = true; return nil }); !errors.Is(err, tt.cancelErr) {
+				t.Errorf("cancel: got %v want %v", err, tt.cancelErr)
+			}
+			if persisted {
+				t.Errorf("cancellation persisted for an order the engine kept")
+			}
+		})
+	}
+	if err := e.SetState(ctx, "unknown", nil); !errors.Is(err, ErrInvalidPairState) {
+		t.Errorf("got %v want %v", err, ErrInvalidPairState)
+	}
+
+	// the order the open pair accepted stays in the book until its cancellation is persisted
+	failed := errors.New("persist failed")
+	if err := e.Cancel(ctx, 0, func(context.Context) error { return failed }); !errors.Is(err, failed) {
+		t.Errorf("got %v want %v", err, failed)
+	}
+	if buy, _ := e.Depth(); buy != 1 {
+		t.Errorf("got %v orders in the book want 1", buy)
+	}
+	// a stuck store gives up after the persist timeout, the lock is released
+	e.persistTimeout = time.Millisecond
+	stuck := func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	if err := e.Cancel(ctx, 0, stuck); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v want %v", err, context.DeadlineExceeded)
+	}
+	if err := e.SetState(ctx, pairHalted, stuck); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v want %v", err, context.DeadlineExceeded)
+	}
+	if got, want := e.State(), pairOpen; got != want {
+		t.Errorf("got %v want %v", got, want)
+	}
+	if err := e.Cancel(ctx, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	if buy, _ := e.Depth(); buy != 0 {
+		t.Errorf("got %v orders in the book want 0", buy)
+	}
+
+	// Pull takes the order out of the frozen book of a halted pair, not out of a closed one
+	e.persistTimeout = persistTimeout
+	if _, _, err := e.Submit(ctx, Order{ID: 1, Side: "BUY", Price: 1, Amount: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.SetState(ctx, pairHalted, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Pull(ctx, 1, nil); err != nil {
+		t.Fatal(err)
+	}
+	if buy, _ := e.Depth(); buy != 0 {
+		t.Errorf("got %v orders in the book want 0", buy)
+	}
+	if err := e.SetState(ctx, pairClosed, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Pull(ctx, 1, nil); !errors.Is(err, ErrPairClosed) {
+		t.Errorf("got %v want %v", err, ErrPairClosed)
+	}
+}
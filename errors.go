@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"regexp"
+)
+
+const requestIDHeader = "X-Request-Id"
+
+var (
+	ErrUnauthorized  = errors.New("invalid credentials")
+	ErrMissingScope  = errors.New("the api key does not allow this operation")
+	ErrAdminRequired = errors.New("admin role required")
+
+	ErrOrderNotFound  error = notFoundError{resource: "order"}
+	ErrUserNotFound   error = notFoundError{resource: "user"}
+	ErrAPIKeyNotFound error = notFoundError{resource: "api key"}
+
+	// requestIDRegexp accepts the request ids set by the clients or a proxy, others are replaced.
+	requestIDRegexp = regexp.MustCompile(`^[a-zA-Z0-9._-]{1,64}$`)
+)
+
+// notFoundError is ErrNotFound naming the missing resource.
+type notFoundError struct {
+	resource string
+}
+
+func (e notFoundError) Error() string {
+	return e.resource + " not found"
+}
+
+func (e notFoundError) Is(target error) bool {
+	return target == ErrNotFound
+}
+
+// errorCodes is the catalogue of the errors reported to the clients, the codes are stable and documented in the
+// readme. The first match wins, so the specific errors come before the ones they wrap.
+var errorCodes = []struct {
+	err  error
+	code string
+}{
+	{ErrInsufficientFunds, "INSUFFICIENT_FUNDS"},
+	{ErrUnknownPair, "UNKNOWN_PAIR"},
+	{ErrUnknownAsset, "UNKNOWN_ASSET"},
+	{ErrTradingHalted, "TRADING_HALTED"},
+	{ErrPairCancelOnly, "PAIR_CANCEL_ONLY"},
+	{ErrPairClosed, "PAIR_CLOSED"},
+	{ErrInvalidPairState, "INVALID_PAIR_STATE"},
+	{ErrOrderNotFound, "ORDER_NOT_FOUND"},
+	{ErrUserNotFound, "USER_NOT_FOUND"},
+	{ErrAPIKeyNotFound, "API_KEY_NOT_FOUND"},
+	{ErrNotFound, "NOT_FOUND"},
+	{ErrOrderNotPending, "ORDER_NOT_PENDING"},
+	{ErrDuplicateClientOrderID, "DUPLICATE_CLIENT_ORDER_ID"},
+	{ErrInvalidCursor, "INVALID_CURSOR"},
+	{ErrBatchSize, "INVALID_BATCH_SIZE"},
+	{ErrUnknownInterval, "UNKNOWN_INTERVAL"},
+	{ErrDeadmanTimeout, "INVALID_DEADMAN_TIMEOUT"},
+	{ErrIdempotencyKeyMismatch, "IDEMPOTENCY_KEY_MISMATCH"},
+	{ErrIdempotencyKeyInFlight, "IDEMPOTENCY_KEY_IN_FLIGHT"},
+	{ErrUserExists, "USERNAME_TAKEN"},
+	{ErrInvalidUsername, "INVALID_USERNAME"},
+	{ErrWeakPassword, "WEAK_PASSWORD"},
+	{ErrUserDisabled, "USER_DISABLED"},
+	{ErrUnauthorized, "UNAUTHORIZED"},
+	{ErrMissingScope, "MISSING_SCOPE"},
+	{ErrAdminRequired, "ADMIN_REQUIRED"},
+	{ErrLoginLocked, "LOGIN_LOCKED"},
+	{ErrRateLimited, "RATE_LIMITED"},
+	{ErrNotReady, "NOT_READY"},
+	{context.DeadlineExceeded, "TIMEOUT"},
+}
+
+// statusCodes are the codes of the errors missing from the catalogue.
+var statusCodes = map[int]string{
+	http.StatusBadRequest:            "INVALID_REQUEST",
+	http.StatusUnauthorized:          "UNAUTHORIZED",
+	http.StatusForbidden:             "FORBIDDEN",
+	http.StatusNotFound:              "NOT_FOUND",
+	http.StatusConflict:              "CONFLICT",
+	http.StatusRequestEntityTooLarge: "REQUEST_TOO_LARGE",
+	http.StatusTooManyRequests:       "RATE_LIMITED",
+	http.StatusServiceUnavailable:    "UNAVAILABLE",
+}
+
+// newJSONError describes msg, an error or a message, reported with the status code for the request id. The messages
+// of the internal errors are logged rather than sent, and the queries that timed out are reported as unavailable.
+func newJSONError(id string, code int, msg interface{}) (int, JSONError) {
+	jsonError := JSONError{RequestID: id}
+	switch m := msg.(type) {
+	case error:
+		if code == http.StatusInternalServerError && errors.Is(m, context.DeadlineExceeded) {
+			code = http.StatusServiceUnavailable
+		}
+		jsonError.Code, jsonError.Error = errorCode(code, m), m.Error()
+		var validation ValidationError
+		if errors.As(m, &validation) {
+			jsonError.Code, jsonError.Fields = "VALIDATION_FAILED", validation.Fields
+		}
+	case string:
+		jsonError.Code, jsonError.Error = errorCode(code, nil), m
+	}
+	if jsonError.Code == "INTERNAL" || jsonError.Code == "TIMEOUT" {
+		slog.Error("request failed", "request_id", id, "status", code, "err", jsonError.Error)
+		jsonError.Error = http.StatusText(code)
+	}
+	return code, jsonError
+}
+
+func errorCode(code int, err error) string {
+	if err != nil {
+		for _, e := range errorCodes {
+			if errors.Is(err, e.err) {
+				return e.code
+			}
+		}
+	}
+	if c, ok := statusCodes[code]; ok {
+		return c
+	}
+	if code >= http.StatusInternalServerError {
+		return "INTERNAL"
+	}
+	return "INVALID_REQUEST"
+}
+
+// withRequestID identifies the request by the id set by the client, or a new one, returned in the response headers
+// and the errors.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !requestIDRegexp.MatchString(id) {
+			var err error
+			if id, err = randomHex(8); err != nil {
+				RespondWithError(w, http.StatusInternalServerError, err)
+				return
+			}
+		}
+		w.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(contextWithRequestID(r.Context(), id)))
+	})
+}
+
+const requestIDKey = "requestID"
+
+func contextWithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey, id)
+}
+
+// requestID returns the id of the request, empty outside of a request.
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
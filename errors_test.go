@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestNewJSONError(t *testing.T) {
+	tests := []struct {
+		name       string
+		code       int
+		msg        interface{}
+		wantStatus int
+		wantCode   string
+		wantError  string
+	}{
+		{name: "catalogue", code: http.StatusBadRequest, msg: ErrInsufficientFunds, wantStatus: http.StatusBadRequest, wantCode: "INSUFFICIENT_FUNDS", wantError: "insufficient funds"},
+		{name: "wrapped", code: http.StatusBadRequest, msg: fmt.Errorf("%w: too many", ErrBatchSize), wantStatus: http.StatusBadRequest, wantCode: "INVALID_BATCH_SIZE", wantError: "invalid batch size: too many"},
+		{name: "resource not found", code: http.StatusNotFound, msg: ErrOrderNotFound, wantStatus: http.StatusNotFound, wantCode: "ORDER_NOT_FOUND", wantError: "order not found"},
+		{name: "validation", code: http.StatusBadRequest, msg: ValidationError{Subject: "order", Fields: []FieldError{{Field: "side"}}}, wantStatus: http.StatusBadRequest, wantCode: "VALIDATION_FAILED", wantError: "invalid order: side: "},
+		{name: "message", code: http.StatusBadRequest, msg: "invalid order id", wantStatus: http.StatusBadRequest, wantCode: "INVALID_REQUEST", wantError: "invalid order id"},
+		{name: "status", code: http.StatusConflict, msg: errors.New("conflict"), wantStatus: http.StatusConflict, wantCode: "CONFLICT", wantError: "conflict"},
+		{name: "internal", code: http.StatusInternalServerError, msg: errors.New("cannot get user: connection refused"), wantStatus: http.StatusInternalServerError, wantCode: "INTERNAL", wantError: "Internal Server Error"},
+		{name: "timeout", code: http.StatusInternalServerError, msg: fmt.Errorf("cannot get user: %w", context.DeadlineExceeded), wantStatus: http.StatusServiceUnavailable, wantCode: "TIMEOUT", wantError: "Service Unavailable"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, jsonError := newJSONError("id", tt.code, tt.msg)
+			if status != tt.wantStatus || jsonError.Code != tt.wantCode || jsonError.Error != tt.wantError || jsonError.RequestID != "id" {
+				t.Errorf("got %v %+v want %v %v %q", status, jsonError, tt.wantStatus, tt.wantCode, tt.wantError)
+			}
+		})
+	}
+	if !errors.Is(ErrOrderNotFound, ErrNotFound) {
+		t.Errorf("%v is not %v", ErrOrderNotFound, ErrNotFound)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+)
+
+var (
+	ErrNotReady            = errors.New("the order books are being loaded")
+	ErrDatabaseUnreachable = errors.New("database unreachable")
+)
+
+// health tracks the startup of the api.
+type health struct {
+	loaded atomic.Bool
+}
+
+type componentStatus struct {
+	Ready   bool              `json:"ready"`
+	Error   string            `json:"error,omitempty"`
+	Details map[string]string `json:"details,omitempty"`
+}
+
+type readiness struct {
+	Ready      bool                       `json:"ready"`
+	Components map[string]componentStatus `json:"components"`
+}
+
+// whenLoaded rejects the requests, but the probes and metrics, until the books are loaded. Orders placed or cancelled
+// meanwhile could be missed by the restore.
+func (api api) whenLoaded(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/healthz", "/readyz", "/metrics", "/openapi.json":
+		default:
+			if !api.health.loaded.Load() {
+				w.Header().Set("Retry-After", "1")
+				RespondWithError(w, http.StatusServiceUnavailable, ErrNotReady)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// healthz reports the process is alive, whatever its dependencies.
+func (api api) healthz(w http.ResponseWriter, r *http.Request) {
+	RespondWithJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// readyz reports whether the books are loaded, the database is reachable and the pairs have their engine.
+func (api api) readyz(w http.ResponseWriter, r *http.Request) {
+	books := componentStatus{Ready: api.health.loaded.Load()}
+	if !books.Ready {
+		books.Error = ErrNotReady.Error()
+	}
+
+	database := componentStatus{Ready: true}
+	if err := api.db.Ping(r.Context()); err != nil {
+		// the probe is unauthenticated, the driver error may name hosts and users
+		slog.ErrorContext(r.Context(), "readiness: cannot ping the database", "err", err)
+		database = componentStatus{Error: ErrDatabaseUnreachable.Error()}
+	}
+
+	engines := componentStatus{Ready: true, Details: make(map[string]string)}
+	for name, engine := range api.engines {
+		engines.Details[name] = engine.State()
+	}
+	if len(api.engines) == 0 {
+		engines = componentStatus{Error: "no pair configured"}
+	}
+
+	status := readiness{
+		Ready:      books.Ready && database.Ready && engines.Ready,
+		Components: map[string]componentStatus{"books": books, "database": database, "engines": engines},
+	}
+	code := http.StatusOK
+	if !status.Ready {
+		code = http.StatusServiceUnavailable
+	}
+	RespondWithJSON(w, code, status)
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+const (
+	idempotencyKeyHeader  = "Idempotency-Key"
+	idempotentReplayed    = "Idempotent-Replayed"
+	maxIdempotencyKeySize = 255
+
+	defaultIdempotencyTTL = 24 * time.Hour
+)
+
+var (
+	ErrIdempotencyKeyExists   = errors.New("idempotency key already used")
+	ErrIdempotencyKeyInFlight = errors.New("a request with this idempotency key is in progress")
+	ErrIdempotencyKeyMismatch = errors.New("idempotency key already used for another request")
+)
+
+// IdempotencyRecord is the response to the first request sent with an idempotency key.
+// Status is zero while that request is in progress.
+type IdempotencyRecord struct {
+	UserID      int
+	Key         string
+	RequestHash []byte
+	Status      int
+	ContentType string
+	Response    []byte
+	CreatedAt   time.Time
+}
+
+// live reports whether the record still holds its key, neither expired nor left in progress by a lost request.
+func (record IdempotencyRecord) live(expiredBefore, abandonedBefore time.Time) bool {
+	if record.CreatedAt.Before(expiredBefore) {
+		return false
+	}
+	return record.Status != 0 || !record.CreatedAt.Before(abandonedBefore)
+}
+
+// responseRecorder keeps a copy of the response written to the client.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+// idempotent replays the response of the first request sent with the same Idempotency-Key header, instead of
+// handling the request again. It must be wrapped by an authentication middleware, keys are scoped per user.
+func (api api) idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyKeyHeader)
+		if key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeySize {
+			RespondWithError(w, http.StatusBadRequest, "idempotency key is too long")
+			return
+		}
+		userID, err := mustUserID(r)
+		if err != nil {
+			RespondWithError(w, http.StatusForbidden, err)
+			return
+		}
+		body, ok := readBody(w, r)
+		if !ok {
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		hash := sha256.Sum256(append([]byte(r.Method+" "+r.URL.Path+"\n"), body...))
+
+		now := time.Now()
+		expired := now.Add(-api.idempotencyTTL)
+		// a request still in progress after the longest deadline was lost, e.g. in a restart
+		abandoned := expired
+		if timeout := api.timeouts.longest(); timeout > 0 {
+			abandoned = now.Add(-timeout)
+		}
+		record, err := api.db.IdempotencyRecord(r.Context(), userID, key)
+		switch {
+		case err == nil && record.live(expired, abandoned):
+			replay(w, record, hash[:])
+			return
+		case err != nil && !errors.Is(err, ErrNotFound):
+			RespondWithError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		record = IdempotencyRecord{UserID: userID, Key: key, RequestHash: hash[:], CreatedAt: now}
+		if err := api.db.SaveIdempotencyRecord(r.Context(), record, expired, abandoned); err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, ErrIdempotencyKeyExists) {
+				// a concurrent request reserved the key first
+				status, err = http.StatusConflict, ErrIdempotencyKeyInFlight
+			}
+			RespondWithError(w, status, err)
+			return
+		}
+
+		// a request that failed on the server side may succeed when retried, the key is released instead of replaying
+		// the failure
+		release := func() {
+			if err := api.db.DeleteIdempotencyRecord(context.WithoutCancel(r.Context()), userID, key); err != nil {
+				slog.ErrorContext(r.Context(), "cannot release idempotency key", "user", userID, "key", key, "err", err)
+			}
+		}
+		defer func() {
+			if p := recover(); p != nil {
+				// no response will complete the record, the retries must not be answered as in progress
+				release()
+				panic(p)
+			}
+		}()
+		recorder := &responseRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r)
+
+		record.Status = recorder.status
+		if record.Status == 0 {
+			record.Status = http.StatusOK
+		}
+		if record.Status >= http.StatusInternalServerError {
+			release()
+			return
+		}
+		record.ContentType = recorder.Header().Get("Content-Type")
+		record.Response = recorder.body.Bytes()
+		// the request was handled, its response is kept even if the client is gone
+		if err := api.db.CompleteIdempotencyRecord(context.WithoutCancel(r.Context()), record); err != nil {
+			slog.ErrorContext(r.Context(), "cannot save idempotent response", "user", userID, "key", key, "err", err)
+		}
+	}
+}
+
+func replay(w http.ResponseWriter, record IdempotencyRecord, hash []byte) {
+	if !bytes.Equal(record.RequestHash, hash) {
+		RespondWithError(w, http.StatusUnprocessableEntity, ErrIdempotencyKeyMismatch)
+		return
+	}
+	if record.Status == 0 {
+		RespondWithError(w, http.StatusConflict, ErrIdempotencyKeyInFlight)
+		return
+	}
+	if record.ContentType != "" {
+		w.Header().Set("Content-Type", record.ContentType)
+	}
+	w.Header().Set(idempotentReplayed, "true")
+	w.WriteHeader(record.Status)
+	_, _ = w.Write(record.Response)
+}
+
+// purgeIdempotencyRecords deletes the expired records every interval, it never returns.
+func (api api) purgeIdempotencyRecords(interval time.Duration) {
+	for range time.Tick(interval) {
+		deleted, err := api.db.DeleteIdempotencyRecords(context.Background(), time.Now().Add(-api.idempotencyTTL))
+		if err != nil {
+			slog.Error("cannot purge idempotency keys", "err", err)
+			continue
+		}
+		slog.Info("idempotency keys purged", "deleted", deleted)
+	}
+}
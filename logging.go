@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// quietRoutes are polled by the orchestrator and the scraper, their requests are only logged at debug level.
+var quietRoutes = map[string]bool{
+	"GET /healthz": true,
+	"GET /readyz":  true,
+	"GET /metrics": true,
+}
+
+// contextHandler adds the request id of the context to the records, the lines logged with slog.InfoContext and the
+// like during a request can be traced back to it.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, record slog.Record) error {
+	if id := requestID(ctx); id != "" {
+		record.AddAttrs(slog.String("request_id", id))
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+const requestLogKey = "requestLog"
+
+// requestLog collects what is only known deeper in the handlers, the authenticated user.
+type requestLog struct {
+	userID int
+}
+
+// logRequests logs a line per request served by next, with its route in mux, status, latency and user. It must wrap
+// the handlers setting the user, and be wrapped by withRequestID.
+func logRequests(mux *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		_, route := mux.Handler(r)
+		if route == "" {
+			route = "unmatched"
+		}
+		entry := &requestLog{userID: -1}
+		ctx := context.WithValue(r.Context(), requestLogKey, entry)
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r.WithContext(ctx))
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+
+		level := slog.LevelInfo
+		if quietRoutes[route] {
+			level = slog.LevelDebug
+		}
+		attrs := []slog.Attr{
+			slog.String("method", r.Method),
+			slog.String("route", route),
+			slog.Int("status", sw.status),
+			slog.Duration("latency", time.Since(start)),
+		}
+		if entry.userID != -1 {
+			attrs = append(attrs, slog.Int("user", entry.userID))
+		}
+		slog.LogAttrs(ctx, level, "request", attrs...)
+	})
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestLogRequests(t *testing.T) {
+	for _, name := range []string{"mem", "postgres", "sqlite"} {
+		t.Run(name, func(t *testing.T) {
+			db := storeFactory(t, name)
+			buyer, _ := randomTestUser(t, db, Asset{Asset: "EUR", Amount: 100}, Asset{Asset: "USD", Amount: 100})
+			seller, sellerID := randomTestUser(t, db, Asset{Asset: "EUR", Amount: 100}, Asset{Asset: "USD", Amount: 100})
+			api := newTestAPI(db, newMatchMaker(defaultPairs[0].TickSize, nil))
+			handler := api.routes()
+
+			var buf bytes.Buffer
+			defer slog.SetDefault(slog.Default())
+			slog.SetDefault(newLogger(logConfig{Level: "debug", Format: "json"}, &buf))
+
+			for _, o := range []struct{ username, side, id string }{{buyer, "BUY", "trace-buy"}, {seller, "SELL", "trace-sell"}} {
+				body := `{"side":"` + o.side + `","asset_pair":"EUR-USD","amount":1,"price":1.5}`
+				req := httptest.NewRequest("POST", "/orders", strings.NewReader(body))
+				req.Header.Add("Authorization", "Basic "+basicAuth(o.username, o.username))
+				req.Header.Add(requestIDHeader, o.id)
+				w := httptest.NewRecorder()
+				handler.ServeHTTP(w, req)
+				if got, want := w.Code, http.StatusOK; got != want {
+					t.Fatalf("got %v want %v: %s", got, want, w.Body)
+				}
+			}
+
+			// the lines of the request placing the sell order, from the authentication to the match
+			messages := map[string]map[string]any{}
+			decoder := json.NewDecoder(&buf)
+			for decoder.More() {
+				var line map[string]any
+				if err := decoder.Decode(&line); err != nil {
+					t.Fatal(err)
+				}
+				if line["request_id"] == "trace-sell" {
+					messages[line["msg"].(string)] = line
+				}
+			}
+			want := []string{"order placed", "match", "request"}
+			if name != "mem" {
+				want = append(want, "store query")
+			}
+			for _, msg := range want {
+				if _, ok := messages[msg]; !ok {
+					t.Errorf("no %q line with the request id, got %v", msg, messages)
+				}
+			}
+			request := messages["request"]
+			if got, want := request["route"], "POST /orders"; got != want {
+				t.Errorf("got %v want %v", got, want)
+			}
+			if got, want := request["status"], float64(http.StatusOK); got != want {
+				t.Errorf("got %v want %v", got, want)
+			}
+			if got, want := request["user"], float64(sellerID); got != want {
+				t.Errorf("got %v want %v", got, want)
+			}
+		})
+	}
+}
@@ -1,26 +1,135 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
-	"log"
 	"log/slog"
 	"net/http"
 	"os"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
 )
 
+const usage = `usage: tranched [flags] [command]
+
+commands:
+  serve             run the api, the default
+  migrate           apply the pending database migrations and exit
+  seed              create the demo accounts and exit
+  backfill-candles  rebuild the candles from the trades, see backfill-candles -h
+
+flags:
+`
+
 func main() {
-	db, err := newPostgres(os.Getenv("DB_URL"))
+	flags := flag.NewFlagSet("tranched", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), usage)
+		flags.PrintDefaults()
+	}
+	configFile := flags.String("config", os.Getenv("CONFIG_FILE"), "json configuration file")
+	seedDB := flags.Bool("seed", false, "create the demo accounts before serving")
+	_ = flags.Parse(os.Args[1:])
+
+	cfg, err := loadConfig(*configFile, os.Getenv)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid configuration:\n%v\n", err)
+		os.Exit(2)
+	}
+	slog.SetDefault(newLogger(cfg.Log, os.Stderr))
+
+	db, err := openStore(cfg.Database)
 	if err != nil {
 		panic(err)
 	}
-	seed(db)
+	hasher := newPasswordHasher(cfg.PasswordHasher)
 
-	api := newAPI(db)
+	command, args := "serve", flags.Args()
+	if len(args) > 0 {
+		command, args = args[0], args[1:]
+	}
+	switch command {
+	case "serve":
+		if *seedDB {
+			seed(context.Background(), db, hasher)
+		}
+		serve(db, hasher, cfg)
+	case "migrate":
+		applied, err := db.Migrate()
+		if err != nil {
+			slog.Error("migration failed", "err", err)
+			os.Exit(1)
+		}
+		slog.Info("database migrated", "applied", applied)
+	case "seed":
+		seed(context.Background(), db, hasher)
+	case "backfill-candles":
+		if err := backfill(db, cfg.Pairs, args); err != nil {
+			slog.Error("backfill failed", "err", err)
+			os.Exit(1)
+		}
+	default:
+		flags.Usage()
+		os.Exit(2)
+	}
+}
 
-	port := "8080"
-	slog.Info("listening", "port", port)
+func serve(db store, hasher passwordHasher, cfg Config) {
+	api := newAPI(db, hasher, cfg)
+	prometheus.MustRegister(bookCollector(api.engines))
+	go api.purgeIdempotencyRecords(time.Hour)
+	go func() {
+		// the probes are served while the books are loaded
+		if err := api.restore(context.Background()); err != nil {
+			slog.Error("cannot restore the order books", "err", err)
+			os.Exit(1)
+		}
+		slog.Info("order books restored")
+	}()
 
 	// todo do gracefully shut down
 	// https://pkg.go.dev/net/http#Server.Shutdown
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%v", port), api.routes()))
+	server := &http.Server{Addr: cfg.Listen.Addr, Handler: api.routes()}
+	slog.Info("listening", "addr", cfg.Listen.Addr, "tls", cfg.Listen.TLS.CertFile != "")
+	var err error
+	if cfg.Listen.TLS.CertFile != "" {
+		err = server.ListenAndServeTLS(cfg.Listen.TLS.CertFile, cfg.Listen.TLS.KeyFile)
+	} else {
+		err = server.ListenAndServe()
+	}
+	slog.Error("server stopped", "err", err)
+	os.Exit(1)
+}
+
+// backfill rebuilds the candles from the trades, e.g. `tranched backfill-candles -pair EUR-USD -from 2024-01-01T00:00:00Z`
+func backfill(db store, pairs []Pair, args []string) error {
+	flags := flag.NewFlagSet("backfill-candles", flag.ExitOnError)
+	pair := flags.String("pair", "", "pair to backfill, all pairs when empty")
+	from := flags.String("from", "1970-01-01T00:00:00Z", "first trade time, RFC3339")
+	to := flags.String("to", "", "last trade time, RFC3339, now when empty")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	start, err := time.Parse(time.RFC3339, *from)
+	if err != nil {
+		return fmt.Errorf("invalid from: %v", err)
+	}
+	end := time.Now()
+	if *to != "" {
+		if end, err = time.Parse(time.RFC3339, *to); err != nil {
+			return fmt.Errorf("invalid to: %v", err)
+		}
+	}
+	for _, p := range pairs {
+		if *pair != "" && p.Name != *pair {
+			continue
+		}
+		if err := backfillCandles(context.Background(), db, p.Name, start, end); err != nil {
+			return err
+		}
+	}
+	return nil
 }
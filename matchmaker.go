@@ -1,26 +1,43 @@
 package main
 
-import "log/slog"
+import (
+	"context"
+	"log/slog"
+	"math"
+)
 
 type node struct {
 	order Order
+	// level is the price in number of ticks, so float rounding can't split a price level
+	level float64
 	// todo add previous, it would simplify reading
 	next *node
 }
 
+// matchmaker logs the matches with the context of the call, for them to carry the request id.
 type matchmaker interface {
-	VerifyMatch() []Order
-	AddOrderAndMatch(order Order) []Order
+	VerifyMatch(ctx context.Context) []Order
+	AddOrderAndMatch(ctx context.Context, order Order) []Order
+	Cancel(id int) bool
+	// Contains reports whether the order is in the book.
+	Contains(id int) bool
+	// BestPrices returns the highest buy and the lowest sell price, zero for an empty side.
+	BestPrices() (bid, ask float64)
+	// Depth returns the number of orders on each side of the book.
+	Depth() (buy, sell int)
 }
 
 type linkedListMatchmaker struct {
 	sell, buy *node
+	tickSize  float64
 }
 
-func newMatchMaker(orders []Order) linkedListMatchmaker {
+// newMatchMaker creates a book whose price levels are multiples of tickSize, a zero tickSize uses the raw prices.
+func newMatchMaker(tickSize float64, orders []Order) linkedListMatchmaker {
 	m := linkedListMatchmaker{
-		sell: &node{},
-		buy:  &node{},
+		sell:     &node{},
+		buy:      &node{},
+		tickSize: tickSize,
 	}
 	for _, order := range orders {
 		m.addOrder(order)
@@ -28,13 +45,13 @@ func newMatchMaker(orders []Order) linkedListMatchmaker {
 	return m
 }
 
-func (m linkedListMatchmaker) match(prev *node, head *node) (matches []Order) {
-	for len(matches) != 2 && head.next != nil && head.next.order.Price <= prev.next.order.Price {
-		if head.next.order.Price == prev.next.order.Price && head.next.order.Amount == prev.next.order.Amount {
+func (m linkedListMatchmaker) match(ctx context.Context, prev *node, head *node) (matches []Order) {
+	for len(matches) != 2 && head.next != nil && head.next.level <= prev.next.level {
+		if head.next.level == prev.next.level && head.next.order.Amount == prev.next.order.Amount {
 			matches = append(matches, prev.next.order, head.next.order)
-			slog.Info("match",
-				"id1", prev.next.order.id,
-				"id2", head.next.order.id,
+			slog.InfoContext(ctx, "match",
+				"id1", prev.next.order.ID,
+				"id2", head.next.order.ID,
 				"pair", prev.next.order.AssetPair,
 				"price", prev.next.order.Price,
 				"amount", prev.next.order.Amount,
@@ -47,24 +64,31 @@ func (m linkedListMatchmaker) match(prev *node, head *node) (matches []Order) {
 	return matches
 }
 
-func (m linkedListMatchmaker) VerifyMatch() (matches []Order) {
+func (m linkedListMatchmaker) VerifyMatch(ctx context.Context) (matches []Order) {
 	cur := m.buy
 	for cur != nil && cur.next != nil {
 		// todo we could use a sliding window here, and go from o(n2) to o(n)
-		match := m.match(cur, m.sell)
+		match := m.match(ctx, cur, m.sell)
 		matches = append(matches, match...)
 		cur = cur.next
 	}
 	return
 }
 
-func (m linkedListMatchmaker) AddOrderAndMatch(order Order) []Order {
+func (m linkedListMatchmaker) AddOrderAndMatch(ctx context.Context, order Order) []Order {
 	prev := m.addOrder(order)
 	head := m.buy
 	if order.Side == "BUY" {
 		head = m.sell
 	}
-	return m.match(prev, head)
+	return m.match(ctx, prev, head)
+}
+
+func (m linkedListMatchmaker) level(price float64) float64 {
+	if m.tickSize == 0 {
+		return price
+	}
+	return math.Round(price / m.tickSize)
 }
 
 func (m linkedListMatchmaker) addOrder(order Order) (prev *node) {
@@ -72,11 +96,13 @@ func (m linkedListMatchmaker) addOrder(order Order) (prev *node) {
 	if order.Side == "SELL" {
 		cur = m.sell
 	}
-	for cur.next != nil && cur.next.order.Price <= order.Price {
+	level := m.level(order.Price)
+	for cur.next != nil && cur.next.level <= level {
 		cur = cur.next
 	}
 	newNode := node{
 		order: order,
+		level: level,
 	}
 	if cur != nil {
 		newNode.next = cur.next
@@ -84,3 +110,49 @@ func (m linkedListMatchmaker) addOrder(order Order) (prev *node) {
 	}
 	return cur
 }
+
+// Cancel removes the order from the book, it returns false if the order isn't in the book.
+func (m linkedListMatchmaker) Cancel(id int) bool {
+	for _, cur := range []*node{m.buy, m.sell} {
+		for cur.next != nil {
+			if cur.next.order.ID == id {
+				cur.next = cur.next.next
+				return true
+			}
+			cur = cur.next
+		}
+	}
+	return false
+}
+
+func (m linkedListMatchmaker) Contains(id int) bool {
+	for _, cur := range []*node{m.buy.next, m.sell.next} {
+		for ; cur != nil; cur = cur.next {
+			if cur.order.ID == id {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (m linkedListMatchmaker) BestPrices() (bid, ask float64) {
+	// both sides are sorted by ascending price
+	for cur := m.buy.next; cur != nil; cur = cur.next {
+		bid = cur.order.Price
+	}
+	if m.sell.next != nil {
+		ask = m.sell.next.order.Price
+	}
+	return
+}
+
+func (m linkedListMatchmaker) Depth() (buy, sell int) {
+	for cur := m.buy.next; cur != nil; cur = cur.next {
+		buy++
+	}
+	for cur := m.sell.next; cur != nil; cur = cur.next {
+		sell++
+	}
+	return
+}
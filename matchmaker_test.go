@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"reflect"
 	"testing"
 )
@@ -16,8 +17,8 @@ func Test_newMatchMaker(t *testing.T) {
 		{
 			name: "simple",
 			orders: []Order{
-				{id: 0, Side: "BUY", Price: 1, Amount: 100},
-				{id: 1, Side: "SELL", Price: 1, Amount: 100},
+				{ID: 0, Side: "BUY", Price: 1, Amount: 100},
+				{ID: 1, Side: "SELL", Price: 1, Amount: 100},
 			},
 			expectedBuy:  []int{0},
 			expectedSell: []int{1},
@@ -26,11 +27,11 @@ func Test_newMatchMaker(t *testing.T) {
 		{
 			name: "more complex",
 			orders: []Order{
-				{id: 0, Side: "BUY", Price: 1},
-				{id: 1, Side: "SELL", Price: 10},
-				{id: 2, Side: "BUY", Price: 2},
-				{id: 3, Side: "SELL", Price: 1},
-				{id: 4, Side: "BUY", Price: 3},
+				{ID: 0, Side: "BUY", Price: 1},
+				{ID: 1, Side: "SELL", Price: 10},
+				{ID: 2, Side: "BUY", Price: 2},
+				{ID: 3, Side: "SELL", Price: 1},
+				{ID: 4, Side: "BUY", Price: 3},
 			},
 			expectedBuy:  []int{0, 2, 4},
 			expectedSell: []int{3, 1},
@@ -39,12 +40,12 @@ func Test_newMatchMaker(t *testing.T) {
 		{
 			name: "no match",
 			orders: []Order{
-				{id: 0, Side: "BUY", Price: 11},
-				{id: 1, Side: "BUY", Price: 1},
-				{id: 2, Side: "BUY", Price: 111},
-				{id: 3, Side: "SELL", Price: 222},
-				{id: 4, Side: "SELL", Price: 22},
-				{id: 5, Side: "SELL", Price: 2},
+				{ID: 0, Side: "BUY", Price: 11},
+				{ID: 1, Side: "BUY", Price: 1},
+				{ID: 2, Side: "BUY", Price: 111},
+				{ID: 3, Side: "SELL", Price: 222},
+				{ID: 4, Side: "SELL", Price: 22},
+				{ID: 5, Side: "SELL", Price: 2},
 			},
 			expectedBuy:  []int{1, 0, 2},
 			expectedSell: []int{5, 4, 3},
@@ -52,12 +53,12 @@ func Test_newMatchMaker(t *testing.T) {
 		{
 			name: "last match",
 			orders: []Order{
-				{id: 0, Side: "BUY", Price: 11},
-				{id: 1, Side: "BUY", Price: 1},
-				{id: 2, Side: "BUY", Price: 222},
-				{id: 3, Side: "SELL", Price: 222},
-				{id: 4, Side: "SELL", Price: 22},
-				{id: 5, Side: "SELL", Price: 2},
+				{ID: 0, Side: "BUY", Price: 11},
+				{ID: 1, Side: "BUY", Price: 1},
+				{ID: 2, Side: "BUY", Price: 222},
+				{ID: 3, Side: "SELL", Price: 222},
+				{ID: 4, Side: "SELL", Price: 22},
+				{ID: 5, Side: "SELL", Price: 2},
 			},
 			expectedBuy:  []int{1, 0, 2},
 			expectedSell: []int{5, 4, 3},
@@ -66,11 +67,11 @@ func Test_newMatchMaker(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			m := newMatchMaker(tt.orders)
+			m := newMatchMaker(0.01, tt.orders)
 			cur := m.buy
 			var gotBuy []int
 			for cur.next != nil {
-				gotBuy = append(gotBuy, cur.next.order.id)
+				gotBuy = append(gotBuy, cur.next.order.ID)
 				cur = cur.next
 			}
 			if got, want := gotBuy, tt.expectedBuy; !reflect.DeepEqual(got, want) {
@@ -80,25 +81,84 @@ func Test_newMatchMaker(t *testing.T) {
 			cur = m.sell
 			var gotSell []int
 			for cur.next != nil {
-				gotSell = append(gotSell, cur.next.order.id)
+				gotSell = append(gotSell, cur.next.order.ID)
 				cur = cur.next
 			}
 			if got, want := gotSell, tt.expectedSell; !reflect.DeepEqual(got, want) {
 				t.Errorf("got %v want %v", got, want)
 			}
 
-			matches := m.VerifyMatch()
+			matches := m.VerifyMatch(context.Background())
 			if len(tt.match) != 0 {
 				if len(matches) == 0 {
 					t.Fatal("empty matches")
 				}
-				if got, want := matches[0].id, tt.match[0]; got != want {
+				if got, want := matches[0].ID, tt.match[0]; got != want {
 					t.Errorf("got %v want %v", got, want)
 				}
-				if got, want := matches[1].id, tt.match[1]; got != want {
+				if got, want := matches[1].ID, tt.match[1]; got != want {
 					t.Errorf("got %v want %v", got, want)
 				}
 			}
 		})
 	}
 }
+
+func Test_cancel(t *testing.T) {
+	m := newMatchMaker(0.01, []Order{
+		{ID: 0, Side: "BUY", Price: 1},
+		{ID: 1, Side: "SELL", Price: 10},
+		{ID: 2, Side: "BUY", Price: 2},
+	})
+	if !m.Contains(2) {
+		t.Errorf("order 2 not in the book")
+	}
+	if !m.Cancel(2) {
+		t.Errorf("order 2 not cancelled")
+	}
+	if m.Contains(2) {
+		t.Errorf("order 2 still in the book")
+	}
+	if !m.Cancel(1) {
+		t.Errorf("order 1 not cancelled")
+	}
+	if m.Cancel(1) {
+		t.Errorf("order 1 cancelled twice")
+	}
+	if m.buy.next == nil || m.buy.next.order.ID != 0 || m.buy.next.next != nil {
+		t.Errorf("unexpected buy side")
+	}
+	if m.sell.next != nil {
+		t.Errorf("unexpected sell side")
+	}
+}
+
+func Test_bestPrices(t *testing.T) {
+	m := newMatchMaker(0.01, []Order{
+		{ID: 0, Side: "BUY", Price: 1},
+		{ID: 1, Side: "SELL", Price: 10},
+		{ID: 2, Side: "BUY", Price: 2},
+		{ID: 3, Side: "SELL", Price: 5},
+	})
+	bid, ask := m.BestPrices()
+	if bid != 2 || ask != 5 {
+		t.Errorf("got %v/%v want 2/5", bid, ask)
+	}
+	bid, ask = newMatchMaker(0.01, nil).BestPrices()
+	if bid != 0 || ask != 0 {
+		t.Errorf("got %v/%v want 0/0", bid, ask)
+	}
+	if buy, sell := m.Depth(); buy != 2 || sell != 2 {
+		t.Errorf("got %v/%v want 2/2", buy, sell)
+	}
+}
+
+func Test_priceLevel(t *testing.T) {
+	m := newMatchMaker(0.01, []Order{
+		{ID: 0, Side: "BUY", Price: 0.1 + 0.2, Amount: 1},
+	})
+	matches := m.AddOrderAndMatch(context.Background(), Order{ID: 1, Side: "SELL", Price: 0.3, Amount: 1})
+	if len(matches) != 2 {
+		t.Errorf("orders on the same price level didn't match")
+	}
+}
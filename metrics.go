@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_requests_total",
+		Help: "HTTP requests by route, method and status code.",
+	}, []string{"route", "method", "code"})
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_request_duration_seconds",
+		Help:    "HTTP request latencies by route and method.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method"})
+
+	ordersSubmitted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "orders_submitted_total",
+		Help: "Orders submitted to the matchmaker by pair and side.",
+	}, []string{"pair", "side"})
+	orderMatches = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "order_matches_total",
+		Help: "Executions by pair.",
+	}, []string{"pair"})
+	matchingDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "matching_duration_seconds",
+		Help:    "Time spent adding an order to the book and matching it, by pair.",
+		Buckets: prometheus.ExponentialBuckets(0.00001, 4, 10),
+	}, []string{"pair"})
+	settlementFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "settlement_failures_total",
+		Help: "Matched orders that couldn't be filled in the store, by pair.",
+	}, []string{"pair"})
+
+	rateLimited = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "rate_limited_total",
+		Help: "Requests rejected by the rate limits, by route class.",
+	}, []string{"class"})
+
+	storeQueryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "store_query_duration_seconds",
+		Help:    "Store call latencies by method.",
+		Buckets: prometheus.ExponentialBuckets(0.0005, 2, 12),
+	}, []string{"method"})
+
+	bookDepthDesc = prometheus.NewDesc("order_book_depth", "Orders resting in the book by pair and side.", []string{"pair", "side"}, nil)
+)
+
+// observeQuery times a store call and logs it at debug level with the request id of ctx, it is meant to be deferred:
+// defer observeQuery(ctx, "Order")().
+func observeQuery(ctx context.Context, method string) func() {
+	start := time.Now()
+	return func() {
+		elapsed := time.Since(start)
+		storeQueryDuration.WithLabelValues(method).Observe(elapsed.Seconds())
+		slog.DebugContext(ctx, "store query", "method", method, "latency", elapsed)
+	}
+}
+
+// bookCollector reads the depth of the books when scraped rather than on each order.
+type bookCollector map[string]*engine
+
+func (c bookCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- bookDepthDesc
+}
+
+func (c bookCollector) Collect(ch chan<- prometheus.Metric) {
+	for name, engine := range c {
+		buy, sell := engine.Depth()
+		ch <- prometheus.MustNewConstMetric(bookDepthDesc, prometheus.GaugeValue, float64(buy), name, "buy")
+		ch <- prometheus.MustNewConstMetric(bookDepthDesc, prometheus.GaugeValue, float64(sell), name, "sell")
+	}
+}
+
+// statusWriter keeps the status code written to the client.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// instrument counts and times the requests served by next, labelled by the pattern they match in mux.
+func instrument(mux *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		_, route := mux.Handler(r)
+		if route == "" {
+			route = "unmatched"
+		}
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+		httpRequests.WithLabelValues(route, r.Method, strconv.Itoa(sw.status)).Inc()
+		httpDuration.WithLabelValues(route, r.Method).Observe(time.Since(start).Seconds())
+	})
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//go:embed migrations/postgres/*.sql migrations/sqlite/*.sql
+var migrationFiles embed.FS
+
+// migration is a sql file named after its version, e.g. 0002_constraints.sql.
+type migration struct {
+	version int
+	name    string
+	sql     string
+}
+
+func loadMigrations(fsys fs.FS, dir string) ([]migration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read migrations: %v", err)
+	}
+	var migrations []migration
+	versions := make(map[int]string)
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || path.Ext(name) != ".sql" {
+			continue
+		}
+		prefix, _, _ := strings.Cut(name, "_")
+		version, err := strconv.Atoi(prefix)
+		if err != nil || version < 1 {
+			return nil, fmt.Errorf("migration %s must start with a positive version", name)
+		}
+		if other, ok := versions[version]; ok {
+			return nil, fmt.Errorf("migrations %s and %s have the same version", other, name)
+		}
+		versions[version] = name
+		b, err := fs.ReadFile(fsys, path.Join(dir, name))
+		if err != nil {
+			return nil, fmt.Errorf("cannot read migration %s: %v", name, err)
+		}
+		migrations = append(migrations, migration{version: version, name: strings.TrimSuffix(name, ".sql"), sql: string(b)})
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].version < migrations[j].version
+	})
+	return migrations, nil
+}
+
+// Migrate applies the embedded migrations that are not recorded in schema_migrations yet, each in its own
+// transaction. It returns the names of the applied migrations.
+func (db postgres) Migrate() ([]string, error) {
+	migrations, err := loadMigrations(migrationFiles, "migrations/postgres")
+	if err != nil {
+		return nil, err
+	}
+	ctx := context.Background()
+	_, err = db.pool.Exec(ctx, `create table if not exists schema_migrations (
+		version int primary key,
+		name text not null,
+		applied_at timestamptz not null default now()
+	)`)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create schema_migrations: %v", err)
+	}
+
+	var applied []string
+	for _, m := range migrations {
+		done, err := db.applyMigration(ctx, m)
+		if err != nil {
+			return applied, err
+		}
+		if done {
+			applied = append(applied, m.name)
+		}
+	}
+	return applied, nil
+}
+
+func (db postgres) applyMigration(ctx context.Context, m migration) (bool, error) {
+	tx, err := db.pool.Begin(ctx)
+	if err != nil {
+		return false, fmt.Errorf("cannot apply migration %s: %v", m.name, err)
+	}
+	defer tx.Rollback(ctx)
+
+	// concurrent migrate commands wait for each other
+	if _, err := tx.Exec(ctx, "lock table schema_migrations in exclusive mode"); err != nil {
+		return false, fmt.Errorf("cannot apply migration %s: %v", m.name, err)
+	}
+	var exists bool
+	if err := tx.QueryRow(ctx, "select exists(select 1 from schema_migrations where version=$1)", m.version).Scan(&exists); err != nil {
+		return false, fmt.Errorf("cannot apply migration %s: %v", m.name, err)
+	}
+	if exists {
+		return false, nil
+	}
+	if _, err := tx.Exec(ctx, m.sql); err != nil {
+		return false, fmt.Errorf("cannot apply migration %s: %v", m.name, err)
+	}
+	if _, err := tx.Exec(ctx, "insert into schema_migrations(version, name) values ($1, $2)", m.version, m.name); err != nil {
+		return false, fmt.Errorf("cannot apply migration %s: %v", m.name, err)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return false, fmt.Errorf("cannot apply migration %s: %v", m.name, err)
+	}
+	return true, nil
+}
+
+// Migrate applies the embedded sqlite migrations like the postgres ones, the single connection serializes them.
+func (db sqlite) Migrate() ([]string, error) {
+	migrations, err := loadMigrations(migrationFiles, "migrations/sqlite")
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.db.Exec(`create table if not exists schema_migrations (
+		version integer primary key,
+		name text not null,
+		applied_at integer not null
+	)`)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create schema_migrations: %v", err)
+	}
+
+	var applied []string
+	for _, m := range migrations {
+		done, err := db.applyMigration(m)
+		if err != nil {
+			return applied, err
+		}
+		if done {
+			applied = append(applied, m.name)
+		}
+	}
+	return applied, nil
+}
+
+func (db sqlite) applyMigration(m migration) (bool, error) {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return false, fmt.Errorf("cannot apply migration %s: %v", m.name, err)
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	if err := tx.QueryRow("select exists(select 1 from schema_migrations where version=?)", m.version).Scan(&exists); err != nil {
+		return false, fmt.Errorf("cannot apply migration %s: %v", m.name, err)
+	}
+	if exists {
+		return false, nil
+	}
+	if _, err := tx.Exec(m.sql); err != nil {
+		return false, fmt.Errorf("cannot apply migration %s: %v", m.name, err)
+	}
+	if _, err := tx.Exec("insert into schema_migrations(version, name, applied_at) values (?, ?, ?)", m.version, m.name, toMicros(time.Now())); err != nil {
+		return false, fmt.Errorf("cannot apply migration %s: %v", m.name, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("cannot apply migration %s: %v", m.name, err)
+	}
+	return true, nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"testing"
+	"testing/fstest"
+)
+
+func TestLoadMigrations(t *testing.T) {
+	migrations, err := loadMigrations(migrationFiles, "migrations/postgres")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, m := range migrations {
+		if got, want := m.version, i+1; got != want {
+			t.Errorf("%s: got version %v want %v", m.name, got, want)
+		}
+	}
+
+	tests := []struct {
+		name  string
+		files fstest.MapFS
+		err   bool
+	}{
+		{name: "sorted", files: fstest.MapFS{"m/0010_b.sql": {}, "m/0002_a.sql": {}, "m/readme.md": {}}},
+		{name: "no version", files: fstest.MapFS{"m/init.sql": {}}, err: true},
+		{name: "same version", files: fstest.MapFS{"m/0001_a.sql": {}, "m/1_b.sql": {}}, err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			migrations, err := loadMigrations(tt.files, "m")
+			if got, want := err != nil, tt.err; got != want {
+				t.Fatalf("got error %v", err)
+			}
+			if err == nil && (len(migrations) != 2 || migrations[0].name != "0002_a" || migrations[1].version != 10) {
+				t.Errorf("got %+v", migrations)
+			}
+		})
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	db := newPostgresTest(t).(*postgres)
+	// newPostgresTest already migrated the database
+	applied, err := db.Migrate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != 0 {
+		t.Errorf("migrations applied twice: %v", applied)
+	}
+}
+
+func TestMigrateSQLite(t *testing.T) {
+	db := newSQLiteTest(t).(*sqlite)
+	applied, err := db.Migrate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != 0 {
+		t.Errorf("migrations applied twice: %v", applied)
+	}
+}
@@ -0,0 +1,93 @@
+-- the schema as it was before migrations, databases created from the first schema get the later columns
+create table if not exists users (
+    id serial primary key,
+    username text unique not null,
+    password bytea not null,
+    role text not null default 'user',
+    disabled boolean not null default false
+);
+
+alter table users add column if not exists role text not null default 'user';
+alter table users add column if not exists disabled boolean not null default false;
+
+create table if not exists assets (
+    id serial primary key,
+    userid int not null,
+    asset_type text not null,
+    balance float not null
+);
+
+create table if not exists orders (
+    id serial primary key,
+    userid int not null,
+    client_order_id text,
+    side text not null,
+    asset_pair text not null,
+    amount float not null,
+    price float not null,
+    status text not null,
+    created_at timestamptz not null default now()
+);
+
+alter table orders add column if not exists client_order_id text;
+alter table orders add column if not exists created_at timestamptz not null default now();
+
+create index if not exists orders_userid_created_at on orders(userid, created_at, id);
+create index if not exists orders_userid_status_created_at on orders(userid, status, created_at, id);
+create index if not exists orders_asset_pair_status on orders(asset_pair, status);
+create unique index if not exists orders_userid_client_order_id on orders(userid, client_order_id) where client_order_id is not null;
+
+create table if not exists api_keys (
+    id serial primary key,
+    userid int not null,
+    key text unique not null,
+    secret text not null,
+    scopes text[] not null,
+    revoked boolean not null default false,
+    created_at timestamptz not null default now()
+);
+
+create table if not exists audit_log (
+    id serial primary key,
+    admin_id int not null,
+    action text not null,
+    target text not null,
+    details text not null,
+    created_at timestamptz not null default now()
+);
+
+create table if not exists trades (
+    id serial primary key,
+    asset_pair text not null,
+    price float not null,
+    amount float not null,
+    executed_at timestamptz not null
+);
+
+create index if not exists trades_asset_pair_executed_at on trades(asset_pair, executed_at);
+
+create table if not exists candles (
+    asset_pair text not null,
+    period text not null,
+    start timestamptz not null,
+    open float not null,
+    high float not null,
+    low float not null,
+    close float not null,
+    base_volume float not null,
+    quote_volume float not null,
+    primary key (asset_pair, period, start)
+);
+
+create table if not exists idempotency_keys (
+    userid int not null,
+    key text not null,
+    request_hash bytea not null,
+    status int not null default 0,
+    content_type text not null default '',
+    response bytea,
+    created_at timestamptz not null,
+    primary key (userid, key)
+);
+
+create index if not exists idempotency_keys_created_at on idempotency_keys(created_at);
@@ -0,0 +1,35 @@
+-- merge the duplicated balances before making them unique
+update assets set balance = duplicates.total
+from (
+    select min(id) as id, sum(balance) as total
+    from assets
+    group by userid, asset_type
+    having count(*) > 1
+) duplicates
+where assets.id = duplicates.id;
+
+delete from assets
+using assets kept
+where assets.userid = kept.userid and assets.asset_type = kept.asset_type and assets.id > kept.id;
+
+alter table assets add constraint assets_userid_asset_type_key unique (userid, asset_type);
+
+-- rows of users that don't exist can't be reached anyway
+delete from assets where userid not in (select id from users);
+delete from orders where userid not in (select id from users);
+delete from api_keys where userid not in (select id from users);
+delete from idempotency_keys where userid not in (select id from users);
+
+alter table assets add constraint assets_userid_fkey foreign key (userid) references users(id) on delete cascade;
+alter table orders add constraint orders_userid_fkey foreign key (userid) references users(id) on delete cascade;
+alter table api_keys add constraint api_keys_userid_fkey foreign key (userid) references users(id) on delete cascade;
+alter table idempotency_keys add constraint idempotency_keys_userid_fkey foreign key (userid) references users(id) on delete cascade;
+alter table audit_log add constraint audit_log_admin_id_fkey foreign key (admin_id) references users(id);
+
+alter table users add constraint users_role_check check (role in ('user', 'admin'));
+alter table orders add constraint orders_side_check check (side in ('BUY', 'SELL'));
+alter table orders add constraint orders_status_check check (status in ('pending', 'filled', 'cancelled'));
+alter table orders add constraint orders_amount_check check (amount > 0 and price > 0);
+
+create index if not exists api_keys_userid on api_keys(userid);
+create index if not exists audit_log_admin_id on audit_log(admin_id);
@@ -0,0 +1,6 @@
+-- the states set by the admins, the pairs without a row are open
+create table if not exists pair_states (
+    asset_pair text primary key,
+    state text not null check (state in ('open', 'halted', 'cancel-only', 'closed')),
+    updated_at timestamptz not null default now()
+);
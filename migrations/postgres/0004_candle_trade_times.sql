@@ -0,0 +1,5 @@
+-- the times of the first and last trades of each candle, so merges keep the open and close of the earliest and
+-- latest trades whatever the order they are recorded in. The candles saved before keep their open and take the close
+-- of their next trade.
+alter table candles add column if not exists opened_at timestamptz not null default '-infinity';
+alter table candles add column if not exists closed_at timestamptz not null default '-infinity';
@@ -0,0 +1,94 @@
+-- times are stored as unix microseconds, the precision of postgres timestamps
+create table users (
+    id integer primary key,
+    username text unique not null,
+    password blob not null,
+    role text not null default 'user' check (role in ('user', 'admin')),
+    disabled boolean not null default false
+);
+
+create table assets (
+    id integer primary key,
+    userid integer not null references users(id) on delete cascade,
+    asset_type text not null,
+    balance real not null,
+    unique (userid, asset_type)
+);
+
+create table orders (
+    id integer primary key,
+    userid integer not null references users(id) on delete cascade,
+    client_order_id text,
+    side text not null check (side in ('BUY', 'SELL')),
+    asset_pair text not null,
+    amount real not null,
+    price real not null,
+    status text not null check (status in ('pending', 'filled', 'cancelled')),
+    created_at integer not null,
+    check (amount > 0 and price > 0)
+);
+
+create index orders_userid_created_at on orders(userid, created_at, id);
+create index orders_userid_status_created_at on orders(userid, status, created_at, id);
+create index orders_asset_pair_status on orders(asset_pair, status);
+create unique index orders_userid_client_order_id on orders(userid, client_order_id) where client_order_id is not null;
+
+-- scopes are comma separated
+create table api_keys (
+    id integer primary key,
+    userid integer not null references users(id) on delete cascade,
+    key text unique not null,
+    secret text not null,
+    scopes text not null,
+    revoked boolean not null default false,
+    created_at integer not null
+);
+
+create index api_keys_userid on api_keys(userid);
+
+create table audit_log (
+    id integer primary key,
+    admin_id integer not null references users(id),
+    action text not null,
+    target text not null,
+    details text not null,
+    created_at integer not null
+);
+
+create index audit_log_admin_id on audit_log(admin_id);
+
+create table trades (
+    id integer primary key,
+    asset_pair text not null,
+    price real not null,
+    amount real not null,
+    executed_at integer not null
+);
+
+create index trades_asset_pair_executed_at on trades(asset_pair, executed_at);
+
+create table candles (
+    asset_pair text not null,
+    period text not null,
+    start integer not null,
+    open real not null,
+    high real not null,
+    low real not null,
+    close real not null,
+    base_volume real not null,
+    quote_volume real not null,
+    primary key (asset_pair, period, start)
+);
+
+create table idempotency_keys (
+    userid integer not null references users(id) on delete cascade,
+    key text not null,
+    request_hash blob not null,
+    status integer not null default 0,
+    content_type text not null default '',
+    response blob,
+    created_at integer not null,
+    primary key (userid, key)
+);
+
+create index idempotency_keys_created_at on idempotency_keys(created_at);
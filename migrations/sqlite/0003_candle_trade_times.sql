@@ -0,0 +1,5 @@
+-- the times of the first and last trades of each candle, so merges keep the open and close of the earliest and
+-- latest trades whatever the order they are recorded in. The candles saved before keep their open and take the close
+-- of their next trade.
+alter table candles add column opened_at integer not null default -9223372036854775808;
+alter table candles add column closed_at integer not null default -9223372036854775808;
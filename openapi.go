@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+//go:embed openapi.json
+var openAPIDocument []byte
+
+// spec is the OpenAPI document served at /openapi.json, the request bodies are validated against its schemas.
+var spec = mustParseSpec(openAPIDocument)
+
+// apiSpec is the part of the OpenAPI document needed to validate the request bodies.
+type apiSpec struct {
+	Paths      map[string]map[string]operation `json:"paths"`
+	Components struct {
+		Schemas map[string]*schema `json:"schemas"`
+	} `json:"components"`
+}
+
+type operation struct {
+	RequestBody *struct {
+		Content map[string]struct {
+			Schema *schema `json:"schema"`
+		} `json:"content"`
+	} `json:"requestBody"`
+}
+
+// schema is the subset of the OpenAPI 3.0 schemas the document uses, enums are only supported on strings.
+type schema struct {
+	Ref                  string             `json:"$ref"`
+	AllOf                []*schema          `json:"allOf"`
+	Type                 string             `json:"type"`
+	Properties           map[string]*schema `json:"properties"`
+	Required             []string           `json:"required"`
+	AdditionalProperties json.RawMessage    `json:"additionalProperties"`
+	Items                *schema            `json:"items"`
+	MinItems             *int               `json:"minItems"`
+	MaxItems             *int               `json:"maxItems"`
+	Enum                 []string           `json:"enum"`
+	Pattern              string             `json:"pattern"`
+	MinLength            *int               `json:"minLength"`
+	MaxLength            *int               `json:"maxLength"`
+	Minimum              *float64           `json:"minimum"`
+	Maximum              *float64           `json:"maximum"`
+	ExclusiveMinimum     bool               `json:"exclusiveMinimum"`
+
+	pattern *regexp.Regexp
+}
+
+func mustParseSpec(document []byte) apiSpec {
+	var s apiSpec
+	if err := json.Unmarshal(document, &s); err != nil {
+		panic(fmt.Sprintf("cannot parse openapi.json: %v", err))
+	}
+	for _, schema := range s.Components.Schemas {
+		s.compile(schema)
+	}
+	for _, item := range s.Paths {
+		for _, op := range item {
+			if op.RequestBody != nil {
+				s.compile(op.RequestBody.Content["application/json"].Schema)
+			}
+		}
+	}
+	return s
+}
+
+// compile checks the references and compiles the patterns of the schema.
+func (s apiSpec) compile(sc *schema) {
+	if sc == nil {
+		return
+	}
+	if sc.Ref != "" {
+		s.resolve(sc)
+	}
+	if sc.Pattern != "" {
+		sc.pattern = regexp.MustCompile(sc.Pattern)
+	}
+	for _, sub := range sc.AllOf {
+		s.compile(sub)
+	}
+	for _, property := range sc.Properties {
+		s.compile(property)
+	}
+	s.compile(sc.Items)
+}
+
+func (s apiSpec) resolve(sc *schema) *schema {
+	if sc.Ref == "" {
+		return sc
+	}
+	resolved, ok := s.Components.Schemas[strings.TrimPrefix(sc.Ref, "#/components/schemas/")]
+	if !ok {
+		panic(fmt.Sprintf("openapi.json: unknown schema %s", sc.Ref))
+	}
+	return resolved
+}
+
+// requestSchema returns the schema of the request body of the route pattern, e.g. "POST /orders", nil without body.
+func (s apiSpec) requestSchema(route string) *schema {
+	method, path, _ := strings.Cut(route, " ")
+	op, ok := s.Paths[path][strings.ToLower(method)]
+	if !ok || op.RequestBody == nil {
+		return nil
+	}
+	return op.RequestBody.Content["application/json"].Schema
+}
+
+// validate checks the decoded json value v, numbers must be decoded as json.Number.
+func (s apiSpec) validate(sc *schema, v any) error {
+	e := ValidationError{Subject: "request body"}
+	s.check(sc, "", v, &e)
+	if len(e.Fields) != 0 {
+		return e
+	}
+	return nil
+}
+
+func (s apiSpec) check(sc *schema, field string, v any, e *ValidationError) {
+	sc = s.resolve(sc)
+	for _, sub := range sc.AllOf {
+		s.check(sub, field, v, e)
+	}
+	name := field
+	if name == "" {
+		name = "body"
+	}
+	switch sc.Type {
+	case "object":
+		object, ok := v.(map[string]any)
+		if !ok {
+			e.add(name, "must be an object")
+			return
+		}
+		for _, required := range sc.Required {
+			if _, ok := object[required]; !ok {
+				e.add(joinField(field, required), "is required")
+			}
+		}
+		// sorted for the errors to be listed in a stable order
+		keys := make([]string, 0, len(object))
+		for key := range object {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			property, ok := sc.Properties[key]
+			if !ok {
+				if string(sc.AdditionalProperties) == "false" {
+					e.add(joinField(field, key), "is not allowed")
+				}
+				continue
+			}
+			s.check(property, joinField(field, key), object[key], e)
+		}
+	case "array":
+		array, ok := v.([]any)
+		if !ok {
+			e.add(name, "must be an array")
+			return
+		}
+		if sc.MinItems != nil && len(array) < *sc.MinItems {
+			e.add(name, "must hold at least %d items", *sc.MinItems)
+		}
+		if sc.MaxItems != nil && len(array) > *sc.MaxItems {
+			e.add(name, "must hold at most %d items", *sc.MaxItems)
+		}
+		if sc.Items != nil {
+			for i, item := range array {
+				s.check(sc.Items, fmt.Sprintf("%s[%d]", field, i), item, e)
+			}
+		}
+	case "string":
+		str, ok := v.(string)
+		if !ok {
+			e.add(name, "must be a string")
+			return
+		}
+		if len(sc.Enum) != 0 && !slices.Contains(sc.Enum, str) {
+			e.add(name, "must be one of %s", strings.Join(sc.Enum, ", "))
+		}
+		if sc.pattern != nil && !sc.pattern.MatchString(str) {
+			e.add(name, "must match %s", sc.Pattern)
+		}
+		if n := utf8.RuneCountInString(str); sc.MinLength != nil && n < *sc.MinLength {
+			e.add(name, "must be at least %d characters", *sc.MinLength)
+		} else if sc.MaxLength != nil && n > *sc.MaxLength {
+			e.add(name, "must be at most %d characters", *sc.MaxLength)
+		}
+	case "number", "integer":
+		number, ok := v.(json.Number)
+		if !ok {
+			e.add(name, "must be a %s", sc.Type)
+			return
+		}
+		if _, err := number.Int64(); sc.Type == "integer" && err != nil {
+			e.add(name, "must be an integer")
+			return
+		}
+		f, err := number.Float64()
+		if err != nil {
+			e.add(name, "must be a number")
+			return
+		}
+		switch {
+		case sc.Minimum != nil && sc.ExclusiveMinimum && f <= *sc.Minimum:
+			e.add(name, "must be greater than %g", *sc.Minimum)
+		case sc.Minimum != nil && f < *sc.Minimum:
+			e.add(name, "must be at least %g", *sc.Minimum)
+		case sc.Maximum != nil && f > *sc.Maximum:
+			e.add(name, "must be at most %g", *sc.Maximum)
+		}
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			e.add(name, "must be a boolean")
+		}
+	}
+}
+
+func joinField(parent, name string) string {
+	if parent == "" {
+		return name
+	}
+	return parent + "." + name
+}
+
+// validateRequest rejects the requests whose body doesn't match the schema of their route in the OpenAPI document,
+// it must be wrapped by the authentication middleware, if any, for the credentials to be checked first.
+func validateRequest(mux *http.ServeMux, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, route := mux.Handler(r)
+		sc := spec.requestSchema(route)
+		if sc == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		body, ok := readBody(w, r)
+		if !ok {
+			return
+		}
+		if len(bytes.TrimSpace(body)) == 0 {
+			RespondWithError(w, http.StatusBadRequest, "a request body is required")
+			return
+		}
+		decoder := json.NewDecoder(bytes.NewReader(body))
+		decoder.UseNumber()
+		var v any
+		if err := decoder.Decode(&v); err != nil {
+			RespondWithError(w, http.StatusBadRequest, fmt.Errorf("invalid json: %v", err))
+			return
+		}
+		if err := spec.validate(sc, v); err != nil {
+			RespondWithError(w, http.StatusBadRequest, err)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		next.ServeHTTP(w, r)
+	}
+}
+
+func (api api) openAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(openAPIDocument)
+}
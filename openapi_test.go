@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestOpenAPIRoutes(t *testing.T) {
+	src, err := os.ReadFile("api.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var routes []string
+	for _, m := range regexp.MustCompile(`mux\.Handle(?:Func)?\("([^"]+)"`).FindAllSubmatch(src, -1) {
+		routes = append(routes, string(m[1]))
+	}
+	var described []string
+	for path, item := range spec.Paths {
+		for method := range item {
+			described = append(described, strings.ToUpper(method)+" "+path)
+		}
+	}
+	sort.Strings(routes)
+	sort.Strings(described)
+	if !reflect.DeepEqual(routes, described) {
+		t.Errorf("routes %v\ndescribed %v", routes, described)
+	}
+
+	ctx := context.Background()
+	db := newMem()
+	username, id := randomTestUser(t, db)
+	if err := db.SetUserRole(ctx, id, roleAdmin); err != nil {
+		t.Fatal(err)
+	}
+	handler := newTestAPI(db, fakeMatcher{}).routes()
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/openapi.json", nil))
+	if got, want := w.Code, http.StatusOK; got != want || !bytes.Equal(w.Body.Bytes(), openAPIDocument) {
+		t.Errorf("got %v %.40s want %v", got, w.Body, want)
+	}
+
+	// every route with a request body must validate it
+	for _, route := range described {
+		if spec.requestSchema(route) == nil {
+			continue
+		}
+		method, path, _ := strings.Cut(route, " ")
+		path = strings.NewReplacer("{username}", username, "{pair}", "EUR-USD").Replace(path)
+		req := httptest.NewRequest(method, path, strings.NewReader(`"invalid"`))
+		req.Header.Add("Authorization", "Basic "+basicAuth(username, username))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		var jsonError JSONError
+		_ = json.NewDecoder(w.Body).Decode(&jsonError)
+		if w.Code != http.StatusBadRequest || jsonError.Code != "VALIDATION_FAILED" {
+			t.Errorf("%s: got %v %+v", route, w.Code, jsonError)
+		}
+	}
+}
+
+func TestValidateRequest(t *testing.T) {
+	tests := []struct {
+		name   string
+		route  string
+		body   string
+		fields []string
+	}{
+		{name: "valid", route: "POST /orders", body: `{"side": "BUY", "asset_pair": "EUR-USD", "amount": 1, "price": 1.2}`},
+		{name: "read only fields", route: "POST /orders", body: `{"id": 0, "status": "", "side": "BUY", "asset_pair": "EUR-USD", "amount": 1, "price": 1.2}`},
+		{name: "missing pair", route: "POST /orders", body: `{"side": "BUY", "amount": 1, "price": 1.2}`, fields: []string{"asset_pair"}},
+		{name: "unknown side", route: "POST /orders", body: `{"side": "HOLD", "asset_pair": "EUR-USD", "amount": 1, "price": 1.2}`, fields: []string{"side"}},
+		{name: "pair format", route: "POST /orders", body: `{"side": "BUY", "asset_pair": "EURUSD", "amount": 1, "price": 1.2}`, fields: []string{"asset_pair"}},
+		{name: "types", route: "POST /orders", body: `{"side": 1, "asset_pair": "EUR-USD", "amount": "1", "price": null}`, fields: []string{"amount", "price", "side"}},
+		{name: "not positive", route: "POST /orders", body: `{"side": "BUY", "asset_pair": "EUR-USD", "amount": 0, "price": -1}`, fields: []string{"amount", "price"}},
+		{name: "client order id", route: "POST /orders", body: `{"client_order_id": "` + strings.Repeat("a", 65) + `", "side": "BUY", "asset_pair": "EUR-USD", "amount": 1, "price": 1}`, fields: []string{"client_order_id"}},
+		{name: "not an object", route: "POST /orders", body: `[]`, fields: []string{"body"}},
+		{name: "batch", route: "POST /orders/batch", body: `[{"side": "BUY", "asset_pair": "EUR-USD", "amount": 1, "price": 1}, {"side": "SELL", "amount": 1, "price": 1}]`, fields: []string{"[1].asset_pair"}},
+		{name: "empty batch", route: "POST /orders/batch", body: `[]`, fields: []string{"body"}},
+		{name: "ids", route: "DELETE /orders/batch", body: `[1, 2.5, "3"]`, fields: []string{"[1]", "[2]"}},
+		{name: "scopes", route: "POST /apikeys", body: `{"scopes": ["read", "admin"]}`, fields: []string{"scopes[1]"}},
+		{name: "pair state", route: "POST /admin/pairs/{pair}/state", body: `{"state": "paused"}`, fields: []string{"state"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sc := spec.requestSchema(tt.route)
+			if sc == nil {
+				t.Fatalf("no request body for %s", tt.route)
+			}
+			decoder := json.NewDecoder(strings.NewReader(tt.body))
+			decoder.UseNumber()
+			var v any
+			if err := decoder.Decode(&v); err != nil {
+				t.Fatal(err)
+			}
+			var fields []string
+			if err := spec.validate(sc, v); err != nil {
+				for _, f := range err.(ValidationError).Fields {
+					fields = append(fields, f.Field)
+				}
+			}
+			if !reflect.DeepEqual(fields, tt.fields) {
+				t.Errorf("got %v want %v", fields, tt.fields)
+			}
+		})
+	}
+}
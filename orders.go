@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultOrdersLimit = 100
+	maxOrdersLimit     = 1000
+	nextCursorHeader   = "X-Next-Cursor"
+)
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// OrderFilter selects the orders of a user, sorted by creation time then id. Zero values match everything and a zero
+// Limit returns all the matching orders.
+type OrderFilter struct {
+	Status string
+	Pair   string
+	Side   string
+	From   time.Time // inclusive
+	To     time.Time // exclusive
+	After  *orderCursor
+	Limit  int
+}
+
+func (f OrderFilter) match(order Order) bool {
+	switch {
+	case f.Status != "" && order.Status != f.Status,
+		f.Pair != "" && order.AssetPair != f.Pair,
+		f.Side != "" && order.Side != f.Side,
+		!f.From.IsZero() && order.CreatedAt.Before(f.From),
+		!f.To.IsZero() && !order.CreatedAt.Before(f.To),
+		f.After != nil && !f.After.before(order):
+		return false
+	}
+	return true
+}
+
+// orderCursor is the position of the last order of a page. Creation times are kept to the microsecond, as in postgres.
+type orderCursor struct {
+	CreatedAt time.Time
+	ID        int
+}
+
+func cursorOf(order Order) *orderCursor {
+	return &orderCursor{CreatedAt: order.CreatedAt, ID: order.ID}
+}
+
+func (c orderCursor) before(order Order) bool {
+	if !c.CreatedAt.Equal(order.CreatedAt) {
+		return c.CreatedAt.Before(order.CreatedAt)
+	}
+	return c.ID < order.ID
+}
+
+func (c orderCursor) String() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d:%d", c.CreatedAt.UnixMicro(), c.ID)))
+}
+
+func parseOrderCursor(s string) (*orderCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	var micro int64
+	var id int
+	if _, err := fmt.Sscanf(string(b), "%d:%d", &micro, &id); err != nil {
+		return nil, ErrInvalidCursor
+	}
+	return &orderCursor{CreatedAt: time.UnixMicro(micro), ID: id}, nil
+}
+
+func (api api) orderFilter(query url.Values) (OrderFilter, error) {
+	filter := OrderFilter{
+		Status: query.Get("status"),
+		Pair:   query.Get("pair"),
+		Side:   query.Get("side"),
+		Limit:  defaultOrdersLimit,
+	}
+	switch filter.Status {
+	case "", statusPending, statusFilled, statusCancelled:
+	default:
+		return filter, fmt.Errorf("invalid status %q", filter.Status)
+	}
+	if filter.Side != "" && filter.Side != "BUY" && filter.Side != "SELL" {
+		return filter, fmt.Errorf("invalid side %q", filter.Side)
+	}
+	if _, ok := api.engines[filter.Pair]; filter.Pair != "" && !ok {
+		return filter, ErrUnknownPair
+	}
+	for name, t := range map[string]*time.Time{"from": &filter.From, "to": &filter.To} {
+		if v := query.Get(name); v != "" {
+			parsed, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return filter, fmt.Errorf("invalid %s: %v", name, err)
+			}
+			*t = parsed
+		}
+	}
+	if v := query.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxOrdersLimit {
+			return filter, fmt.Errorf("limit must be between 1 and %d", maxOrdersLimit)
+		}
+		filter.Limit = limit
+	}
+	if v := query.Get("cursor"); v != "" {
+		cursor, err := parseOrderCursor(v)
+		if err != nil {
+			return filter, err
+		}
+		filter.After = cursor
+	}
+	return filter, nil
+}
+
+// listOrders responds with a page of the user's orders, the cursor of the next page, if any, is set in the
+// X-Next-Cursor header.
+func (api api) listOrders(w http.ResponseWriter, r *http.Request, userID int) {
+	filter, err := api.orderFilter(r.URL.Query())
+	if err != nil {
+		RespondWithError(w, http.StatusBadRequest, err)
+		return
+	}
+	limit := filter.Limit
+	filter.Limit++
+	orders, err := api.db.UserOrders(r.Context(), userID, filter)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if len(orders) > limit {
+		orders = orders[:limit]
+		w.Header().Set(nextCursorHeader, cursorOf(orders[limit-1]).String())
+	}
+	if orders == nil {
+		orders = []Order{}
+	}
+	RespondWithJSON(w, http.StatusOK, orders)
+}
+
+// orderResponse is the order as placed, with the executions it triggered immediately.
+type orderResponse struct {
+	Order
+	Fills []Execution `json:"fills"`
+}
+
+// checkOrder returns the engine of the order pair if it accepts the order, or the error and its status code.
+func (api api) checkOrder(order Order) (*engine, int, error) {
+	engine, ok := api.engines[order.AssetPair]
+	if !ok {
+		return nil, http.StatusBadRequest, ErrUnknownPair
+	}
+	if err := stateError(engine.State()); err != nil {
+		return nil, http.StatusConflict, err
+	}
+	if err := validateOrder(order, engine.pair, engine.ReferencePrice()); err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	return engine, http.StatusOK, nil
+}
+
+// placeOrder saves a checked order, submits it to the engine and settles the matches.
+func (api api) placeOrder(ctx context.Context, engine *engine, order Order) (orderResponse, int, error) {
+	if err := api.db.SaveOrder(ctx, &order); err != nil {
+		if errors.Is(err, ErrDuplicateClientOrderID) {
+			return orderResponse{}, http.StatusConflict, err
+		}
+		return orderResponse{}, http.StatusInternalServerError, err
+	}
+	// from here the book and the store must agree, the request being cancelled doesn't stop the settlement
+	ctx = context.WithoutCancel(ctx)
+	matches, execs, err := engine.Submit(ctx, order)
+	if err != nil {
+		// the pair state changed in the meantime, the order never reached the book. Closing the pair may have
+		// cancelled it already.
+		if err := api.db.CancelOrder(ctx, order.ID); err != nil && !errors.Is(err, ErrOrderNotPending) {
+			return orderResponse{}, http.StatusInternalServerError, err
+		}
+		return orderResponse{}, http.StatusConflict, err
+	}
+	slog.InfoContext(ctx, "order placed", "order", order.ID, "pair", order.AssetPair, "side", order.Side, "matches", len(matches))
+	if len(matches) > 0 {
+		fills := make([]Fill, len(matches))
+		for i, match := range matches {
+			fills[i] = Fill{Order: match, FeePercent: engine.pair.Fees.MakerPercent}
+			if match.ID == order.ID {
+				fills[i].FeePercent = engine.pair.Fees.TakerPercent
+				order.Status = statusFilled
+			}
+		}
+		if err := api.db.FillOrders(ctx, fills...); err != nil {
+			settlementFailures.WithLabelValues(engine.pair.Name).Inc()
+			return orderResponse{}, http.StatusInternalServerError, err
+		}
+	}
+	for _, execution := range execs {
+		api.recordExecution(ctx, execution)
+	}
+	if execs == nil {
+		execs = []Execution{}
+	}
+	return orderResponse{Order: order, Fills: execs}, http.StatusOK, nil
+}
+
+// cancelOrder removes a pending order from the book and returns it cancelled, entry is saved with the cancellation
+// when it is an admin action. It returns ErrOrderNotPending when the order left the book, e.g. matched in the meantime.
+func (api api) cancelOrder(ctx context.Context, order Order, entry *AuditEntry) (Order, error) {
+	return api.removeOrder(ctx, order, entry, (*engine).Cancel)
+}
+
+// removeOrder cancels the order in the store and takes it out of the book of its pair with remove, either Cancel or
+// Pull.
+func (api api) removeOrder(ctx context.Context, order Order, entry *AuditEntry, remove func(*engine, context.Context, int, func(context.Context) error) error) (Order, error) {
+	if order.Status != statusPending {
+		return order, ErrOrderNotPending
+	}
+	persist := func(ctx context.Context) error {
+		return api.db.CancelOrderAudited(ctx, order.ID, entry)
+	}
+	var err error
+	if engine, ok := api.engines[order.AssetPair]; ok {
+		err = remove(engine, ctx, order.ID, persist)
+	} else {
+		err = persist(ctx)
+	}
+	if err != nil {
+		return order, err
+	}
+	slog.InfoContext(ctx, "order cancelled", "order", order.ID, "pair", order.AssetPair)
+	order.Status = statusCancelled
+	return order, nil
+}
+
+func cancelStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrOrderNotPending), errors.Is(err, ErrTradingHalted), errors.Is(err, ErrPairClosed):
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
+// cancelAll cancels the pending orders of the user on the pair, or on every pair when empty, including those frozen in
+// the book of a halted pair. The orders that left the book in the meantime are skipped and logged.
+func (api api) cancelAll(ctx context.Context, userID int, pair string) ([]Order, error) {
+	pending, err := api.db.UserOrders(ctx, userID, OrderFilter{Status: statusPending, Pair: pair})
+	if err != nil {
+		return nil, err
+	}
+	cancelled := []Order{}
+	for _, order := range pending {
+		order, err := api.removeOrder(ctx, order, nil, (*engine).Pull)
+		if errors.Is(err, ErrOrderNotPending) || errors.Is(err, ErrPairClosed) {
+			// filled, cancelled with its closed pair, or not yet in the book
+			slog.WarnContext(ctx, "order skipped by cancel all", "order", order.ID, "pair", order.AssetPair, "err", err)
+			continue
+		}
+		if err != nil {
+			return cancelled, err
+		}
+		cancelled = append(cancelled, order)
+	}
+	return cancelled, nil
+}
+
+func (api api) cancelAllOrders(w http.ResponseWriter, r *http.Request) {
+	userID, err := mustUserID(r)
+	if err != nil {
+		RespondWithError(w, http.StatusForbidden, err)
+		return
+	}
+	pair := r.URL.Query().Get("pair")
+	if _, ok := api.engines[pair]; pair != "" && !ok {
+		RespondWithError(w, http.StatusBadRequest, ErrUnknownPair)
+		return
+	}
+	cancelled, err := api.cancelAll(r.Context(), userID, pair)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err)
+		return
+	}
+	RespondWithJSON(w, http.StatusOK, cancelled)
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+)
+
+const (
+	pairOpen       = "open"
+	pairHalted     = "halted"
+	pairCancelOnly = "cancel-only"
+	pairClosed     = "closed"
+)
+
+var (
+	ErrUnknownPair      = errors.New("unknown asset pair")
+	ErrUnknownAsset     = errors.New("asset not traded on any pair")
+	ErrTradingHalted    = errors.New("trading is halted on this pair")
+	ErrPairCancelOnly   = errors.New("pair only accepts cancellations")
+	ErrPairClosed       = errors.New("pair is closed")
+	ErrInvalidPairState = errors.New("pair state must be open, halted, cancel-only or closed")
+)
+
+type Pair struct {
+	Name  string `json:"name"`
+	Base  string `json:"base"`
+	Quote string `json:"quote"`
+	// TickSize and LotSize are the price and amount increments, zero disables the check.
+	TickSize float64 `json:"tick_size"`
+	LotSize  float64 `json:"lot_size"`
+	// PriceBandPercent rejects orders priced further than this from the reference price, zero disables it.
+	PriceBandPercent float64 `json:"price_band_percent"`
+	// MinAmount, MaxAmount, MinNotional and MaxNotional bound the order size, zero disables a bound.
+	MinAmount      float64              `json:"min_amount"`
+	MaxAmount      float64              `json:"max_amount"`
+	MinNotional    float64              `json:"min_notional"`
+	MaxNotional    float64              `json:"max_notional"`
+	CircuitBreaker circuitBreakerConfig `json:"circuit_breaker"`
+	Fees           feeConfig            `json:"fees"`
+}
+
+// feeConfig is the share of the received amount kept on each fill, the taker is the order that triggered the match.
+type feeConfig struct {
+	MakerPercent float64 `json:"maker_percent"`
+	TakerPercent float64 `json:"taker_percent"`
+}
+
+// circuitBreakerConfig halts the pair for Cooldown when the trade price moves more than MaxMovePercent within Window.
+// A zero MaxMovePercent disables the circuit breaker.
+type circuitBreakerConfig struct {
+	MaxMovePercent float64  `json:"max_move_percent"`
+	Window         duration `json:"window"`
+	Cooldown       duration `json:"cooldown"`
+}
+
+// duration is a time.Duration encoded as a string like "5m" in json.
+type duration time.Duration
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+// defaultPairs are traded when the configuration doesn't list any pair.
+var defaultPairs = []Pair{
+	{
+		Name:             "EUR-USD",
+		Base:             "EUR",
+		Quote:            "USD",
+		TickSize:         0.0001,
+		LotSize:          0.01,
+		PriceBandPercent: 10,
+		MinAmount:        0.01,
+		MaxAmount:        1_000_000,
+		MinNotional:      0.01,
+		MaxNotional:      10_000_000,
+		CircuitBreaker: circuitBreakerConfig{
+			MaxMovePercent: 10,
+			Window:         duration(5 * time.Minute),
+			Cooldown:       duration(5 * time.Minute),
+		},
+	},
+}
+
+// stateError returns the error explaining why a pair in this state rejects new orders, nil if it accepts them.
+func stateError(state string) error {
+	switch state {
+	case pairOpen:
+		return nil
+	case pairHalted:
+		return ErrTradingHalted
+	case pairCancelOnly:
+		return ErrPairCancelOnly
+	case pairClosed:
+		return ErrPairClosed
+	}
+	return ErrInvalidPairState
+}
+
+// cancelError returns the error explaining why a pair in this state rejects cancellations, nil if it accepts them. A
+// halted pair freezes its book, a closed pair has none.
+func cancelError(state string) error {
+	switch state {
+	case pairHalted:
+		return ErrTradingHalted
+	case pairClosed:
+		return ErrPairClosed
+	}
+	return nil
+}
+
+// isMultiple reports whether v is a multiple of step, within float precision.
+func isMultiple(v, step float64) bool {
+	if step <= 0 {
+		return true
+	}
+	n := v / step
+	return math.Abs(n-math.Round(n)) < 1e-12*math.Max(1, math.Abs(n))
+}
+
+type pricePoint struct {
+	price float64
+	at    time.Time
+}
+
+type circuitBreaker struct {
+	config circuitBreakerConfig
+	prices []pricePoint
+}
+
+// record adds a trade price and reports whether the price moved more than allowed within the window.
+func (b *circuitBreaker) record(price float64, now time.Time) bool {
+	if b.config.MaxMovePercent <= 0 {
+		return false
+	}
+	i := 0
+	for i < len(b.prices) && now.Sub(b.prices[i].at) > time.Duration(b.config.Window) {
+		i++
+	}
+	b.prices = append(b.prices[i:], pricePoint{price: price, at: now})
+
+	low, high := price, price
+	for _, p := range b.prices {
+		low, high = min(low, p.price), max(high, p.price)
+	}
+	return (high-low)/low*100 > b.config.MaxMovePercent
+}
+
+func (b *circuitBreaker) reset() {
+	b.prices = nil
+}
+
+type pairInfo struct {
+	Pair
+	State string `json:"state"`
+}
+
+func (api api) pairs(w http.ResponseWriter, r *http.Request) {
+	infos := make([]pairInfo, 0, len(api.engines))
+	for _, engine := range api.engines {
+		infos = append(infos, pairInfo{Pair: engine.pair, State: engine.State()})
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name < infos[j].Name
+	})
+	RespondWithJSON(w, http.StatusOK, infos)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"runtime"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var ErrUnknownHashFormat = errors.New("unknown password hash format")
+
+// passwordHasher hashes passwords into a self describing encoded form.
+type passwordHasher interface {
+	Hash(password string) ([]byte, error)
+	// Verify reports whether the password matches the encoded hash, and whether the hash should be
+	// replaced because it was produced by another algorithm or with other parameters.
+	Verify(password string, encoded []byte) (ok bool, rehash bool, err error)
+}
+
+const argon2idPrefix = "$argon2id$"
+
+// the password hashers selectable in the configuration
+const (
+	hasherArgon2id = "argon2id"
+	hasherBcrypt   = "bcrypt"
+)
+
+// newPasswordHasher returns the hasher of the configuration, argon2id unless bcrypt is asked for. The hashes of the
+// other one are still verified, and replaced at the next login.
+func newPasswordHasher(name string) passwordHasher {
+	if name == hasherBcrypt {
+		return bcryptHasher{cost: bcrypt.DefaultCost}
+	}
+	return newArgon2idHasher()
+}
+
+// argon2idHasher encodes hashes as $argon2id$v=19$m=<memory>,t=<time>,p=<threads>$<salt>$<key>.
+type argon2idHasher struct {
+	time    uint32
+	memory  uint32
+	threads uint8
+	keyLen  uint32
+	saltLen int
+}
+
+// newArgon2idHasher uses the OWASP recommended parameters, 19 MiB of memory, 2 iterations and 1 thread. Hashes made
+// with the earlier 64 MiB and 4 threads are replaced at the next login.
+func newArgon2idHasher() argon2idHasher {
+	return argon2idHasher{time: 2, memory: 19 * 1024, threads: 1, keyLen: 32, saltLen: 16}
+}
+
+// argon2Slots bounds the number of concurrent argon2id computations, and so the memory they hold, a burst of logins
+// waits for a slot instead of allocating memory for each.
+var argon2Slots = make(chan struct{}, runtime.NumCPU())
+
+func argon2idKey(password, salt []byte, time, memory uint32, threads uint8, keyLen uint32) []byte {
+	argon2Slots <- struct{}{}
+	defer func() { <-argon2Slots }()
+	return argon2.IDKey(password, salt, time, memory, threads, keyLen)
+}
+
+func (h argon2idHasher) Hash(password string) ([]byte, error) {
+	salt := make([]byte, h.saltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("cannot generate salt: %v", err)
+	}
+	key := argon2idKey([]byte(password), salt, h.time, h.memory, h.threads, h.keyLen)
+	return []byte(fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2idPrefix, argon2.Version, h.memory, h.time, h.threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	)), nil
+}
+
+func (h argon2idHasher) Verify(password string, encoded []byte) (bool, bool, error) {
+	if !bytes.HasPrefix(encoded, []byte(argon2idPrefix)) {
+		return verifyForeign(password, encoded)
+	}
+	parts := strings.Split(string(encoded), "$")
+	if len(parts) != 6 {
+		return false, false, ErrUnknownHashFormat
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return false, false, ErrUnknownHashFormat
+	}
+	var params argon2idHasher
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.memory, &params.time, &params.threads); err != nil {
+		return false, false, ErrUnknownHashFormat
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, false, ErrUnknownHashFormat
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return false, false, ErrUnknownHashFormat
+	}
+	params.keyLen, params.saltLen = uint32(len(key)), len(salt)
+
+	computed := argon2idKey([]byte(password), salt, params.time, params.memory, params.threads, params.keyLen)
+	if subtle.ConstantTimeCompare(computed, key) != 1 {
+		return false, false, nil
+	}
+	return true, version != argon2.Version || params != h, nil
+}
+
+type bcryptHasher struct {
+	cost int
+}
+
+func (h bcryptHasher) Hash(password string) ([]byte, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), h.cost)
+	if err != nil {
+		return nil, fmt.Errorf("cannot hash password: %v", err)
+	}
+	return hash, nil
+}
+
+func (h bcryptHasher) Verify(password string, encoded []byte) (bool, bool, error) {
+	if !isBcrypt(encoded) {
+		return verifyForeign(password, encoded)
+	}
+	if err := bcrypt.CompareHashAndPassword(encoded, []byte(password)); err != nil {
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return false, false, nil
+		}
+		return false, false, err
+	}
+	cost, err := bcrypt.Cost(encoded)
+	if err != nil {
+		return false, false, err
+	}
+	return true, cost != h.cost, nil
+}
+
+func isBcrypt(encoded []byte) bool {
+	return bytes.HasPrefix(encoded, []byte("$2a$")) || bytes.HasPrefix(encoded, []byte("$2b$")) || bytes.HasPrefix(encoded, []byte("$2y$"))
+}
+
+// verifyForeign verifies hashes produced by a hasher other than the configured one, including the
+// legacy unsalted sha256 hashes. A match always asks for a rehash.
+func verifyForeign(password string, encoded []byte) (bool, bool, error) {
+	var (
+		ok  bool
+		err error
+	)
+	switch {
+	case bytes.HasPrefix(encoded, []byte(argon2idPrefix)):
+		ok, _, err = argon2idHasher{}.Verify(password, encoded)
+	case isBcrypt(encoded):
+		ok, _, err = bcryptHasher{}.Verify(password, encoded)
+	case len(encoded) == sha256.Size:
+		legacy := sha256.Sum256([]byte(password))
+		ok = subtle.ConstantTimeCompare(legacy[:], encoded) == 1
+	default:
+		err = ErrUnknownHashFormat
+	}
+	return ok, ok, err
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"testing"
+)
+
+func TestPasswordHasher(t *testing.T) {
+	argon := argon2idHasher{time: 1, memory: 1024, threads: 1, keyLen: 32, saltLen: 16}
+	weakArgon := argon2idHasher{time: 1, memory: 512, threads: 1, keyLen: 32, saltLen: 16}
+	bcryptH := bcryptHasher{cost: 4}
+	legacy := sha256.Sum256([]byte("password"))
+
+	tests := []struct {
+		name   string
+		hasher passwordHasher
+		hash   func(t *testing.T) []byte
+		rehash bool
+	}{
+		{name: "argon2id", hasher: argon, hash: mustHash(argon)},
+		{name: "argon2id other parameters", hasher: argon, hash: mustHash(weakArgon), rehash: true},
+		{name: "bcrypt", hasher: bcryptH, hash: mustHash(bcryptH)},
+		{name: "bcrypt to argon2id", hasher: argon, hash: mustHash(bcryptH), rehash: true},
+		{name: "argon2id to bcrypt", hasher: bcryptH, hash: mustHash(argon), rehash: true},
+		{name: "legacy sha256", hasher: argon, hash: func(*testing.T) []byte { return legacy[:] }, rehash: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hash := tt.hash(t)
+
+			ok, rehash, err := tt.hasher.Verify("password", hash)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !ok {
+				t.Errorf("password doesn't match")
+			}
+			if got, want := rehash, tt.rehash; got != want {
+				t.Errorf("rehash: got %v want %v", got, want)
+			}
+
+			ok, rehash, err = tt.hasher.Verify("wrong", hash)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok || rehash {
+				t.Errorf("wrong password: got ok=%v rehash=%v", ok, rehash)
+			}
+		})
+	}
+
+	t.Run("salted", func(t *testing.T) {
+		if bytes.Equal(mustHash(argon)(t), mustHash(argon)(t)) {
+			t.Errorf("same password hashed twice gives the same hash")
+		}
+	})
+
+	t.Run("unknown format", func(t *testing.T) {
+		if _, _, err := argon.Verify("password", []byte("plain")); err == nil {
+			t.Errorf("expected an error")
+		}
+	})
+}
+
+func mustHash(h passwordHasher) func(t *testing.T) []byte {
+	return func(t *testing.T) []byte {
+		hash, err := h.Hash("password")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return hash
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// route classes sharing a rate limit
+const (
+	classOrders       = "orders"
+	classQueries      = "queries"
+	classAuthFailures = "auth_failures"
+	// classRegistrations is kept per client address, the registrations are never authenticated
+	classRegistrations = "registrations"
+)
+
+const (
+	rateLimitHeader          = "X-RateLimit-Limit"
+	rateLimitRemainingHeader = "X-RateLimit-Remaining"
+)
+
+var (
+	ErrRateLimited = errors.New("too many requests")
+	ErrLoginLocked = errors.New("too many failed logins, the account is temporarily locked")
+)
+
+// rateLimiter holds one token bucket per key, they share the same rate and burst. A nil rateLimiter allows everything.
+type rateLimiter struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   int
+	buckets map[string]*tokenBucket
+	swept   time.Time
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// newRateLimiter returns nil when the rate is zero, the limit is disabled.
+func newRateLimiter(cfg bucketConfig) *rateLimiter {
+	if cfg.Rate == 0 {
+		return nil
+	}
+	return &rateLimiter{rate: cfg.Rate, burst: cfg.Burst, buckets: make(map[string]*tokenBucket)}
+}
+
+// take removes a token from the bucket of each key, and returns the fewest tokens left, or how long to wait for a token
+// in every bucket when one is empty, nothing is taken then.
+func (l *rateLimiter) take(now time.Time, keys ...string) (remaining int, wait time.Duration) {
+	if l == nil {
+		return 0, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	buckets := make([]*tokenBucket, len(keys))
+	for i, key := range keys {
+		buckets[i] = l.bucket(key, now)
+		if buckets[i].tokens < 1 {
+			wait = max(wait, l.untilToken(buckets[i]))
+		}
+	}
+	if wait > 0 {
+		return 0, wait
+	}
+	remaining = l.burst
+	for _, b := range buckets {
+		b.tokens--
+		remaining = min(remaining, int(b.tokens))
+	}
+	return remaining, 0
+}
+
+// wait returns how long to wait for a token of the key, without taking it.
+func (l *rateLimiter) wait(key string, now time.Time) time.Duration {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b := l.bucket(key, now)
+	if b.tokens < 1 {
+		return l.untilToken(b)
+	}
+	return 0
+}
+
+func (l *rateLimiter) untilToken(b *tokenBucket) time.Duration {
+	return time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+}
+
+// bucket returns the bucket of the key refilled until now, the full buckets are forgotten from time to time.
+func (l *rateLimiter) bucket(key string, now time.Time) *tokenBucket {
+	full := time.Duration(float64(l.burst) / l.rate * float64(time.Second))
+	if now.Sub(l.swept) > full {
+		for k, b := range l.buckets {
+			if now.Sub(b.updated) > full {
+				delete(l.buckets, k)
+			}
+		}
+		l.swept = now
+	}
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: float64(l.burst), updated: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(l.burst), b.tokens+now.Sub(b.updated).Seconds()*l.rate)
+	b.updated = now
+	return b
+}
+
+// loginLockout locks a username out for a while after consecutive failed logins, whether the username exists or not.
+// A nil loginLockout never locks.
+type loginLockout struct {
+	mu          sync.Mutex
+	maxFailures int
+	duration    time.Duration
+	failures    map[string]loginFailures
+	lockedUntil map[string]time.Time
+	swept       time.Time
+}
+
+type loginFailures struct {
+	count int
+	last  time.Time
+}
+
+// newLoginLockout returns nil when max failures is zero, the lockout is disabled.
+func newLoginLockout(cfg lockoutConfig) *loginLockout {
+	if cfg.MaxFailures == 0 {
+		return nil
+	}
+	return &loginLockout{
+		maxFailures: cfg.MaxFailures,
+		duration:    time.Duration(cfg.Duration),
+		failures:    make(map[string]loginFailures),
+		lockedUntil: make(map[string]time.Time),
+	}
+}
+
+// lockedFor returns how long the username stays locked out, zero if it isn't.
+func (l *loginLockout) lockedFor(username string, now time.Time) time.Duration {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	until, ok := l.lockedUntil[username]
+	if !ok {
+		return 0
+	}
+	if !now.Before(until) {
+		delete(l.lockedUntil, username)
+		return 0
+	}
+	return until.Sub(now)
+}
+
+// fail records a failed login, the username is locked out once it failed max failures times in a row. The failures
+// older than the lockout duration and the expired lockouts are forgotten from time to time, any username can fail.
+func (l *loginLockout) fail(username string, now time.Time) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.swept) > l.duration {
+		for name, failures := range l.failures {
+			if now.Sub(failures.last) > l.duration {
+				delete(l.failures, name)
+			}
+		}
+		for name, until := range l.lockedUntil {
+			if !now.Before(until) {
+				delete(l.lockedUntil, name)
+			}
+		}
+		l.swept = now
+	}
+	failures := l.failures[username]
+	failures.count++
+	failures.last = now
+	l.failures[username] = failures
+	if failures.count >= l.maxFailures {
+		delete(l.failures, username)
+		l.lockedUntil[username] = now.Add(l.duration)
+	}
+}
+
+func (l *loginLockout) reset(username string) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.failures, username)
+}
+
+// clientIP is the address the request comes from, proxies are not trusted.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// limit takes a token of the class for the client address, and for the authenticated user if any, so neither many
+// addresses sharing an account nor many accounts sharing an address escape the limit. It must be wrapped by the
+// authentication middleware, if any.
+func (api api) limit(class string, next http.HandlerFunc) http.HandlerFunc {
+	limiter := api.limiters[class]
+	if limiter == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		keys := []string{"ip:" + clientIP(r)}
+		if userID, err := mustUserID(r); err == nil {
+			keys = append(keys, "user:"+strconv.Itoa(userID))
+		}
+		remaining, wait := limiter.take(time.Now(), keys...)
+		w.Header().Set(rateLimitHeader, strconv.Itoa(limiter.burst))
+		w.Header().Set(rateLimitRemainingHeader, strconv.Itoa(remaining))
+		if wait > 0 {
+			rateLimited.WithLabelValues(class).Inc()
+			tooManyRequests(w, ErrRateLimited, wait)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+}
+
+// authBlocked answers 429 when the client address failed to authenticate too often.
+func (api api) authBlocked(w http.ResponseWriter, r *http.Request) bool {
+	wait := api.limiters[classAuthFailures].wait("ip:"+clientIP(r), time.Now())
+	if wait == 0 {
+		return false
+	}
+	rateLimited.WithLabelValues(classAuthFailures).Inc()
+	tooManyRequests(w, ErrRateLimited, wait)
+	return true
+}
+
+// authFailed counts a failed authentication against the client address.
+func (api api) authFailed(r *http.Request) {
+	api.limiters[classAuthFailures].take(time.Now(), "ip:"+clientIP(r))
+}
+
+// tooManyRequests answers 429, the client may retry after wait.
+func tooManyRequests(w http.ResponseWriter, err error, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	RespondWithError(w, http.StatusTooManyRequests, err)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(bucketConfig{Rate: 2, Burst: 3})
+	now := time.Now()
+	type step struct {
+		after     time.Duration
+		keys      []string
+		remaining int
+		wait      time.Duration
+	}
+	steps := []step{
+		{keys: []string{"a"}, remaining: 2},
+		{keys: []string{"a"}, remaining: 1},
+		{keys: []string{"a"}, remaining: 0},
+		{keys: []string{"a"}, wait: 500 * time.Millisecond},
+		{keys: []string{"b"}, remaining: 2},
+		// every bucket must hold a token, none is taken otherwise
+		{keys: []string{"b", "a"}, wait: 500 * time.Millisecond},
+		{keys: []string{"b", "c"}, remaining: 1},
+		{after: 250 * time.Millisecond, keys: []string{"a"}, wait: 250 * time.Millisecond},
+		{after: 250 * time.Millisecond, keys: []string{"a"}, remaining: 0},
+		{after: time.Hour, keys: []string{"a"}, remaining: 2},
+	}
+	for i, s := range steps {
+		now = now.Add(s.after)
+		remaining, wait := l.take(now, s.keys...)
+		if remaining != s.remaining || wait != s.wait {
+			t.Errorf("step %d: got %v, %v want %v, %v", i, remaining, wait, s.remaining, s.wait)
+		}
+	}
+	if got, want := len(l.buckets), 1; got != want {
+		t.Errorf("got %v buckets want %v", got, want)
+	}
+
+	var disabled *rateLimiter
+	if _, wait := disabled.take(now, "a"); wait != 0 {
+		t.Errorf("got %v want 0", wait)
+	}
+}
+
+func TestLoginLockout(t *testing.T) {
+	l := newLoginLockout(lockoutConfig{MaxFailures: 3, Duration: duration(time.Minute)})
+	now := time.Now()
+
+	l.fail("alice", now)
+	l.fail("alice", now)
+	l.reset("alice")
+	l.fail("alice", now)
+	l.fail("alice", now)
+	if got := l.lockedFor("alice", now); got != 0 {
+		t.Errorf("got %v want 0", got)
+	}
+	l.fail("alice", now)
+	if got, want := l.lockedFor("alice", now.Add(time.Second)), 59*time.Second; got != want {
+		t.Errorf("got %v want %v", got, want)
+	}
+	if got := l.lockedFor("bob", now); got != 0 {
+		t.Errorf("got %v want 0", got)
+	}
+	if got := l.lockedFor("alice", now.Add(time.Minute)); got != 0 {
+		t.Errorf("got %v want 0", got)
+	}
+
+	// the failures of any username are forgotten once older than the lockout
+	l.fail("nobody", now)
+	l.fail("carol", now.Add(2*time.Minute))
+	if _, ok := l.failures["nobody"]; ok {
+		t.Errorf("stale failures kept")
+	}
+}
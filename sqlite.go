@@ -0,0 +1,778 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	sqlite3 "modernc.org/sqlite"
+	sqlitelib "modernc.org/sqlite/lib"
+)
+
+// sqlite stores everything in a single file, for the environments without a postgres server.
+// Times are stored as unix microseconds so they sort and round trip like postgres timestamps.
+type sqlite struct {
+	db *sql.DB
+}
+
+func newSQLite(path string) (*sqlite, error) {
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		return nil, fmt.Errorf("cannot open database: %w", err)
+	}
+	// sqlite has a single writer, one connection serializes the transactions instead of failing them as busy
+	db.SetMaxOpenConns(1)
+	return &sqlite{
+		db: db,
+	}, nil
+}
+
+func toMicros(t time.Time) int64 {
+	return t.UnixMicro()
+}
+
+func fromMicros(n int64) time.Time {
+	return time.UnixMicro(n)
+}
+
+func (db sqlite) User(ctx context.Context, username string) (user User, err error) {
+	defer observeQuery(ctx, "User")()
+	err = db.db.QueryRowContext(ctx, "select id, username, password, role, disabled from users where username=?", username).
+		Scan(&user.id, &user.Username, &user.password, &user.Role, &user.Disabled)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return User{}, ErrNotFound
+		}
+		return User{}, fmt.Errorf("cannot get user: %w", err)
+	}
+	return
+}
+
+func (db sqlite) UserByID(ctx context.Context, id int) (user User, err error) {
+	defer observeQuery(ctx, "UserByID")()
+	err = db.db.QueryRowContext(ctx, "select id, username, password, role, disabled from users where id=?", id).
+		Scan(&user.id, &user.Username, &user.password, &user.Role, &user.Disabled)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return User{}, ErrNotFound
+		}
+		return User{}, fmt.Errorf("cannot get user: %w", err)
+	}
+	return
+}
+
+func (db sqlite) SaveUser(ctx context.Context, username string, password []byte, assets ...Asset) (int, error) {
+	defer observeQuery(ctx, "SaveUser")()
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return -1, fmt.Errorf("cannot save user: %w", err)
+	}
+	defer tx.Rollback()
+
+	id := -1
+	err = tx.QueryRowContext(ctx, `insert into users(username, password) values (?, ?) returning id`, username, password).Scan(&id)
+	if err != nil {
+		if isSQLiteUniqueViolation(err) {
+			return -1, ErrUserExists
+		}
+		return -1, fmt.Errorf("cannot save user: %w", err)
+	}
+	for _, asset := range assets {
+		_, err := tx.ExecContext(ctx, `insert into assets(userid, asset_type, balance) values (?, ?, ?)`, id, asset.Asset, asset.Amount)
+		if err != nil {
+			if isSQLiteUniqueViolation(err) {
+				return -1, ErrAssetExists
+			}
+			return -1, fmt.Errorf("cannot save asset: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return -1, fmt.Errorf("cannot save user: %w", err)
+	}
+	return id, nil
+}
+
+func (db sqlite) UpdatePassword(ctx context.Context, userID int, password []byte) error {
+	defer observeQuery(ctx, "UpdatePassword")()
+	return db.updateUser(ctx, "update users set password = ? where id=?", password, userID)
+}
+
+func (db sqlite) SetUserRole(ctx context.Context, userID int, role string) error {
+	defer observeQuery(ctx, "SetUserRole")()
+	return db.updateUser(ctx, "update users set role = ? where id=?", role, userID)
+}
+
+func (db sqlite) SetUserDisabled(ctx context.Context, userID int, disabled bool) error {
+	defer observeQuery(ctx, "SetUserDisabled")()
+	return db.updateUser(ctx, "update users set disabled = ? where id=?", disabled, userID)
+}
+
+func (db sqlite) SetUserDisabledAudited(ctx context.Context, userID int, disabled bool, entry *AuditEntry) error {
+	defer observeQuery(ctx, "SetUserDisabledAudited")()
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("cannot update user: %w", err)
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, "update users set disabled = ? where id=?", disabled, userID)
+	if err != nil {
+		return fmt.Errorf("cannot update user: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	if err := db.saveAudit(ctx, tx, entry); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("cannot update user: %w", err)
+	}
+	return nil
+}
+
+func (db sqlite) Users(ctx context.Context) (users []User, err error) {
+	defer observeQuery(ctx, "Users")()
+	rows, err := db.db.QueryContext(ctx, "select id, username, role, disabled from users order by id")
+	if err != nil {
+		return nil, fmt.Errorf("cannot get users: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var user User
+		if err := rows.Scan(&user.id, &user.Username, &user.Role, &user.Disabled); err != nil {
+			return nil, fmt.Errorf("cannot read user: %w", err)
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+func (db sqlite) updateUser(ctx context.Context, query string, args ...any) error {
+	res, err := db.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return fmt.Errorf("cannot update user: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (db sqlite) Assets(ctx context.Context, userID int) (assets []Asset, err error) {
+	defer observeQuery(ctx, "Assets")()
+	rows, err := db.db.QueryContext(ctx, "select id, asset_type, balance from assets where userid=? order by id", userID)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get assets: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		asset := Asset{userID: userID}
+		if err := rows.Scan(&asset.id, &asset.Asset, &asset.Amount); err != nil {
+			return nil, fmt.Errorf("cannot read assets: %w", err)
+		}
+		assets = append(assets, asset)
+	}
+	return assets, rows.Err()
+}
+
+func (db sqlite) SaveAsset(ctx context.Context, asset Asset) error {
+	defer observeQuery(ctx, "SaveAsset")()
+	_, err := db.db.ExecContext(ctx, `insert into assets(userid, asset_type, balance) values (?, ?, ?)`, asset.userID, asset.Asset, asset.Amount)
+	if err != nil {
+		if isSQLiteUniqueViolation(err) {
+			return ErrAssetExists
+		}
+		return fmt.Errorf("cannot save asset: %w", err)
+	}
+	return nil
+}
+
+func (db sqlite) AdjustAsset(ctx context.Context, userID int, assetType string, delta float64) (Asset, error) {
+	defer observeQuery(ctx, "AdjustAsset")()
+	return db.adjustAsset(ctx, userID, assetType, delta, nil)
+}
+
+func (db sqlite) AdjustAssetAudited(ctx context.Context, userID int, assetType string, delta float64, entry *AuditEntry) (Asset, error) {
+	defer observeQuery(ctx, "AdjustAssetAudited")()
+	return db.adjustAsset(ctx, userID, assetType, delta, entry)
+}
+
+func (db sqlite) adjustAsset(ctx context.Context, userID int, assetType string, delta float64, entry *AuditEntry) (Asset, error) {
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return Asset{}, fmt.Errorf("cannot adjust asset: %w", err)
+	}
+	defer tx.Rollback()
+
+	asset := Asset{userID: userID, Asset: assetType}
+	err = tx.QueryRowContext(ctx, "select id, balance from assets where userid=? and asset_type=?", userID, assetType).Scan(&asset.id, &asset.Amount)
+	exist := err == nil
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return Asset{}, fmt.Errorf("cannot get asset: %w", err)
+	}
+	if asset.Amount+delta < 0 {
+		return Asset{}, ErrInsufficientFunds
+	}
+	asset.Amount += delta
+	if exist {
+		_, err = tx.ExecContext(ctx, "update assets set balance = ? where id=?", asset.Amount, asset.id)
+	} else {
+		err = tx.QueryRowContext(ctx, "insert into assets(userid, asset_type, balance) values (?, ?, ?) returning id", userID, assetType, asset.Amount).Scan(&asset.id)
+	}
+	if err != nil {
+		return Asset{}, fmt.Errorf("cannot adjust asset: %w", err)
+	}
+	if err := db.saveAudit(ctx, tx, entry); err != nil {
+		return Asset{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return Asset{}, fmt.Errorf("cannot adjust asset: %w", err)
+	}
+	return asset, nil
+}
+
+func (db sqlite) SaveOrder(ctx context.Context, order *Order) error {
+	defer observeQuery(ctx, "SaveOrder")()
+	order.Status = statusPending
+	order.CreatedAt = time.Now().Truncate(time.Microsecond)
+	err := db.db.QueryRowContext(ctx,
+		`insert into orders(userid, client_order_id, side, asset_pair, amount, price, status, created_at) values (?, nullif(?, ''), ?, ?, ?, ?, ?, ?) returning id`,
+		order.userID, order.ClientOrderID, order.Side, order.AssetPair, order.Amount, order.Price, order.Status, toMicros(order.CreatedAt),
+	).Scan(&order.ID)
+	if err != nil {
+		if isSQLiteUniqueViolation(err) {
+			return ErrDuplicateClientOrderID
+		}
+		return fmt.Errorf("cannot save order: %w", err)
+	}
+	return nil
+}
+
+func scanSQLiteOrder(row interface{ Scan(...any) error }) (order Order, err error) {
+	var createdAt int64
+	err = row.Scan(&order.ID, &order.ClientOrderID, &order.userID, &order.Side, &order.AssetPair, &order.Amount, &order.Price, &order.Status, &createdAt)
+	order.CreatedAt = fromMicros(createdAt)
+	return
+}
+
+func (db sqlite) Order(ctx context.Context, id int) (Order, error) {
+	defer observeQuery(ctx, "Order")()
+	order, err := scanSQLiteOrder(db.db.QueryRowContext(ctx, "select "+orderColumns+" from orders where id=?", id))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Order{}, ErrNotFound
+		}
+		return Order{}, fmt.Errorf("cannot get order: %w", err)
+	}
+	return order, nil
+}
+
+func (db sqlite) OrderByClientID(ctx context.Context, userID int, clientOrderID string) (Order, error) {
+	defer observeQuery(ctx, "OrderByClientID")()
+	order, err := scanSQLiteOrder(db.db.QueryRowContext(ctx, "select "+orderColumns+" from orders where userid=? and client_order_id=?", userID, clientOrderID))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Order{}, ErrNotFound
+		}
+		return Order{}, fmt.Errorf("cannot get order: %w", err)
+	}
+	return order, nil
+}
+
+func (db sqlite) CancelOrder(ctx context.Context, id int) error {
+	defer observeQuery(ctx, "CancelOrder")()
+	res, err := db.db.ExecContext(ctx, "update orders set status = ? where id=? and status=?", statusCancelled, id, statusPending)
+	if err != nil {
+		return fmt.Errorf("cannot cancel order: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		if _, err := db.Order(ctx, id); err != nil {
+			return err
+		}
+		return ErrOrderNotPending
+	}
+	return nil
+}
+
+func (db sqlite) CancelOrderAudited(ctx context.Context, id int, entry *AuditEntry) error {
+	defer observeQuery(ctx, "CancelOrderAudited")()
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("cannot cancel order: %w", err)
+	}
+	defer tx.Rollback()
+
+	var status string
+	err = tx.QueryRowContext(ctx, "select status from orders where id=?", id).Scan(&status)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNotFound
+		}
+		return fmt.Errorf("cannot get order: %w", err)
+	}
+	if status != statusPending {
+		return ErrOrderNotPending
+	}
+	if _, err := tx.ExecContext(ctx, "update orders set status = ? where id=?", statusCancelled, id); err != nil {
+		return fmt.Errorf("cannot cancel order: %w", err)
+	}
+	if err := db.saveAudit(ctx, tx, entry); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("cannot cancel order: %w", err)
+	}
+	return nil
+}
+
+func (db sqlite) UserOrders(ctx context.Context, userID int, filter OrderFilter) ([]Order, error) {
+	defer observeQuery(ctx, "UserOrders")()
+	query := "select " + orderColumns + " from orders where userid=?"
+	args := []any{userID}
+	where := func(condition string, values ...any) {
+		args = append(args, values...)
+		query += " and " + condition
+	}
+	if filter.Status != "" {
+		where("status=?", filter.Status)
+	}
+	if filter.Pair != "" {
+		where("asset_pair=?", filter.Pair)
+	}
+	if filter.Side != "" {
+		where("side=?", filter.Side)
+	}
+	if !filter.From.IsZero() {
+		where("created_at >= ?", toMicros(filter.From))
+	}
+	if !filter.To.IsZero() {
+		where("created_at < ?", toMicros(filter.To))
+	}
+	if filter.After != nil {
+		where("(created_at, id) > (?, ?)", toMicros(filter.After.CreatedAt), filter.After.ID)
+	}
+	query += " order by created_at, id"
+	if filter.Limit > 0 {
+		query += " limit ?"
+		args = append(args, filter.Limit)
+	}
+	return db.queryOrders(ctx, query, args...)
+}
+
+func (db sqlite) PendingOrders(ctx context.Context, pair string) ([]Order, error) {
+	defer observeQuery(ctx, "PendingOrders")()
+	return db.queryOrders(ctx, "select "+orderColumns+" from orders where status=? and asset_pair=? order by id", statusPending, pair)
+}
+
+func (db sqlite) queryOrders(ctx context.Context, query string, args ...any) (orders []Order, err error) {
+	rows, err := db.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get order: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		order, err := scanSQLiteOrder(rows)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read order: %w", err)
+		}
+		orders = append(orders, order)
+	}
+	return orders, rows.Err()
+}
+
+func (db sqlite) FillOrders(ctx context.Context, fills ...Fill) error {
+	defer observeQuery(ctx, "FillOrders")()
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("cannot fill order: %w", err)
+	}
+	defer tx.Rollback()
+
+	for _, fill := range fills {
+		res, err := tx.ExecContext(ctx, "update orders set status = ? where id=? and status=?", statusFilled, fill.Order.ID, statusPending)
+		if err != nil {
+			return fmt.Errorf("cannot fill order: %w", err)
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			var exists bool
+			if err := tx.QueryRowContext(ctx, "select exists(select 1 from orders where id=?)", fill.Order.ID).Scan(&exists); err != nil {
+				return fmt.Errorf("cannot fill order: %w", err)
+			}
+			if !exists {
+				return ErrNotFound
+			}
+			return ErrOrderNotPending
+		}
+	}
+	for _, change := range settlements(fills) {
+		_, err := tx.ExecContext(ctx, `insert into assets(userid, asset_type, balance) values (?, ?, ?)
+			on conflict (userid, asset_type) do update set balance = assets.balance + excluded.balance`, change.userID, change.asset, change.delta)
+		if err != nil {
+			return fmt.Errorf("cannot settle order: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("cannot fill order: %w", err)
+	}
+	return nil
+}
+
+func (db sqlite) SaveAPIKey(ctx context.Context, key *APIKey) error {
+	defer observeQuery(ctx, "SaveAPIKey")()
+	err := db.db.QueryRowContext(ctx, `insert into api_keys(userid, key, secret, scopes, created_at) values (?, ?, ?, ?, ?) returning id`,
+		key.userID, key.Key, key.Secret, strings.Join(key.Scopes, ","), toMicros(key.CreatedAt),
+	).Scan(&key.id)
+	if err != nil {
+		if isSQLiteUniqueViolation(err) {
+			return ErrAPIKeyExists
+		}
+		return fmt.Errorf("cannot save api key: %w", err)
+	}
+	return nil
+}
+
+func scanSQLiteAPIKey(row interface{ Scan(...any) error }) (key APIKey, err error) {
+	var scopes string
+	var createdAt int64
+	if err := row.Scan(&key.id, &key.userID, &key.Key, &key.Secret, &scopes, &key.Revoked, &createdAt); err != nil {
+		return APIKey{}, err
+	}
+	key.Scopes = []string{}
+	if scopes != "" {
+		key.Scopes = strings.Split(scopes, ",")
+	}
+	key.CreatedAt = fromMicros(createdAt)
+	return key, nil
+}
+
+func (db sqlite) APIKey(ctx context.Context, key string) (APIKey, error) {
+	defer observeQuery(ctx, "APIKey")()
+	apiKey, err := scanSQLiteAPIKey(db.db.QueryRowContext(ctx, "select id, userid, key, secret, scopes, revoked, created_at from api_keys where key=?", key))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return APIKey{}, ErrNotFound
+		}
+		return APIKey{}, fmt.Errorf("cannot get api key: %w", err)
+	}
+	return apiKey, nil
+}
+
+func (db sqlite) UserAPIKeys(ctx context.Context, userID int) (keys []APIKey, err error) {
+	defer observeQuery(ctx, "UserAPIKeys")()
+	rows, err := db.db.QueryContext(ctx, "select id, userid, key, secret, scopes, revoked, created_at from api_keys where userid=? order by id", userID)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get api keys: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		key, err := scanSQLiteAPIKey(rows)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read api key: %w", err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+func (db sqlite) RevokeAPIKey(ctx context.Context, userID int, key string) error {
+	defer observeQuery(ctx, "RevokeAPIKey")()
+	res, err := db.db.ExecContext(ctx, "update api_keys set revoked = true where key=? and userid=?", key, userID)
+	if err != nil {
+		return fmt.Errorf("cannot revoke api key: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (db sqlite) SaveTrade(ctx context.Context, e *Execution) error {
+	defer observeQuery(ctx, "SaveTrade")()
+	err := db.db.QueryRowContext(ctx, `insert into trades(asset_pair, price, amount, executed_at) values (?, ?, ?, ?) returning id`,
+		e.Pair, e.Price, e.Amount, toMicros(e.Time),
+	).Scan(&e.id)
+	if err != nil {
+		return fmt.Errorf("cannot save trade: %w", err)
+	}
+	return nil
+}
+
+func (db sqlite) Trades(ctx context.Context, pair string, from, to time.Time) (trades []Execution, err error) {
+	defer observeQuery(ctx, "Trades")()
+	rows, err := db.db.QueryContext(ctx, "select id, asset_pair, price, amount, executed_at from trades where asset_pair=? and executed_at >= ? and executed_at < ? order by executed_at, id",
+		pair, toMicros(from), toMicros(to))
+	if err != nil {
+		return nil, fmt.Errorf("cannot get trades: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var trade Execution
+		var executedAt int64
+		if err := rows.Scan(&trade.id, &trade.Pair, &trade.Price, &trade.Amount, &executedAt); err != nil {
+			return nil, fmt.Errorf("cannot read trade: %w", err)
+		}
+		trade.Time = fromMicros(executedAt)
+		trades = append(trades, trade)
+	}
+	return trades, rows.Err()
+}
+
+func (db sqlite) RecordTrade(ctx context.Context, e *Execution, candles map[string]Candle) error {
+	defer observeQuery(ctx, "RecordTrade")()
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("cannot record trade: %w", err)
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(ctx, `insert into trades(asset_pair, price, amount, executed_at) values (?, ?, ?, ?) returning id`,
+		e.Pair, e.Price, e.Amount, toMicros(e.Time),
+	).Scan(&e.id)
+	if err != nil {
+		return fmt.Errorf("cannot save trade: %w", err)
+	}
+	for interval, c := range candles {
+		_, err := tx.ExecContext(ctx, `insert into candles(asset_pair, period, start, open, high, low, close, base_volume, quote_volume, opened_at, closed_at)
+			values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+			on conflict (asset_pair, period, start) do update set
+				open = case when excluded.opened_at < candles.opened_at then excluded.open else candles.open end,
+				high = max(candles.high, excluded.high),
+				low = min(candles.low, excluded.low),
+				close = case when excluded.closed_at >= candles.closed_at then excluded.close else candles.close end,
+				base_volume = candles.base_volume + excluded.base_volume,
+				quote_volume = candles.quote_volume + excluded.quote_volume,
+				opened_at = min(candles.opened_at, excluded.opened_at),
+				closed_at = max(candles.closed_at, excluded.closed_at)`,
+			e.Pair, interval, toMicros(c.Start), c.Open, c.High, c.Low, c.Close, c.BaseVolume, c.QuoteVolume, toMicros(c.openedAt), toMicros(c.closedAt))
+		if err != nil {
+			return fmt.Errorf("cannot merge candle: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("cannot record trade: %w", err)
+	}
+	return nil
+}
+
+func (db sqlite) SaveCandles(ctx context.Context, pair, interval string, candles []Candle) error {
+	defer observeQuery(ctx, "SaveCandles")()
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("cannot save candles: %w", err)
+	}
+	defer tx.Rollback()
+	for _, c := range candles {
+		_, err := tx.ExecContext(ctx, `insert into candles(asset_pair, period, start, open, high, low, close, base_volume, quote_volume, opened_at, closed_at)
+			values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+			on conflict (asset_pair, period, start) do update set
+				open = excluded.open,
+				high = excluded.high,
+				low = excluded.low,
+				close = excluded.close,
+				base_volume = excluded.base_volume,
+				quote_volume = excluded.quote_volume,
+				opened_at = excluded.opened_at,
+				closed_at = excluded.closed_at`,
+			pair, interval, toMicros(c.Start), c.Open, c.High, c.Low, c.Close, c.BaseVolume, c.QuoteVolume, toMicros(c.openedAt), toMicros(c.closedAt))
+		if err != nil {
+			return fmt.Errorf("cannot save candle: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("cannot save candles: %w", err)
+	}
+	return nil
+}
+
+func (db sqlite) Candles(ctx context.Context, pair, interval string, from, to time.Time) (candles []Candle, err error) {
+	defer observeQuery(ctx, "Candles")()
+	rows, err := db.db.QueryContext(ctx, "select start, open, high, low, close, base_volume, quote_volume from candles where asset_pair=? and period=? and start >= ? and start < ? order by start",
+		pair, interval, toMicros(from), toMicros(to))
+	if err != nil {
+		return nil, fmt.Errorf("cannot get candles: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var c Candle
+		var start int64
+		if err := rows.Scan(&start, &c.Open, &c.High, &c.Low, &c.Close, &c.BaseVolume, &c.QuoteVolume); err != nil {
+			return nil, fmt.Errorf("cannot read candle: %w", err)
+		}
+		c.Start = fromMicros(start)
+		candles = append(candles, c)
+	}
+	return candles, rows.Err()
+}
+
+func (db sqlite) SaveIdempotencyRecord(ctx context.Context, record IdempotencyRecord, expiredBefore, abandonedBefore time.Time) error {
+	defer observeQuery(ctx, "SaveIdempotencyRecord")()
+	res, err := db.db.ExecContext(ctx, `insert into idempotency_keys(userid, key, request_hash, created_at) values (?, ?, ?, ?)
+		on conflict (userid, key) do update set request_hash = excluded.request_hash, status = 0, content_type = '', response = null, created_at = excluded.created_at
+		where idempotency_keys.created_at < ? or (idempotency_keys.status = 0 and idempotency_keys.created_at < ?)`,
+		record.UserID, record.Key, record.RequestHash, toMicros(record.CreatedAt), toMicros(expiredBefore), toMicros(abandonedBefore))
+	if err != nil {
+		return fmt.Errorf("cannot save idempotency key: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrIdempotencyKeyExists
+	}
+	return nil
+}
+
+func (db sqlite) IdempotencyRecord(ctx context.Context, userID int, key string) (record IdempotencyRecord, err error) {
+	defer observeQuery(ctx, "IdempotencyRecord")()
+	var createdAt int64
+	err = db.db.QueryRowContext(ctx, "select userid, key, request_hash, status, content_type, response, created_at from idempotency_keys where userid=? and key=?", userID, key).
+		Scan(&record.UserID, &record.Key, &record.RequestHash, &record.Status, &record.ContentType, &record.Response, &createdAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return IdempotencyRecord{}, ErrNotFound
+		}
+		return IdempotencyRecord{}, fmt.Errorf("cannot get idempotency key: %w", err)
+	}
+	record.CreatedAt = fromMicros(createdAt)
+	return
+}
+
+func (db sqlite) CompleteIdempotencyRecord(ctx context.Context, record IdempotencyRecord) error {
+	defer observeQuery(ctx, "CompleteIdempotencyRecord")()
+	res, err := db.db.ExecContext(ctx, "update idempotency_keys set status = ?, content_type = ?, response = ? where userid=? and key=?",
+		record.Status, record.ContentType, record.Response, record.UserID, record.Key)
+	if err != nil {
+		return fmt.Errorf("cannot save idempotent response: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (db sqlite) DeleteIdempotencyRecord(ctx context.Context, userID int, key string) error {
+	defer observeQuery(ctx, "DeleteIdempotencyRecord")()
+	if _, err := db.db.ExecContext(ctx, "delete from idempotency_keys where userid=? and key=?", userID, key); err != nil {
+		return fmt.Errorf("cannot delete idempotency key: %w", err)
+	}
+	return nil
+}
+
+func (db sqlite) DeleteIdempotencyRecords(ctx context.Context, createdBefore time.Time) (int64, error) {
+	defer observeQuery(ctx, "DeleteIdempotencyRecords")()
+	res, err := db.db.ExecContext(ctx, "delete from idempotency_keys where created_at < ?", toMicros(createdBefore))
+	if err != nil {
+		return 0, fmt.Errorf("cannot delete idempotency keys: %w", err)
+	}
+	return res.RowsAffected()
+}
+
+func (db sqlite) SaveAudit(ctx context.Context, entry *AuditEntry) error {
+	defer observeQuery(ctx, "SaveAudit")()
+	return db.saveAudit(ctx, db.db, entry)
+}
+
+// sqlQuerier is implemented by the database and the transactions.
+type sqlQuerier interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// saveAudit saves the entry with q, the transaction of the audited action, a nil entry records nothing.
+func (db sqlite) saveAudit(ctx context.Context, q sqlQuerier, entry *AuditEntry) error {
+	if entry == nil {
+		return nil
+	}
+	err := q.QueryRowContext(ctx, `insert into audit_log(admin_id, action, target, details, created_at) values (?, ?, ?, ?, ?) returning id`,
+		entry.AdminID, entry.Action, entry.Target, entry.Details, toMicros(entry.CreatedAt),
+	).Scan(&entry.id)
+	if err != nil {
+		return fmt.Errorf("cannot save audit entry: %w", err)
+	}
+	return nil
+}
+
+func (db sqlite) AuditLog(ctx context.Context, limit int) (entries []AuditEntry, err error) {
+	defer observeQuery(ctx, "AuditLog")()
+	rows, err := db.db.QueryContext(ctx, "select id, admin_id, action, target, details, created_at from audit_log order by id desc limit ?", limit)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get audit log: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var entry AuditEntry
+		var createdAt int64
+		if err := rows.Scan(&entry.id, &entry.AdminID, &entry.Action, &entry.Target, &entry.Details, &createdAt); err != nil {
+			return nil, fmt.Errorf("cannot read audit entry: %w", err)
+		}
+		entry.CreatedAt = fromMicros(createdAt)
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+func (db sqlite) SavePairState(ctx context.Context, pair, state string, entry *AuditEntry) error {
+	defer observeQuery(ctx, "SavePairState")()
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("cannot save pair state: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx,
+		`insert into pair_states(asset_pair, state, updated_at) values (?, ?, ?)
+		on conflict (asset_pair) do update set state = excluded.state, updated_at = excluded.updated_at`, pair, state, toMicros(time.Now()))
+	if err != nil {
+		return fmt.Errorf("cannot save pair state: %w", err)
+	}
+	if state == pairClosed {
+		_, err := tx.ExecContext(ctx, "update orders set status = ? where asset_pair=? and status=?", statusCancelled, pair, statusPending)
+		if err != nil {
+			return fmt.Errorf("cannot cancel orders: %w", err)
+		}
+	}
+	if err := db.saveAudit(ctx, tx, entry); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("cannot save pair state: %w", err)
+	}
+	return nil
+}
+
+func (db sqlite) PairStates(ctx context.Context) (map[string]string, error) {
+	defer observeQuery(ctx, "PairStates")()
+	rows, err := db.db.QueryContext(ctx, "select asset_pair, state from pair_states")
+	if err != nil {
+		return nil, fmt.Errorf("cannot get pair states: %w", err)
+	}
+	defer rows.Close()
+	states := make(map[string]string)
+	for rows.Next() {
+		var pair, state string
+		if err := rows.Scan(&pair, &state); err != nil {
+			return nil, fmt.Errorf("cannot read pair state: %w", err)
+		}
+		states[pair] = state
+	}
+	return states, rows.Err()
+}
+
+func (db sqlite) Ping(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, pingTimeout)
+	defer cancel()
+	if err := db.db.PingContext(ctx); err != nil {
+		return fmt.Errorf("cannot reach database: %w", err)
+	}
+	return nil
+}
+
+func (db sqlite) Close() {
+	db.db.Close()
+}
+
+func isSQLiteUniqueViolation(err error) bool {
+	var sqliteErr *sqlite3.Error
+	return errors.As(err, &sqliteErr) &&
+		(sqliteErr.Code() == sqlitelib.SQLITE_CONSTRAINT_UNIQUE || sqliteErr.Code() == sqlitelib.SQLITE_CONSTRAINT_PRIMARYKEY)
+}
@@ -4,18 +4,43 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
-	"strings"
+	"sort"
+	"sync"
+	"time"
 )
 
 var ErrNotFound = errors.New("no long url associated to this short url")
-var errNoRowsMsg = "no rows in result set" // can't use sql.ErrNoRows because it has a prefix "sql:" which is absent somehow
+var ErrUserExists = errors.New("username already taken")
+var ErrOrderNotPending = errors.New("order is not pending")
+var ErrDuplicateClientOrderID = errors.New("client order id already used")
+var ErrAssetExists = errors.New("asset already exists")
+var ErrAPIKeyExists = errors.New("api key already exists")
+
+const uniqueViolation = "23505"
+const pingTimeout = 2 * time.Second
+
+const (
+	statusPending   = "pending"
+	statusFilled    = "filled"
+	statusCancelled = "cancelled"
+)
 
 const (
-	statusPending = "pending"
-	statusFilled  = "filled"
+	roleUser  = "user"
+	roleAdmin = "admin"
 )
 
+type User struct {
+	id       int
+	password []byte
+	Username string `json:"username"`
+	Role     string `json:"role"`
+	Disabled bool   `json:"disabled"`
+}
+
 type Asset struct {
 	id     int
 	userID int
@@ -24,63 +49,280 @@ type Asset struct {
 }
 
 type Order struct {
-	id        int
-	userID    int
-	Side      string  `json:"side"`
-	AssetPair string  `json:"asset_pair"`
-	Amount    float64 `json:"amount"`
-	Price     float64 `json:"price"`
-	Status    string  `json:"status"`
+	ID            int    `json:"id"`
+	ClientOrderID string `json:"client_order_id,omitempty"`
+	userID        int
+	Side          string    `json:"side"`
+	AssetPair     string    `json:"asset_pair"`
+	Amount        float64   `json:"amount"`
+	Price         float64   `json:"price"`
+	Status        string    `json:"status"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// Fill is a matched order to settle, FeePercent of the received amount is kept as fees.
+type Fill struct {
+	Order      Order
+	FeePercent float64
 }
 
 type store interface {
-	SaveUser(username string, password []byte) (int, error)
-	User(username string) (id int, password []byte, err error)
-	SaveAsset(asset Asset) error
-	Assets(userID int) (assets []Asset, err error)
-	SaveOrder(order *Order) error
-	UserOrders(userID int) ([]Order, error)
-	PendingOrders(pair string) ([]Order, error)
-	FillOrder(order Order) error
+	// SaveUser creates the user with its initial balances, all or nothing.
+	SaveUser(ctx context.Context, username string, password []byte, assets ...Asset) (int, error)
+	User(ctx context.Context, username string) (User, error)
+	UserByID(ctx context.Context, id int) (User, error)
+	UpdatePassword(ctx context.Context, userID int, password []byte) error
+	SetUserRole(ctx context.Context, userID int, role string) error
+	SetUserDisabled(ctx context.Context, userID int, disabled bool) error
+	// SetUserDisabledAudited is SetUserDisabled saving entry in the same transaction.
+	SetUserDisabledAudited(ctx context.Context, userID int, disabled bool, entry *AuditEntry) error
+	Users(ctx context.Context) ([]User, error)
+	// SaveAsset creates a balance, it returns ErrAssetExists when the user already has one for this asset.
+	SaveAsset(ctx context.Context, asset Asset) error
+	// Assets returns the balances of the user by creation.
+	Assets(ctx context.Context, userID int) (assets []Asset, err error)
+	// AdjustAsset credits, or debits for a negative delta, the balance of an asset.
+	AdjustAsset(ctx context.Context, userID int, asset string, delta float64) (Asset, error)
+	// AdjustAssetAudited is AdjustAsset saving entry in the same transaction.
+	AdjustAssetAudited(ctx context.Context, userID int, asset string, delta float64, entry *AuditEntry) (Asset, error)
+	SaveOrder(ctx context.Context, order *Order) error
+	Order(ctx context.Context, id int) (Order, error)
+	OrderByClientID(ctx context.Context, userID int, clientOrderID string) (Order, error)
+	UserOrders(ctx context.Context, userID int, filter OrderFilter) ([]Order, error)
+	// PendingOrders returns the pending orders of the pair in the order they were placed.
+	PendingOrders(ctx context.Context, pair string) ([]Order, error)
+	// FillOrders marks the pending orders filled and settles them at their price in one transaction, e.g. both sides of
+	// a match. The received balances are created when missing, it settles nothing and returns ErrOrderNotPending when an
+	// order isn't pending.
+	FillOrders(ctx context.Context, fills ...Fill) error
+	CancelOrder(ctx context.Context, id int) error
+	// CancelOrderAudited is CancelOrder saving entry in the same transaction.
+	CancelOrderAudited(ctx context.Context, id int, entry *AuditEntry) error
+	SaveTrade(ctx context.Context, e *Execution) error
+	// Trades returns the trades executed in [from, to) by execution time.
+	Trades(ctx context.Context, pair string, from, to time.Time) ([]Execution, error)
+	// RecordTrade saves the trade and rolls the candles, by interval, into the stored candles starting at the same
+	// time, or creates them, in one transaction.
+	RecordTrade(ctx context.Context, e *Execution, candles map[string]Candle) error
+	// SaveCandles creates or replaces the candles.
+	SaveCandles(ctx context.Context, pair, interval string, candles []Candle) error
+	// Candles returns the candles starting in [from, to) by start time.
+	Candles(ctx context.Context, pair, interval string, from, to time.Time) ([]Candle, error)
+	// SaveIdempotencyRecord reserves the key, replacing a record created before expiredBefore, or still in progress
+	// and created before abandonedBefore. It returns ErrIdempotencyKeyExists when the key is already reserved.
+	SaveIdempotencyRecord(ctx context.Context, record IdempotencyRecord, expiredBefore, abandonedBefore time.Time) error
+	IdempotencyRecord(ctx context.Context, userID int, key string) (IdempotencyRecord, error)
+	CompleteIdempotencyRecord(ctx context.Context, record IdempotencyRecord) error
+	// DeleteIdempotencyRecord releases the key.
+	DeleteIdempotencyRecord(ctx context.Context, userID int, key string) error
+	DeleteIdempotencyRecords(ctx context.Context, createdBefore time.Time) (int64, error)
+	SaveAudit(ctx context.Context, entry *AuditEntry) error
+	// SavePairState records the state set on the pair with entry, closing the pair cancels its pending orders in the
+	// same transaction.
+	SavePairState(ctx context.Context, pair, state string, entry *AuditEntry) error
+	// PairStates returns the recorded states by pair, the pairs without one are open.
+	PairStates(ctx context.Context) (map[string]string, error)
+	AuditLog(ctx context.Context, limit int) ([]AuditEntry, error)
+	SaveAPIKey(ctx context.Context, key *APIKey) error
+	APIKey(ctx context.Context, key string) (APIKey, error)
+	UserAPIKeys(ctx context.Context, userID int) ([]APIKey, error)
+	RevokeAPIKey(ctx context.Context, userID int, key string) error
+	// Ping checks the store is reachable.
+	Ping(ctx context.Context) error
 	Close()
 }
 
+// settlement returns the balance changes of a filled order, the received amount minus feePercent and the amount paid.
+func settlement(order Order, feePercent float64) map[string]float64 {
+	bought, sold := order.Amount, order.Amount*order.Price
+	soldAsset, boughtAsset := order.AssetPair[0:3], order.AssetPair[4:]
+	if order.Side == "SELL" {
+		bought, sold = sold, bought
+		boughtAsset, soldAsset = soldAsset, boughtAsset
+	}
+	bought -= bought * feePercent / 100
+	return map[string]float64{boughtAsset: bought, soldAsset: -sold}
+}
+
+// balanceChange is a settlement delta of a balance.
+type balanceChange struct {
+	userID int
+	asset  string
+	delta  float64
+}
+
+// settlements returns the balance changes of the fills sorted by user then asset, for concurrent settlements to update
+// the balances in the same order.
+func settlements(fills []Fill) []balanceChange {
+	var changes []balanceChange
+	for _, fill := range fills {
+		for asset, delta := range settlement(fill.Order, fill.FeePercent) {
+			changes = append(changes, balanceChange{userID: fill.Order.userID, asset: asset, delta: delta})
+		}
+	}
+	sort.SliceStable(changes, func(i, j int) bool {
+		if changes[i].userID != changes[j].userID {
+			return changes[i].userID < changes[j].userID
+		}
+		return changes[i].asset < changes[j].asset
+	})
+	return changes
+}
+
+// migratingStore is a store whose schema is managed by the embedded migrations.
+type migratingStore interface {
+	store
+	Migrate() ([]string, error)
+}
+
+// openStore opens the store selected by the configuration.
+func openStore(cfg databaseConfig) (migratingStore, error) {
+	if cfg.Driver == driverSQLite {
+		return newSQLite(cfg.Path)
+	}
+	return newPostgres(cfg)
+}
+
 type mem struct {
-	userIDs   map[string]int
-	passwords map[int][]byte
-	assets    map[int]map[string]float64
-	orders    []Order
+	mu      sync.Mutex
+	userIDs map[string]int
+	users   map[int]User
+	// balances by user id then asset type
+	assets  map[int]map[string]Asset
+	nAssets int
+	orders  []Order
+	apiKeys []APIKey
+	audit   []AuditEntry
+	states  map[string]string
+	trades  []Execution
+	candles map[candleKey]Candle
+	// idempotency records by user id then key
+	idempotency map[int]map[string]IdempotencyRecord
+}
+
+type candleKey struct {
+	pair, interval string
+	start          int64
 }
 
 func newMem() *mem {
 	return &mem{
-		userIDs:   make(map[string]int),
-		passwords: make(map[int][]byte),
-		assets:    make(map[int]map[string]float64),
+		userIDs: make(map[string]int),
+		users:   make(map[int]User),
+		assets:  make(map[int]map[string]Asset),
+		candles: make(map[candleKey]Candle),
+		states:  make(map[string]string),
+
+		idempotency: make(map[int]map[string]IdempotencyRecord),
+	}
+}
+
+// lock acquires the store unless the context is done, as a query would fail on the other stores.
+func (m *mem) lock(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
 	}
+	m.mu.Lock()
+	return nil
 }
 
-func (m *mem) FillOrder(order Order) error {
-	if m.orders[order.id].Status == statusFilled {
-		return fmt.Errorf("order already filled")
+func (m *mem) FillOrders(ctx context.Context, fills ...Fill) error {
+	if err := m.lock(ctx); err != nil {
+		return err
+	}
+	defer m.mu.Unlock()
+	for _, fill := range fills {
+		if fill.Order.ID < 0 || fill.Order.ID >= len(m.orders) {
+			return ErrNotFound
+		}
+		if m.orders[fill.Order.ID].Status != statusPending {
+			return ErrOrderNotPending
+		}
+	}
+	for _, fill := range fills {
+		m.orders[fill.Order.ID].Status = statusFilled
+	}
+	for _, change := range settlements(fills) {
+		m.adjustAsset(change.userID, change.asset, change.delta)
 	}
-	m.orders[order.id].Status = statusFilled
 	return nil
 }
 
-func (m *mem) UserOrders(userID int) (orders []Order, err error) {
+func (m *mem) UserOrders(ctx context.Context, userID int, filter OrderFilter) (orders []Order, err error) {
+	if err := m.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer m.mu.Unlock()
 	for _, order := range m.orders {
-		if order.userID != userID {
+		if order.userID != userID || !filter.match(order) {
 			continue
 		}
 		orders = append(orders, order)
 	}
+	sort.SliceStable(orders, func(i, j int) bool {
+		return cursorOf(orders[i]).before(orders[j])
+	})
+	if filter.Limit > 0 && len(orders) > filter.Limit {
+		orders = orders[:filter.Limit]
+	}
 	return
 }
 
-func (m *mem) PendingOrders(pair string) (pendings []Order, err error) {
+func (m *mem) Order(ctx context.Context, id int) (Order, error) {
+	if err := m.lock(ctx); err != nil {
+		return Order{}, err
+	}
+	defer m.mu.Unlock()
+	if id < 0 || id >= len(m.orders) {
+		return Order{}, ErrNotFound
+	}
+	return m.orders[id], nil
+}
+
+func (m *mem) OrderByClientID(ctx context.Context, userID int, clientOrderID string) (Order, error) {
+	if err := m.lock(ctx); err != nil {
+		return Order{}, err
+	}
+	defer m.mu.Unlock()
+	return m.orderByClientID(userID, clientOrderID)
+}
+
+func (m *mem) orderByClientID(userID int, clientOrderID string) (Order, error) {
 	for _, order := range m.orders {
-		if order.AssetPair != pair || order.Status == statusFilled {
+		if order.userID == userID && order.ClientOrderID == clientOrderID {
+			return order, nil
+		}
+	}
+	return Order{}, ErrNotFound
+}
+
+func (m *mem) CancelOrder(ctx context.Context, id int) error {
+	return m.CancelOrderAudited(ctx, id, nil)
+}
+
+func (m *mem) CancelOrderAudited(ctx context.Context, id int, entry *AuditEntry) error {
+	if err := m.lock(ctx); err != nil {
+		return err
+	}
+	defer m.mu.Unlock()
+	if id < 0 || id >= len(m.orders) {
+		return ErrNotFound
+	}
+	if m.orders[id].Status != statusPending {
+		return ErrOrderNotPending
+	}
+	m.orders[id].Status = statusCancelled
+	m.saveAudit(entry)
+	return nil
+}
+
+func (m *mem) PendingOrders(ctx context.Context, pair string) (pendings []Order, err error) {
+	if err := m.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer m.mu.Unlock()
+	for _, order := range m.orders {
+		if order.AssetPair != pair || order.Status != statusPending {
 			continue
 		}
 		pendings = append(pendings, order)
@@ -88,63 +330,463 @@ func (m *mem) PendingOrders(pair string) (pendings []Order, err error) {
 	return
 }
 
-func (m *mem) User(username string) (int, []byte, error) {
+func (m *mem) User(ctx context.Context, username string) (User, error) {
+	if err := m.lock(ctx); err != nil {
+		return User{}, err
+	}
+	defer m.mu.Unlock()
 	id, ok := m.userIDs[username]
 	if !ok {
-		return 0, nil, ErrNotFound
+		return User{}, ErrNotFound
+	}
+	return m.users[id], nil
+}
+
+func (m *mem) UserByID(ctx context.Context, id int) (User, error) {
+	if err := m.lock(ctx); err != nil {
+		return User{}, err
+	}
+	defer m.mu.Unlock()
+	user, ok := m.users[id]
+	if !ok {
+		return User{}, ErrNotFound
 	}
-	return id, m.passwords[id], nil
+	return user, nil
 }
 
-func (m *mem) SaveUser(username string, password []byte) (int, error) {
+func (m *mem) SaveUser(ctx context.Context, username string, password []byte, assets ...Asset) (int, error) {
+	if err := m.lock(ctx); err != nil {
+		return 0, err
+	}
+	defer m.mu.Unlock()
 	if _, exist := m.userIDs[username]; exist {
-		return m.userIDs[username], nil
+		return -1, ErrUserExists
+	}
+	seen := make(map[string]bool)
+	for _, asset := range assets {
+		if seen[asset.Asset] {
+			return -1, ErrAssetExists
+		}
+		seen[asset.Asset] = true
 	}
 	id := len(m.userIDs)
 	m.userIDs[username] = id
-	m.passwords[id] = password
+	m.users[id] = User{id: id, password: password, Username: username, Role: roleUser}
+	for _, asset := range assets {
+		asset.userID = id
+		m.saveAsset(asset)
+	}
 	return id, nil
 }
 
-func (m *mem) Assets(userID int) ([]Asset, error) {
-	if m.assets[userID] == nil {
-		return []Asset{}, nil
+func (m *mem) UpdatePassword(ctx context.Context, userID int, password []byte) error {
+	return m.updateUser(ctx, userID, func(user *User) { user.password = password })
+}
+
+func (m *mem) SetUserRole(ctx context.Context, userID int, role string) error {
+	return m.updateUser(ctx, userID, func(user *User) { user.Role = role })
+}
+
+func (m *mem) SetUserDisabled(ctx context.Context, userID int, disabled bool) error {
+	return m.SetUserDisabledAudited(ctx, userID, disabled, nil)
+}
+
+func (m *mem) SetUserDisabledAudited(ctx context.Context, userID int, disabled bool, entry *AuditEntry) error {
+	return m.updateUser(ctx, userID, func(user *User) {
+		user.Disabled = disabled
+		m.saveAudit(entry)
+	})
+}
+
+func (m *mem) updateUser(ctx context.Context, userID int, update func(*User)) error {
+	if err := m.lock(ctx); err != nil {
+		return err
 	}
-	var b []Asset
-	for k, v := range m.assets[userID] {
-		b = append(b, Asset{
-			Asset:  k,
-			Amount: v,
-		})
+	defer m.mu.Unlock()
+	user, exist := m.users[userID]
+	if !exist {
+		return ErrNotFound
 	}
-	return b, nil
+	update(&user)
+	m.users[userID] = user
+	return nil
 }
 
-func (m *mem) SaveAsset(asset Asset) error {
-	if m.assets[asset.userID] == nil {
-		m.assets[asset.userID] = make(map[string]float64)
+func (m *mem) Users(ctx context.Context) (users []User, err error) {
+	if err := m.lock(ctx); err != nil {
+		return nil, err
 	}
-	m.assets[asset.userID][asset.Asset] = asset.Amount
+	defer m.mu.Unlock()
+	for id := 0; id < len(m.userIDs); id++ {
+		users = append(users, m.users[id])
+	}
+	return
+}
+
+func (m *mem) Assets(ctx context.Context, userID int) ([]Asset, error) {
+	if err := m.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer m.mu.Unlock()
+	var assets []Asset
+	for _, asset := range m.assets[userID] {
+		assets = append(assets, asset)
+	}
+	sort.Slice(assets, func(i, j int) bool {
+		return assets[i].id < assets[j].id
+	})
+	return assets, nil
+}
+
+func (m *mem) SaveAsset(ctx context.Context, asset Asset) error {
+	if err := m.lock(ctx); err != nil {
+		return err
+	}
+	defer m.mu.Unlock()
+	if _, exist := m.assets[asset.userID][asset.Asset]; exist {
+		return ErrAssetExists
+	}
+	m.saveAsset(asset)
 	return nil
 }
 
-func (m *mem) SaveOrder(order *Order) error {
+func (m *mem) saveAsset(asset Asset) Asset {
+	if m.assets[asset.userID] == nil {
+		m.assets[asset.userID] = make(map[string]Asset)
+	}
+	m.nAssets++
+	asset.id = m.nAssets
+	m.assets[asset.userID][asset.Asset] = asset
+	return asset
+}
+
+func (m *mem) AdjustAsset(ctx context.Context, userID int, asset string, delta float64) (Asset, error) {
+	return m.AdjustAssetAudited(ctx, userID, asset, delta, nil)
+}
+
+func (m *mem) AdjustAssetAudited(ctx context.Context, userID int, asset string, delta float64, entry *AuditEntry) (Asset, error) {
+	if err := m.lock(ctx); err != nil {
+		return Asset{}, err
+	}
+	defer m.mu.Unlock()
+	if m.assets[userID][asset].Amount+delta < 0 {
+		return Asset{}, ErrInsufficientFunds
+	}
+	adjusted := m.adjustAsset(userID, asset, delta)
+	m.saveAudit(entry)
+	return adjusted, nil
+}
+
+// adjustAsset changes the balance, creating it when missing, without checking the funds.
+func (m *mem) adjustAsset(userID int, assetType string, delta float64) Asset {
+	asset, exist := m.assets[userID][assetType]
+	if !exist {
+		return m.saveAsset(Asset{userID: userID, Asset: assetType, Amount: delta})
+	}
+	asset.Amount += delta
+	m.assets[userID][assetType] = asset
+	return asset
+}
+
+func (m *mem) SaveOrder(ctx context.Context, order *Order) error {
+	if err := m.lock(ctx); err != nil {
+		return err
+	}
+	defer m.mu.Unlock()
+	if order.ClientOrderID != "" {
+		if _, err := m.orderByClientID(order.userID, order.ClientOrderID); err == nil {
+			return ErrDuplicateClientOrderID
+		}
+	}
 	order.Status = statusPending
-	order.id = len(m.orders)
+	order.ID = len(m.orders)
+	order.CreatedAt = time.Now().Truncate(time.Microsecond)
 	m.orders = append(m.orders, *order)
 	return nil
 }
 
+func (m *mem) SaveAPIKey(ctx context.Context, key *APIKey) error {
+	if err := m.lock(ctx); err != nil {
+		return err
+	}
+	defer m.mu.Unlock()
+	for _, k := range m.apiKeys {
+		if k.Key == key.Key {
+			return ErrAPIKeyExists
+		}
+	}
+	key.id = len(m.apiKeys)
+	m.apiKeys = append(m.apiKeys, *key)
+	return nil
+}
+
+func (m *mem) APIKey(ctx context.Context, key string) (APIKey, error) {
+	if err := m.lock(ctx); err != nil {
+		return APIKey{}, err
+	}
+	defer m.mu.Unlock()
+	for _, k := range m.apiKeys {
+		if k.Key == key {
+			return k, nil
+		}
+	}
+	return APIKey{}, ErrNotFound
+}
+
+func (m *mem) UserAPIKeys(ctx context.Context, userID int) (keys []APIKey, err error) {
+	if err := m.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer m.mu.Unlock()
+	for _, k := range m.apiKeys {
+		if k.userID != userID {
+			continue
+		}
+		keys = append(keys, k)
+	}
+	return
+}
+
+func (m *mem) RevokeAPIKey(ctx context.Context, userID int, key string) error {
+	if err := m.lock(ctx); err != nil {
+		return err
+	}
+	defer m.mu.Unlock()
+	for i, k := range m.apiKeys {
+		if k.Key == key && k.userID == userID {
+			m.apiKeys[i].Revoked = true
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (m *mem) SaveTrade(ctx context.Context, e *Execution) error {
+	if err := m.lock(ctx); err != nil {
+		return err
+	}
+	defer m.mu.Unlock()
+	e.id = len(m.trades)
+	m.trades = append(m.trades, *e)
+	return nil
+}
+
+func (m *mem) Trades(ctx context.Context, pair string, from, to time.Time) (trades []Execution, err error) {
+	if err := m.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer m.mu.Unlock()
+	for _, trade := range m.trades {
+		if trade.Pair != pair || trade.Time.Before(from) || !trade.Time.Before(to) {
+			continue
+		}
+		trades = append(trades, trade)
+	}
+	sort.SliceStable(trades, func(i, j int) bool {
+		return trades[i].Time.Before(trades[j].Time)
+	})
+	return
+}
+
+func (m *mem) RecordTrade(ctx context.Context, e *Execution, candles map[string]Candle) error {
+	if err := m.lock(ctx); err != nil {
+		return err
+	}
+	defer m.mu.Unlock()
+	e.id = len(m.trades)
+	m.trades = append(m.trades, *e)
+	for interval, c := range candles {
+		key := candleKey{pair: e.Pair, interval: interval, start: c.Start.UnixNano()}
+		if stored, exist := m.candles[key]; exist {
+			stored.merge(c)
+			c = stored
+		}
+		m.candles[key] = c
+	}
+	return nil
+}
+
+func (m *mem) SaveCandles(ctx context.Context, pair, interval string, candles []Candle) error {
+	if err := m.lock(ctx); err != nil {
+		return err
+	}
+	defer m.mu.Unlock()
+	for _, c := range candles {
+		m.candles[candleKey{pair: pair, interval: interval, start: c.Start.UnixNano()}] = c
+	}
+	return nil
+}
+
+func (m *mem) Candles(ctx context.Context, pair, interval string, from, to time.Time) (candles []Candle, err error) {
+	if err := m.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer m.mu.Unlock()
+	for key, c := range m.candles {
+		if key.pair != pair || key.interval != interval || c.Start.Before(from) || !c.Start.Before(to) {
+			continue
+		}
+		// the trade times are bookkeeping, the other stores don't return them either
+		c.openedAt, c.closedAt = time.Time{}, time.Time{}
+		candles = append(candles, c)
+	}
+	sort.Slice(candles, func(i, j int) bool {
+		return candles[i].Start.Before(candles[j].Start)
+	})
+	return
+}
+
+func (m *mem) SaveIdempotencyRecord(ctx context.Context, record IdempotencyRecord, expiredBefore, abandonedBefore time.Time) error {
+	if err := m.lock(ctx); err != nil {
+		return err
+	}
+	defer m.mu.Unlock()
+	if stored, exist := m.idempotency[record.UserID][record.Key]; exist && stored.live(expiredBefore, abandonedBefore) {
+		return ErrIdempotencyKeyExists
+	}
+	if m.idempotency[record.UserID] == nil {
+		m.idempotency[record.UserID] = make(map[string]IdempotencyRecord)
+	}
+	m.idempotency[record.UserID][record.Key] = record
+	return nil
+}
+
+func (m *mem) IdempotencyRecord(ctx context.Context, userID int, key string) (IdempotencyRecord, error) {
+	if err := m.lock(ctx); err != nil {
+		return IdempotencyRecord{}, err
+	}
+	defer m.mu.Unlock()
+	record, exist := m.idempotency[userID][key]
+	if !exist {
+		return IdempotencyRecord{}, ErrNotFound
+	}
+	return record, nil
+}
+
+func (m *mem) CompleteIdempotencyRecord(ctx context.Context, record IdempotencyRecord) error {
+	if err := m.lock(ctx); err != nil {
+		return err
+	}
+	defer m.mu.Unlock()
+	stored, exist := m.idempotency[record.UserID][record.Key]
+	if !exist {
+		return ErrNotFound
+	}
+	stored.Status, stored.ContentType, stored.Response = record.Status, record.ContentType, record.Response
+	m.idempotency[record.UserID][record.Key] = stored
+	return nil
+}
+
+func (m *mem) DeleteIdempotencyRecord(ctx context.Context, userID int, key string) error {
+	if err := m.lock(ctx); err != nil {
+		return err
+	}
+	defer m.mu.Unlock()
+	delete(m.idempotency[userID], key)
+	return nil
+}
+
+func (m *mem) DeleteIdempotencyRecords(ctx context.Context, createdBefore time.Time) (deleted int64, err error) {
+	if err := m.lock(ctx); err != nil {
+		return 0, err
+	}
+	defer m.mu.Unlock()
+	for _, records := range m.idempotency {
+		for key, record := range records {
+			if record.CreatedAt.Before(createdBefore) {
+				delete(records, key)
+				deleted++
+			}
+		}
+	}
+	return
+}
+
+func (m *mem) SaveAudit(ctx context.Context, entry *AuditEntry) error {
+	if err := m.lock(ctx); err != nil {
+		return err
+	}
+	defer m.mu.Unlock()
+	m.saveAudit(entry)
+	return nil
+}
+
+// saveAudit appends the entry, a nil entry records nothing.
+func (m *mem) saveAudit(entry *AuditEntry) {
+	if entry == nil {
+		return
+	}
+	entry.id = len(m.audit)
+	m.audit = append(m.audit, *entry)
+}
+
+func (m *mem) AuditLog(ctx context.Context, limit int) (entries []AuditEntry, err error) {
+	if err := m.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer m.mu.Unlock()
+	for i := len(m.audit) - 1; i >= 0 && len(entries) < limit; i-- {
+		entries = append(entries, m.audit[i])
+	}
+	return
+}
+
+func (m *mem) SavePairState(ctx context.Context, pair, state string, entry *AuditEntry) error {
+	if err := m.lock(ctx); err != nil {
+		return err
+	}
+	defer m.mu.Unlock()
+	m.states[pair] = state
+	if state == pairClosed {
+		for i, order := range m.orders {
+			if order.AssetPair == pair && order.Status == statusPending {
+				m.orders[i].Status = statusCancelled
+			}
+		}
+	}
+	m.saveAudit(entry)
+	return nil
+}
+
+func (m *mem) PairStates(ctx context.Context) (map[string]string, error) {
+	if err := m.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer m.mu.Unlock()
+	states := make(map[string]string, len(m.states))
+	for pair, state := range m.states {
+		states[pair] = state
+	}
+	return states, nil
+}
+
+func (m *mem) Ping(ctx context.Context) error {
+	return ctx.Err()
+}
+
 func (m *mem) Close() {}
 
 type postgres struct {
 	pool *pgxpool.Pool
 }
 
-func newPostgres(db string) (*postgres, error) {
-	pool, err := pgxpool.New(context.Background(), db)
+func newPostgres(cfg databaseConfig) (*postgres, error) {
+	poolConfig, err := pgxpool.ParseConfig(cfg.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid database url: %w", err)
+	}
+	if cfg.MaxConns > 0 {
+		poolConfig.MaxConns = cfg.MaxConns
+	}
+	if cfg.MinConns > 0 {
+		poolConfig.MinConns = cfg.MinConns
+	}
+	if cfg.MaxConnLifetime > 0 {
+		poolConfig.MaxConnLifetime = time.Duration(cfg.MaxConnLifetime)
+	}
+	pool, err := pgxpool.NewWithConfig(context.Background(), poolConfig)
 	if err != nil {
-		return nil, fmt.Errorf("unable to create connection pool: %v", err)
+		return nil, fmt.Errorf("unable to create connection pool: %w", err)
 	}
 
 	return &postgres{
@@ -152,137 +794,734 @@ func newPostgres(db string) (*postgres, error) {
 	}, nil
 }
 
-func (db postgres) User(username string) (id int, password []byte, err error) {
-	err = db.pool.QueryRow(context.Background(), "select id, password from users where username=$1", username).Scan(&id, &password)
+func (db postgres) User(ctx context.Context, username string) (user User, err error) {
+	defer observeQuery(ctx, "User")()
+	err = db.pool.QueryRow(ctx, "select id, username, password, role, disabled from users where username=$1", username).
+		Scan(&user.id, &user.Username, &user.password, &user.Role, &user.Disabled)
 	if err != nil {
-		if strings.Contains(err.Error(), errNoRowsMsg) {
-			return -1, nil, ErrNotFound
+		if errors.Is(err, pgx.ErrNoRows) {
+			return User{}, ErrNotFound
 		}
-		return -1, nil, fmt.Errorf("cannot get user: %v", err)
+		return User{}, fmt.Errorf("cannot get user: %w", err)
 	}
 	return
 }
 
-func (db postgres) SaveUser(username string, password []byte) (int, error) {
+func (db postgres) UserByID(ctx context.Context, id int) (user User, err error) {
+	defer observeQuery(ctx, "UserByID")()
+	err = db.pool.QueryRow(ctx, "select id, username, password, role, disabled from users where id=$1", id).
+		Scan(&user.id, &user.Username, &user.password, &user.Role, &user.Disabled)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return User{}, ErrNotFound
+		}
+		return User{}, fmt.Errorf("cannot get user: %w", err)
+	}
+	return
+}
+
+func (db postgres) SaveUser(ctx context.Context, username string, password []byte, assets ...Asset) (int, error) {
+	defer observeQuery(ctx, "SaveUser")()
+	tx, err := db.pool.Begin(ctx)
+	if err != nil {
+		return -1, fmt.Errorf("cannot save user: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
 	id := -1
-	err := db.pool.QueryRow(context.Background(),
+	err = tx.QueryRow(ctx,
 		`insert into users(username, password) values ($1, $2) returning id`, username, password,
 	).Scan(&id)
 	if err != nil {
-		return id, fmt.Errorf("cannot save user: %v", err)
+		if isUniqueViolation(err) {
+			return -1, ErrUserExists
+		}
+		return -1, fmt.Errorf("cannot save user: %w", err)
+	}
+	for _, asset := range assets {
+		_, err := tx.Exec(ctx, `insert into assets(userid, asset_type, balance) values ($1, $2, $3)`, id, asset.Asset, asset.Amount)
+		if err != nil {
+			if isUniqueViolation(err) {
+				return -1, ErrAssetExists
+			}
+			return -1, fmt.Errorf("cannot save asset: %w", err)
+		}
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return -1, fmt.Errorf("cannot save user: %w", err)
 	}
 	return id, nil
 }
 
-func (db postgres) Assets(userID int) (assets []Asset, err error) {
-	rows, err := db.pool.Query(context.Background(), "select id, asset_type, balance from assets where userid=$1", userID)
+func (db postgres) UpdatePassword(ctx context.Context, userID int, password []byte) error {
+	defer observeQuery(ctx, "UpdatePassword")()
+	return db.updateUser(ctx, "update users set password = $1 where id=$2", password, userID)
+}
+
+func (db postgres) SetUserRole(ctx context.Context, userID int, role string) error {
+	defer observeQuery(ctx, "SetUserRole")()
+	return db.updateUser(ctx, "update users set role = $1 where id=$2", role, userID)
+}
+
+func (db postgres) SetUserDisabled(ctx context.Context, userID int, disabled bool) error {
+	defer observeQuery(ctx, "SetUserDisabled")()
+	return db.updateUser(ctx, "update users set disabled = $1 where id=$2", disabled, userID)
+}
+
+func (db postgres) SetUserDisabledAudited(ctx context.Context, userID int, disabled bool, entry *AuditEntry) error {
+	defer observeQuery(ctx, "SetUserDisabledAudited")()
+	tx, err := db.pool.Begin(ctx)
 	if err != nil {
-		if strings.Contains(err.Error(), errNoRowsMsg) {
-			return nil, ErrNotFound
+		return fmt.Errorf("cannot update user: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	tag, err := tx.Exec(ctx, "update users set disabled = $1 where id=$2", disabled, userID)
+	if err != nil {
+		return fmt.Errorf("cannot update user: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	if err := db.saveAudit(ctx, tx, entry); err != nil {
+		return err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("cannot update user: %w", err)
+	}
+	return nil
+}
+
+func (db postgres) Users(ctx context.Context) (users []User, err error) {
+	defer observeQuery(ctx, "Users")()
+	rows, err := db.pool.Query(ctx, "select id, username, role, disabled from users order by id")
+	if err != nil {
+		return nil, fmt.Errorf("cannot get users: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var user User
+		if err := rows.Scan(&user.id, &user.Username, &user.Role, &user.Disabled); err != nil {
+			return nil, fmt.Errorf("cannot read user: %w", err)
 		}
-		return nil, fmt.Errorf("cannot get assets: %v", err)
+		users = append(users, user)
+	}
+	return
+}
+
+func (db postgres) updateUser(ctx context.Context, query string, args ...any) error {
+	tag, err := db.pool.Exec(ctx, query, args...)
+	if err != nil {
+		return fmt.Errorf("cannot update user: %w", err)
 	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (db postgres) Assets(ctx context.Context, userID int) (assets []Asset, err error) {
+	defer observeQuery(ctx, "Assets")()
+	rows, err := db.pool.Query(ctx, "select id, asset_type, balance from assets where userid=$1 order by id", userID)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get assets: %w", err)
+	}
+	defer rows.Close()
 	for rows.Next() {
-		var asset Asset
+		asset := Asset{userID: userID}
 		if err := rows.Scan(&asset.id, &asset.Asset, &asset.Amount); err != nil {
-			return nil, fmt.Errorf("cannot read assets: %v", err)
+			return nil, fmt.Errorf("cannot read assets: %w", err)
 		}
 		assets = append(assets, asset)
 	}
-	return
+	return assets, rows.Err()
 }
 
-func (db postgres) SaveAsset(asset Asset) error {
-	_, err := db.pool.Exec(context.Background(), `insert into assets(userid, asset_type, balance) values ($1, $2, $3)`, asset.userID, asset.Asset, asset.Amount)
+func (db postgres) SaveAsset(ctx context.Context, asset Asset) error {
+	defer observeQuery(ctx, "SaveAsset")()
+	_, err := db.pool.Exec(ctx, `insert into assets(userid, asset_type, balance) values ($1, $2, $3)`, asset.userID, asset.Asset, asset.Amount)
 	if err != nil {
-		return fmt.Errorf("cannot save asset: %v", err)
+		if isUniqueViolation(err) {
+			return ErrAssetExists
+		}
+		return fmt.Errorf("cannot save asset: %w", err)
 	}
 	return nil
 }
 
-func (db postgres) SaveOrder(order *Order) error {
+func (db postgres) AdjustAsset(ctx context.Context, userID int, assetType string, delta float64) (Asset, error) {
+	defer observeQuery(ctx, "AdjustAsset")()
+	return db.adjustAsset(ctx, userID, assetType, delta, nil)
+}
+
+func (db postgres) AdjustAssetAudited(ctx context.Context, userID int, assetType string, delta float64, entry *AuditEntry) (Asset, error) {
+	defer observeQuery(ctx, "AdjustAssetAudited")()
+	return db.adjustAsset(ctx, userID, assetType, delta, entry)
+}
+
+func (db postgres) adjustAsset(ctx context.Context, userID int, assetType string, delta float64, entry *AuditEntry) (Asset, error) {
+	tx, err := db.pool.Begin(ctx)
+	if err != nil {
+		return Asset{}, fmt.Errorf("cannot adjust asset: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	asset := Asset{userID: userID, Asset: assetType}
+	err = tx.QueryRow(ctx, "select id, balance from assets where userid=$1 and asset_type=$2 for update", userID, assetType).Scan(&asset.id, &asset.Amount)
+	exist := err == nil
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return Asset{}, fmt.Errorf("cannot get asset: %w", err)
+	}
+	if asset.Amount+delta < 0 {
+		return Asset{}, ErrInsufficientFunds
+	}
+	asset.Amount += delta
+	if exist {
+		_, err = tx.Exec(ctx, "update assets set balance = $1 where id=$2", asset.Amount, asset.id)
+	} else {
+		err = tx.QueryRow(ctx, "insert into assets(userid, asset_type, balance) values ($1, $2, $3) returning id", userID, assetType, asset.Amount).Scan(&asset.id)
+	}
+	if err != nil {
+		return Asset{}, fmt.Errorf("cannot adjust asset: %w", err)
+	}
+	if err := db.saveAudit(ctx, tx, entry); err != nil {
+		return Asset{}, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return Asset{}, fmt.Errorf("cannot adjust asset: %w", err)
+	}
+	return asset, nil
+}
+
+func (db postgres) SaveOrder(ctx context.Context, order *Order) error {
+	defer observeQuery(ctx, "SaveOrder")()
 	order.Status = statusPending
-	err := db.pool.QueryRow(context.Background(),
-		`insert into orders(userid, side, asset_pair, amount, price, status) values ($1, $2, $3, $4, $5, $6) returning id`, order.userID, order.Side, order.AssetPair, order.Amount, order.Price, order.Status,
-	).Scan(&order.id)
+	err := db.pool.QueryRow(ctx,
+		`insert into orders(userid, client_order_id, side, asset_pair, amount, price, status) values ($1, nullif($2, ''), $3, $4, $5, $6, $7) returning id, created_at`, order.userID, order.ClientOrderID, order.Side, order.AssetPair, order.Amount, order.Price, order.Status,
+	).Scan(&order.ID, &order.CreatedAt)
 	if err != nil {
-		return fmt.Errorf("cannot save order: %v", err)
+		if isUniqueViolation(err) {
+			return ErrDuplicateClientOrderID
+		}
+		return fmt.Errorf("cannot save order: %w", err)
 	}
 	return nil
 }
 
-func (db postgres) UserOrders(userID int) (orders []Order, err error) {
-	rows, err := db.pool.Query(context.Background(), "select id, side, asset_pair, amount, price, status from orders where userid=$1", userID)
+const orderColumns = "id, coalesce(client_order_id, ''), userid, side, asset_pair, amount, price, status, created_at"
+
+func scanOrder(row pgx.Row) (order Order, err error) {
+	err = row.Scan(&order.ID, &order.ClientOrderID, &order.userID, &order.Side, &order.AssetPair, &order.Amount, &order.Price, &order.Status, &order.CreatedAt)
+	return
+}
+
+func (db postgres) Order(ctx context.Context, id int) (Order, error) {
+	defer observeQuery(ctx, "Order")()
+	order, err := scanOrder(db.pool.QueryRow(ctx, "select "+orderColumns+" from orders where id=$1", id))
 	if err != nil {
-		if strings.Contains(err.Error(), errNoRowsMsg) {
-			return nil, ErrNotFound
+		if errors.Is(err, pgx.ErrNoRows) {
+			return Order{}, ErrNotFound
 		}
-		return nil, fmt.Errorf("cannot get order: %v", err)
+		return Order{}, fmt.Errorf("cannot get order: %w", err)
 	}
+	return order, nil
+}
+
+func (db postgres) OrderByClientID(ctx context.Context, userID int, clientOrderID string) (Order, error) {
+	defer observeQuery(ctx, "OrderByClientID")()
+	order, err := scanOrder(db.pool.QueryRow(ctx,
+		"select "+orderColumns+" from orders where userid=$1 and client_order_id=$2", userID, clientOrderID))
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return Order{}, ErrNotFound
+		}
+		return Order{}, fmt.Errorf("cannot get order: %w", err)
+	}
+	return order, nil
+}
+
+func (db postgres) CancelOrder(ctx context.Context, id int) error {
+	defer observeQuery(ctx, "CancelOrder")()
+	tag, err := db.pool.Exec(ctx, "update orders set status = $1 where id=$2 and status=$3", statusCancelled, id, statusPending)
+	if err != nil {
+		return fmt.Errorf("cannot cancel order: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		if _, err := db.Order(ctx, id); err != nil {
+			return err
+		}
+		return ErrOrderNotPending
+	}
+	return nil
+}
+
+func (db postgres) CancelOrderAudited(ctx context.Context, id int, entry *AuditEntry) error {
+	defer observeQuery(ctx, "CancelOrderAudited")()
+	tx, err := db.pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("cannot cancel order: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	var status string
+	err = tx.QueryRow(ctx, "select status from orders where id=$1 for update", id).Scan(&status)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return ErrNotFound
+		}
+		return fmt.Errorf("cannot get order: %w", err)
+	}
+	if status != statusPending {
+		return ErrOrderNotPending
+	}
+	if _, err := tx.Exec(ctx, "update orders set status = $1 where id=$2", statusCancelled, id); err != nil {
+		return fmt.Errorf("cannot cancel order: %w", err)
+	}
+	if err := db.saveAudit(ctx, tx, entry); err != nil {
+		return err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("cannot cancel order: %w", err)
+	}
+	return nil
+}
+
+func (db postgres) UserOrders(ctx context.Context, userID int, filter OrderFilter) (orders []Order, err error) {
+	defer observeQuery(ctx, "UserOrders")()
+	query := "select " + orderColumns + " from orders where userid=$1"
+	args := []any{userID}
+	where := func(condition string, values ...any) {
+		placeholders := make([]any, len(values))
+		for i, v := range values {
+			args = append(args, v)
+			placeholders[i] = len(args)
+		}
+		query += " and " + fmt.Sprintf(condition, placeholders...)
+	}
+	if filter.Status != "" {
+		where("status=$%d", filter.Status)
+	}
+	if filter.Pair != "" {
+		where("asset_pair=$%d", filter.Pair)
+	}
+	if filter.Side != "" {
+		where("side=$%d", filter.Side)
+	}
+	if !filter.From.IsZero() {
+		where("created_at >= $%d", filter.From)
+	}
+	if !filter.To.IsZero() {
+		where("created_at < $%d", filter.To)
+	}
+	if filter.After != nil {
+		where("(created_at, id) > ($%d, $%d)", filter.After.CreatedAt, filter.After.ID)
+	}
+	query += " order by created_at, id"
+	if filter.Limit > 0 {
+		args = append(args, filter.Limit)
+		query += fmt.Sprintf(" limit $%d", len(args))
+	}
+
+	rows, err := db.pool.Query(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get order: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		order, err := scanOrder(rows)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read order: %w", err)
+		}
+		orders = append(orders, order)
+	}
+	return orders, rows.Err()
+}
+
+func (db postgres) PendingOrders(ctx context.Context, pair string) (orders []Order, err error) {
+	defer observeQuery(ctx, "PendingOrders")()
+	rows, err := db.pool.Query(ctx, "select "+orderColumns+" from orders where status=$1 and asset_pair=$2 order by id", statusPending, pair)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get order: %w", err)
+	}
+	defer rows.Close()
 	for rows.Next() {
-		order := Order{userID: userID}
-		if err := rows.Scan(&order.id, &order.Side, &order.AssetPair, &order.Amount, &order.Price, &order.Status); err != nil {
-			return nil, fmt.Errorf("cannot read order: %v", err)
+		order, err := scanOrder(rows)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read order: %w", err)
 		}
 		orders = append(orders, order)
 	}
+	return orders, rows.Err()
+}
+
+func (db postgres) FillOrders(ctx context.Context, fills ...Fill) error {
+	defer observeQuery(ctx, "FillOrders")()
+	tx, err := db.pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("cannot fill order: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	for _, fill := range fills {
+		tag, err := tx.Exec(ctx, "update orders set status = $1 where id=$2 and status=$3", statusFilled, fill.Order.ID, statusPending)
+		if err != nil {
+			return fmt.Errorf("cannot fill order: %w", err)
+		}
+		if tag.RowsAffected() == 0 {
+			var exists bool
+			if err := tx.QueryRow(ctx, "select exists(select 1 from orders where id=$1)", fill.Order.ID).Scan(&exists); err != nil {
+				return fmt.Errorf("cannot fill order: %w", err)
+			}
+			if !exists {
+				return ErrNotFound
+			}
+			return ErrOrderNotPending
+		}
+	}
+	for _, change := range settlements(fills) {
+		_, err := tx.Exec(ctx, `insert into assets(userid, asset_type, balance) values ($1, $2, $3)
+			on conflict (userid, asset_type) do update set balance = assets.balance + excluded.balance`, change.userID, change.asset, change.delta)
+		if err != nil {
+			return fmt.Errorf("cannot settle order: %w", err)
+		}
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("cannot fill order: %w", err)
+	}
+	return nil
+}
+
+func (db postgres) SaveAPIKey(ctx context.Context, key *APIKey) error {
+	defer observeQuery(ctx, "SaveAPIKey")()
+	err := db.pool.QueryRow(ctx,
+		`insert into api_keys(userid, key, secret, scopes, created_at) values ($1, $2, $3, $4, $5) returning id`, key.userID, key.Key, key.Secret, key.Scopes, key.CreatedAt,
+	).Scan(&key.id)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return ErrAPIKeyExists
+		}
+		return fmt.Errorf("cannot save api key: %w", err)
+	}
+	return nil
+}
+
+func (db postgres) APIKey(ctx context.Context, key string) (apiKey APIKey, err error) {
+	defer observeQuery(ctx, "APIKey")()
+	err = db.pool.QueryRow(ctx, "select id, userid, key, secret, scopes, revoked, created_at from api_keys where key=$1", key).
+		Scan(&apiKey.id, &apiKey.userID, &apiKey.Key, &apiKey.Secret, &apiKey.Scopes, &apiKey.Revoked, &apiKey.CreatedAt)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return APIKey{}, ErrNotFound
+		}
+		return APIKey{}, fmt.Errorf("cannot get api key: %w", err)
+	}
 	return
 }
 
-func (db postgres) PendingOrders(pair string) (orders []Order, err error) {
-	rows, err := db.pool.Query(context.Background(), "select id, userid, side, asset_pair, amount, price, status from orders where status=$1 and asset_pair=$2", statusPending, pair)
+func (db postgres) UserAPIKeys(ctx context.Context, userID int) (keys []APIKey, err error) {
+	defer observeQuery(ctx, "UserAPIKeys")()
+	rows, err := db.pool.Query(ctx, "select id, key, secret, scopes, revoked, created_at from api_keys where userid=$1 order by id", userID)
 	if err != nil {
-		if strings.Contains(err.Error(), errNoRowsMsg) {
-			return nil, ErrNotFound
+		return nil, fmt.Errorf("cannot get api keys: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		key := APIKey{userID: userID}
+		if err := rows.Scan(&key.id, &key.Key, &key.Secret, &key.Scopes, &key.Revoked, &key.CreatedAt); err != nil {
+			return nil, fmt.Errorf("cannot read api key: %w", err)
 		}
-		return nil, fmt.Errorf("cannot get order: %v", err)
+		keys = append(keys, key)
 	}
+	return
+}
+
+func (db postgres) RevokeAPIKey(ctx context.Context, userID int, key string) error {
+	defer observeQuery(ctx, "RevokeAPIKey")()
+	tag, err := db.pool.Exec(ctx, "update api_keys set revoked = true where key=$1 and userid=$2", key, userID)
+	if err != nil {
+		return fmt.Errorf("cannot revoke api key: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (db postgres) SaveTrade(ctx context.Context, e *Execution) error {
+	defer observeQuery(ctx, "SaveTrade")()
+	err := db.pool.QueryRow(ctx,
+		`insert into trades(asset_pair, price, amount, executed_at) values ($1, $2, $3, $4) returning id`, e.Pair, e.Price, e.Amount, e.Time,
+	).Scan(&e.id)
+	if err != nil {
+		return fmt.Errorf("cannot save trade: %w", err)
+	}
+	return nil
+}
+
+func (db postgres) Trades(ctx context.Context, pair string, from, to time.Time) (trades []Execution, err error) {
+	defer observeQuery(ctx, "Trades")()
+	rows, err := db.pool.Query(ctx,
+		"select id, asset_pair, price, amount, executed_at from trades where asset_pair=$1 and executed_at >= $2 and executed_at < $3 order by executed_at, id", pair, from, to)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get trades: %w", err)
+	}
+	defer rows.Close()
 	for rows.Next() {
-		var order Order
-		if err := rows.Scan(&order.id, &order.userID, &order.Side, &order.AssetPair, &order.Amount, &order.Price, &order.Status); err != nil {
-			return nil, fmt.Errorf("cannot read order: %v", err)
+		var trade Execution
+		if err := rows.Scan(&trade.id, &trade.Pair, &trade.Price, &trade.Amount, &trade.Time); err != nil {
+			return nil, fmt.Errorf("cannot read trade: %w", err)
 		}
-		orders = append(orders, order)
+		trades = append(trades, trade)
 	}
 	return
 }
 
-func (db postgres) FillOrder(order Order) error {
-	// todo check if already filled
-	_, err := db.pool.Exec(context.Background(), "update orders set status = $1 where id=$2", statusFilled, order.id)
+func (db postgres) RecordTrade(ctx context.Context, e *Execution, candles map[string]Candle) error {
+	defer observeQuery(ctx, "RecordTrade")()
+	tx, err := db.pool.Begin(ctx)
 	if err != nil {
-		return err
+		return fmt.Errorf("cannot record trade: %w", err)
 	}
+	defer tx.Rollback(ctx)
 
-	bought, sold := order.Amount, order.Amount*order.Price
-	soldAsset, boughtAsset := order.AssetPair[0:3], order.AssetPair[4:]
-	if order.Side == "SELL" {
-		bought, sold = sold, bought
-		boughtAsset, soldAsset = soldAsset, boughtAsset
+	err = tx.QueryRow(ctx,
+		`insert into trades(asset_pair, price, amount, executed_at) values ($1, $2, $3, $4) returning id`, e.Pair, e.Price, e.Amount, e.Time,
+	).Scan(&e.id)
+	if err != nil {
+		return fmt.Errorf("cannot save trade: %w", err)
+	}
+	for interval, c := range candles {
+		_, err := tx.Exec(ctx, `insert into candles(asset_pair, period, start, open, high, low, close, base_volume, quote_volume, opened_at, closed_at)
+			values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+			on conflict (asset_pair, period, start) do update set
+				open = case when excluded.opened_at < candles.opened_at then excluded.open else candles.open end,
+				high = greatest(candles.high, excluded.high),
+				low = least(candles.low, excluded.low),
+				close = case when excluded.closed_at >= candles.closed_at then excluded.close else candles.close end,
+				base_volume = candles.base_volume + excluded.base_volume,
+				quote_volume = candles.quote_volume + excluded.quote_volume,
+				opened_at = least(candles.opened_at, excluded.opened_at),
+				closed_at = greatest(candles.closed_at, excluded.closed_at)`,
+			e.Pair, interval, c.Start, c.Open, c.High, c.Low, c.Close, c.BaseVolume, c.QuoteVolume, c.openedAt, c.closedAt)
+		if err != nil {
+			return fmt.Errorf("cannot merge candle: %w", err)
+		}
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("cannot record trade: %w", err)
 	}
+	return nil
+}
 
-	assets, err := db.Assets(order.userID)
+func (db postgres) SaveCandles(ctx context.Context, pair, interval string, candles []Candle) error {
+	defer observeQuery(ctx, "SaveCandles")()
+	tx, err := db.pool.Begin(ctx)
 	if err != nil {
-		return err
+		return fmt.Errorf("cannot save candles: %w", err)
 	}
-	for _, asset := range assets {
-		if asset.Asset == boughtAsset {
-			_, err := db.pool.Exec(context.Background(), "update assets set balance = $1 where id=$2", asset.Amount+bought, asset.id)
-			if err != nil {
-				return err
-			}
+	defer tx.Rollback(ctx)
+	for _, c := range candles {
+		_, err := tx.Exec(ctx, `insert into candles(asset_pair, period, start, open, high, low, close, base_volume, quote_volume, opened_at, closed_at)
+			values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+			on conflict (asset_pair, period, start) do update set
+				open = excluded.open,
+				high = excluded.high,
+				low = excluded.low,
+				close = excluded.close,
+				base_volume = excluded.base_volume,
+				quote_volume = excluded.quote_volume,
+				opened_at = excluded.opened_at,
+				closed_at = excluded.closed_at`,
+			pair, interval, c.Start, c.Open, c.High, c.Low, c.Close, c.BaseVolume, c.QuoteVolume, c.openedAt, c.closedAt)
+		if err != nil {
+			return fmt.Errorf("cannot save candle: %w", err)
 		}
-		if asset.Asset == soldAsset {
-			_, err := db.pool.Exec(context.Background(), "update assets set balance = $1 where id=$2", asset.Amount-sold, asset.id)
-			if err != nil {
-				return err
-			}
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("cannot save candles: %w", err)
+	}
+	return nil
+}
+
+func (db postgres) Candles(ctx context.Context, pair, interval string, from, to time.Time) (candles []Candle, err error) {
+	defer observeQuery(ctx, "Candles")()
+	rows, err := db.pool.Query(ctx,
+		"select start, open, high, low, close, base_volume, quote_volume from candles where asset_pair=$1 and period=$2 and start >= $3 and start < $4 order by start",
+		pair, interval, from, to)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get candles: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var c Candle
+		if err := rows.Scan(&c.Start, &c.Open, &c.High, &c.Low, &c.Close, &c.BaseVolume, &c.QuoteVolume); err != nil {
+			return nil, fmt.Errorf("cannot read candle: %w", err)
+		}
+		candles = append(candles, c)
+	}
+	return
+}
+
+func (db postgres) SaveIdempotencyRecord(ctx context.Context, record IdempotencyRecord, expiredBefore, abandonedBefore time.Time) error {
+	defer observeQuery(ctx, "SaveIdempotencyRecord")()
+	tag, err := db.pool.Exec(ctx, `insert into idempotency_keys(userid, key, request_hash, created_at) values ($1, $2, $3, $4)
+		on conflict (userid, key) do update set request_hash = excluded.request_hash, status = 0, content_type = '', response = null, created_at = excluded.created_at
+		where idempotency_keys.created_at < $5 or (idempotency_keys.status = 0 and idempotency_keys.created_at < $6)`,
+		record.UserID, record.Key, record.RequestHash, record.CreatedAt, expiredBefore, abandonedBefore)
+	if err != nil {
+		return fmt.Errorf("cannot save idempotency key: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrIdempotencyKeyExists
+	}
+	return nil
+}
+
+func (db postgres) IdempotencyRecord(ctx context.Context, userID int, key string) (record IdempotencyRecord, err error) {
+	defer observeQuery(ctx, "IdempotencyRecord")()
+	err = db.pool.QueryRow(ctx, "select userid, key, request_hash, status, content_type, response, created_at from idempotency_keys where userid=$1 and key=$2", userID, key).
+		Scan(&record.UserID, &record.Key, &record.RequestHash, &record.Status, &record.ContentType, &record.Response, &record.CreatedAt)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return IdempotencyRecord{}, ErrNotFound
 		}
+		return IdempotencyRecord{}, fmt.Errorf("cannot get idempotency key: %w", err)
+	}
+	return
+}
+
+func (db postgres) CompleteIdempotencyRecord(ctx context.Context, record IdempotencyRecord) error {
+	defer observeQuery(ctx, "CompleteIdempotencyRecord")()
+	tag, err := db.pool.Exec(ctx, "update idempotency_keys set status = $1, content_type = $2, response = $3 where userid=$4 and key=$5",
+		record.Status, record.ContentType, record.Response, record.UserID, record.Key)
+	if err != nil {
+		return fmt.Errorf("cannot save idempotent response: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
 	}
+	return nil
+}
 
+func (db postgres) DeleteIdempotencyRecord(ctx context.Context, userID int, key string) error {
+	defer observeQuery(ctx, "DeleteIdempotencyRecord")()
+	if _, err := db.pool.Exec(ctx, "delete from idempotency_keys where userid=$1 and key=$2", userID, key); err != nil {
+		return fmt.Errorf("cannot delete idempotency key: %w", err)
+	}
+	return nil
+}
+
+func (db postgres) DeleteIdempotencyRecords(ctx context.Context, createdBefore time.Time) (int64, error) {
+	defer observeQuery(ctx, "DeleteIdempotencyRecords")()
+	tag, err := db.pool.Exec(ctx, "delete from idempotency_keys where created_at < $1", createdBefore)
+	if err != nil {
+		return 0, fmt.Errorf("cannot delete idempotency keys: %w", err)
+	}
+	return tag.RowsAffected(), nil
+}
+
+func (db postgres) SaveAudit(ctx context.Context, entry *AuditEntry) error {
+	defer observeQuery(ctx, "SaveAudit")()
+	return db.saveAudit(ctx, db.pool, entry)
+}
+
+// pgxQuerier is implemented by the pool and the transactions.
+type pgxQuerier interface {
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+// saveAudit saves the entry with q, the transaction of the audited action, a nil entry records nothing.
+func (db postgres) saveAudit(ctx context.Context, q pgxQuerier, entry *AuditEntry) error {
+	if entry == nil {
+		return nil
+	}
+	err := q.QueryRow(ctx,
+		`insert into audit_log(admin_id, action, target, details, created_at) values ($1, $2, $3, $4, $5) returning id`, entry.AdminID, entry.Action, entry.Target, entry.Details, entry.CreatedAt,
+	).Scan(&entry.id)
+	if err != nil {
+		return fmt.Errorf("cannot save audit entry: %w", err)
+	}
+	return nil
+}
+
+func (db postgres) AuditLog(ctx context.Context, limit int) (entries []AuditEntry, err error) {
+	defer observeQuery(ctx, "AuditLog")()
+	rows, err := db.pool.Query(ctx, "select id, admin_id, action, target, details, created_at from audit_log order by id desc limit $1", limit)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get audit log: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var entry AuditEntry
+		if err := rows.Scan(&entry.id, &entry.AdminID, &entry.Action, &entry.Target, &entry.Details, &entry.CreatedAt); err != nil {
+			return nil, fmt.Errorf("cannot read audit entry: %w", err)
+		}
+		entries = append(entries, entry)
+	}
+	return
+}
+
+func (db postgres) SavePairState(ctx context.Context, pair, state string, entry *AuditEntry) error {
+	defer observeQuery(ctx, "SavePairState")()
+	tx, err := db.pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("cannot save pair state: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx,
+		`insert into pair_states(asset_pair, state, updated_at) values ($1, $2, now())
+		on conflict (asset_pair) do update set state = excluded.state, updated_at = excluded.updated_at`, pair, state)
+	if err != nil {
+		return fmt.Errorf("cannot save pair state: %w", err)
+	}
+	if state == pairClosed {
+		_, err := tx.Exec(ctx, "update orders set status = $1 where asset_pair=$2 and status=$3", statusCancelled, pair, statusPending)
+		if err != nil {
+			return fmt.Errorf("cannot cancel orders: %w", err)
+		}
+	}
+	if err := db.saveAudit(ctx, tx, entry); err != nil {
+		return err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("cannot save pair state: %w", err)
+	}
+	return nil
+}
+
+func (db postgres) PairStates(ctx context.Context) (map[string]string, error) {
+	defer observeQuery(ctx, "PairStates")()
+	rows, err := db.pool.Query(ctx, "select asset_pair, state from pair_states")
+	if err != nil {
+		return nil, fmt.Errorf("cannot get pair states: %w", err)
+	}
+	defer rows.Close()
+	states := make(map[string]string)
+	for rows.Next() {
+		var pair, state string
+		if err := rows.Scan(&pair, &state); err != nil {
+			return nil, fmt.Errorf("cannot read pair state: %w", err)
+		}
+		states[pair] = state
+	}
+	return states, rows.Err()
+}
+
+func (db postgres) Ping(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, pingTimeout)
+	defer cancel()
+	if err := db.pool.Ping(ctx); err != nil {
+		return fmt.Errorf("cannot reach database: %w", err)
+	}
 	return nil
 }
 
 func (db postgres) Close() {
 	db.pool.Close()
 }
+
+func isUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == uniqueViolation
+}
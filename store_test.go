@@ -4,13 +4,17 @@ import (
 	"bytes"
 	"context"
 	"crypto/sha256"
+	"errors"
 	"math/rand"
 	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
+	"time"
 )
 
 func TestPostgres(t *testing.T) {
+	ctx := context.Background()
 	tests := []struct {
 		name   string
 		db     string
@@ -28,6 +32,11 @@ func TestPostgres(t *testing.T) {
 			db:     "mem",
 			assets: []Asset{{Asset: "EUR", Amount: 1}, {Asset: "USD", Amount: 2}},
 		},
+		{
+			name:   "two asset",
+			db:     "sqlite",
+			assets: []Asset{{Asset: "EUR", Amount: 1}, {Asset: "USD", Amount: 2}},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.db+"-"+tt.name, func(t *testing.T) {
@@ -36,26 +45,31 @@ func TestPostgres(t *testing.T) {
 
 			randomTestUser(t, db)
 			pwd := sha256.Sum256([]byte(username))
-			_, err := db.SaveUser(username, pwd[:])
+			_, err := db.SaveUser(ctx, username, pwd[:])
 			if err != nil {
 				t.Fatal(err)
 			}
 
-			id, passwordHash, err := db.User(username)
+			if _, err := db.SaveUser(ctx, username, pwd[:]); !errors.Is(err, ErrUserExists) {
+				t.Errorf("duplicate user: got %v want %v", err, ErrUserExists)
+			}
+
+			user, err := db.User(ctx, username)
 			if err != nil {
 				t.Fatal(err)
 			}
-			if got, want := pwd[:], passwordHash; !bytes.Equal(got, want) {
+			if got, want := pwd[:], user.password; !bytes.Equal(got, want) {
 				t.Errorf("got %x want %x", got, want)
 			}
+			id := user.id
 
 			for _, asset := range tt.assets {
 				asset.userID = id
-				if err := db.SaveAsset(asset); err != nil {
+				if err := db.SaveAsset(ctx, asset); err != nil {
 					t.Fatal(err)
 				}
 			}
-			assets, err := db.Assets(id)
+			assets, err := db.Assets(ctx, id)
 			if err != nil {
 				t.Fatal(err)
 			}
@@ -63,21 +77,21 @@ func TestPostgres(t *testing.T) {
 				t.Errorf("got %v want %v", got, want)
 			}
 			order := &Order{
-				id:        -1, // false value to check if updated
+				ID:        -1, // false value to check if updated
 				userID:    id,
 				Side:      "SELL",
 				AssetPair: "EUR-USD",
 				Amount:    1,
 				Price:     1,
 			}
-			err = db.SaveOrder(order)
+			err = db.SaveOrder(ctx, order)
 			if err != nil {
 				t.Fatal(err)
 			}
-			if order.id == -1 {
-				t.Errorf("order.id not updated")
+			if order.ID == -1 {
+				t.Errorf("order.ID not updated")
 			}
-			orders, err := db.UserOrders(id)
+			orders, err := db.UserOrders(ctx, id, OrderFilter{})
 			if err != nil {
 				t.Fatal(err)
 			}
@@ -86,7 +100,7 @@ func TestPostgres(t *testing.T) {
 				t.Fatal("no orders for user")
 			}
 
-			orders, err = db.PendingOrders("EUR-USD")
+			orders, err = db.PendingOrders(ctx, "EUR-USD")
 			if err != nil {
 				t.Fatal(err)
 			}
@@ -97,30 +111,137 @@ func TestPostgres(t *testing.T) {
 	}
 }
 
+func TestClientOrderID(t *testing.T) {
+	ctx := context.Background()
+	for _, name := range []string{"mem", "postgres", "sqlite"} {
+		t.Run(name, func(t *testing.T) {
+			db := storeFactory(t, name)
+			_, id := randomTestUser(t, db)
+			_, other := randomTestUser(t, db)
+
+			order := Order{ClientOrderID: "a", userID: id, Side: "BUY", AssetPair: "EUR-USD", Amount: 1, Price: 1}
+			if err := db.SaveOrder(ctx, &order); err != nil {
+				t.Fatal(err)
+			}
+			duplicate := order
+			if err := db.SaveOrder(ctx, &duplicate); !errors.Is(err, ErrDuplicateClientOrderID) {
+				t.Errorf("got %v want %v", err, ErrDuplicateClientOrderID)
+			}
+			// client order ids are unique per user only, and optional
+			for _, o := range []Order{{ClientOrderID: "a", userID: other}, {userID: id}, {userID: id}} {
+				o.Side, o.AssetPair, o.Amount, o.Price = "BUY", "EUR-USD", 1, 1
+				if err := db.SaveOrder(ctx, &o); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			got, err := db.OrderByClientID(ctx, id, "a")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != order {
+				t.Errorf("got %+v want %+v", got, order)
+			}
+			if _, err := db.OrderByClientID(ctx, other, "b"); !errors.Is(err, ErrNotFound) {
+				t.Errorf("got %v want %v", err, ErrNotFound)
+			}
+		})
+	}
+}
+
+func TestUserOrders(t *testing.T) {
+	ctx := context.Background()
+	for _, name := range []string{"mem", "postgres", "sqlite"} {
+		t.Run(name, func(t *testing.T) {
+			db := storeFactory(t, name)
+			_, id := randomTestUser(t, db)
+			_, other := randomTestUser(t, db)
+
+			var ids []int
+			for i, side := range []string{"BUY", "SELL", "BUY", "SELL", "BUY"} {
+				order := Order{userID: id, Side: side, AssetPair: "EUR-USD", Amount: 1, Price: float64(i + 1)}
+				if err := db.SaveOrder(ctx, &order); err != nil {
+					t.Fatal(err)
+				}
+				ids = append(ids, order.ID)
+			}
+			if err := db.SaveOrder(ctx, &Order{userID: other, Side: "BUY", AssetPair: "EUR-USD", Amount: 1, Price: 1}); err != nil {
+				t.Fatal(err)
+			}
+			if err := db.CancelOrder(ctx, ids[2]); err != nil {
+				t.Fatal(err)
+			}
+
+			var got []int
+			filter := OrderFilter{Limit: 2}
+			for {
+				page, err := db.UserOrders(ctx, id, filter)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(page) == 0 {
+					break
+				}
+				for _, order := range page {
+					got = append(got, order.ID)
+				}
+				filter.After = cursorOf(page[len(page)-1])
+			}
+			if want := ids; !reflect.DeepEqual(got, want) {
+				t.Errorf("pages: got %v want %v", got, want)
+			}
+
+			tests := []struct {
+				filter OrderFilter
+				want   []int
+			}{
+				{filter: OrderFilter{Side: "BUY"}, want: []int{ids[0], ids[2], ids[4]}},
+				{filter: OrderFilter{Status: statusCancelled}, want: []int{ids[2]}},
+				{filter: OrderFilter{Side: "BUY", Status: statusPending}, want: []int{ids[0], ids[4]}},
+				{filter: OrderFilter{Pair: "USD-EUR"}},
+				{filter: OrderFilter{To: time.Now().Add(-time.Hour)}},
+			}
+			for _, tt := range tests {
+				orders, err := db.UserOrders(ctx, id, tt.filter)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var got []int
+				for _, order := range orders {
+					got = append(got, order.ID)
+				}
+				if !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("%+v: got %v want %v", tt.filter, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
 func TestFillOrder(t *testing.T) {
+	ctx := context.Background()
+	// a BUY pays the first asset of the pair, a SELL the second, see cost
 	tests := []struct {
 		name     string
-		db       string
 		assets   [][]Asset
 		orders   [][]Order
 		expected [][]Asset
 	}{
 		{
 			name: "swap two asset",
-			db:   "postgres",
 			assets: [][]Asset{
 				{{Asset: "EUR", Amount: 100}, {Asset: "USD", Amount: 0}},
 				{{Asset: "EUR", Amount: 0}, {Asset: "USD", Amount: 100}},
 			},
 			orders: [][]Order{
 				{{
-					Side:      "SELL",
+					Side:      "BUY",
 					AssetPair: "EUR-USD",
 					Amount:    100,
 					Price:     1,
 				}},
 				{{
-					Side:      "BUY",
+					Side:      "SELL",
 					AssetPair: "EUR-USD",
 					Amount:    100,
 					Price:     1,
@@ -133,76 +254,218 @@ func TestFillOrder(t *testing.T) {
 		},
 		{
 			name: "trade two asset",
-			db:   "postgres",
 			assets: [][]Asset{
 				{{Asset: "EUR", Amount: 100}, {Asset: "USD", Amount: 0}},
 				{{Asset: "EUR", Amount: 0}, {Asset: "USD", Amount: 100}},
 			},
 			orders: [][]Order{
 				{{
-					Side:      "SELL",
+					Side:      "BUY",
 					AssetPair: "EUR-USD",
 					Amount:    100,
 					Price:     0.5,
 				}},
 				{{
-					Side:      "BUY",
+					Side:      "SELL",
 					AssetPair: "EUR-USD",
 					Amount:    100,
 					Price:     1,
 				}},
 			},
 			expected: [][]Asset{
-				{{Asset: "EUR", Amount: 0}, {Asset: "USD", Amount: 50}},
-				{{Asset: "EUR", Amount: 100}, {Asset: "USD", Amount: 50}},
+				{{Asset: "EUR", Amount: 50}, {Asset: "USD", Amount: 100}},
+				{{Asset: "EUR", Amount: 100}, {Asset: "USD", Amount: 0}},
 			},
 		},
 	}
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			db := storeFactory(t, tt.db)
+	for _, storeType := range []string{"mem", "postgres", "sqlite"} {
+		for _, tt := range tests {
+			t.Run(storeType+"-"+tt.name, func(t *testing.T) {
+				db := storeFactory(t, storeType)
 
-			var users []int
-			for i, asset := range tt.assets {
-				_, id := randomTestUser(t, db, asset...)
-				for _, order := range tt.orders[i] {
-					order.userID = id
-					if err := db.SaveOrder(&order); err != nil {
-						t.Fatal(err)
+				var users []int
+				for i, asset := range tt.assets {
+					_, id := randomTestUser(t, db, asset...)
+					for _, order := range tt.orders[i] {
+						order.userID = id
+						if err := db.SaveOrder(ctx, &order); err != nil {
+							t.Fatal(err)
+						}
+						if err := db.FillOrders(ctx, Fill{Order: order}); err != nil {
+							t.Fatal(err)
+						}
 					}
-
+					users = append(users, id)
 				}
-				orders, err := db.UserOrders(id)
-				if err != nil {
-					t.Fatal(err)
-				}
-				if got, want := len(orders), len(tt.orders[i]); got != want {
-					t.Errorf("got %v want %v", got, want)
+
+				for i, user := range users {
+					assets, err := db.Assets(ctx, user)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if got, want := balances(assets), balances(tt.expected[i]); !reflect.DeepEqual(got, want) {
+						t.Errorf("got %v want %v", got, want)
+					}
 				}
+			})
+		}
+	}
+}
+
+// balances indexes the amounts by asset, ignoring the ids.
+func balances(assets []Asset) map[string]float64 {
+	amounts := make(map[string]float64)
+	for _, asset := range assets {
+		amounts[asset.Asset] = asset.Amount
+	}
+	return amounts
+}
 
-				users = append(users, id)
+func TestAuditedRollback(t *testing.T) {
+	ctx := context.Background()
+	// the sql stores refuse an entry of an unknown admin, the action must be rolled back with it
+	for _, storeType := range []string{"postgres", "sqlite"} {
+		t.Run(storeType, func(t *testing.T) {
+			db := storeFactory(t, storeType)
+			_, id := randomTestUser(t, db, Asset{Asset: "EUR", Amount: 10})
+			order := Order{userID: id, Side: "BUY", AssetPair: "EUR-USD", Amount: 1, Price: 1}
+			if err := db.SaveOrder(ctx, &order); err != nil {
+				t.Fatal(err)
 			}
+			entry := &AuditEntry{AdminID: id + 1000, Action: "adjust", Target: "user", CreatedAt: time.Now()}
 
-			orders, err := db.PendingOrders("EUR-USD")
+			if _, err := db.AdjustAssetAudited(ctx, id, "EUR", 5, entry); err == nil {
+				t.Error("adjusted with an unknown admin")
+			}
+			if err := db.SetUserDisabledAudited(ctx, id, true, entry); err == nil {
+				t.Error("disabled with an unknown admin")
+			}
+			if err := db.CancelOrderAudited(ctx, order.ID, entry); err == nil {
+				t.Error("cancelled with an unknown admin")
+			}
+
+			assets, err := db.Assets(ctx, id)
 			if err != nil {
 				t.Fatal(err)
 			}
-			if len(orders) == 0 {
-				t.Fatal("no pending orders")
+			if got, want := balances(assets)["EUR"], 10.0; got != want {
+				t.Errorf("got %v want %v", got, want)
 			}
-			for _, order := range orders {
-				if err := db.FillOrder(order); err != nil {
-					t.Fatal(err)
-				}
+			if user, err := db.UserByID(ctx, id); err != nil || user.Disabled {
+				t.Errorf("got %+v, %v", user, err)
 			}
-			for i, user := range users {
-				asset, err := db.Assets(user)
-				if err != nil {
-					t.Fatal(err)
-				}
-				if got, want := asset, tt.expected[i]; reflect.DeepEqual(got, want) {
-					t.Errorf("got %v want %v", got, want)
-				}
+			if got, err := db.Order(ctx, order.ID); err != nil || got.Status != statusPending {
+				t.Errorf("got %+v, %v", got, err)
+			}
+		})
+	}
+}
+
+func TestAPIKeys(t *testing.T) {
+	ctx := context.Background()
+	for _, storeType := range []string{"mem", "postgres", "sqlite"} {
+		t.Run(storeType, func(t *testing.T) {
+			db := storeFactory(t, storeType)
+			_, id := randomTestUser(t, db)
+
+			key, err := newAPIKey(id, []string{scopeRead, scopeTrade})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := db.SaveAPIKey(ctx, &key); err != nil {
+				t.Fatal(err)
+			}
+			got, err := db.APIKey(ctx, key.Key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.userID != id || got.Secret != key.Secret || !reflect.DeepEqual(got.Scopes, key.Scopes) {
+				t.Errorf("got %+v want %+v", got, key)
+			}
+			if _, err := db.APIKey(ctx, "unknown"); !errors.Is(err, ErrNotFound) {
+				t.Errorf("got %v want %v", err, ErrNotFound)
+			}
+
+			if err := db.RevokeAPIKey(ctx, id+1, key.Key); !errors.Is(err, ErrNotFound) {
+				t.Errorf("revoke other user key: got %v want %v", err, ErrNotFound)
+			}
+			if err := db.RevokeAPIKey(ctx, id, key.Key); err != nil {
+				t.Fatal(err)
+			}
+			keys, err := db.UserAPIKeys(ctx, id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(keys) != 1 || !keys[0].Revoked {
+				t.Errorf("expected one revoked key, got %+v", keys)
+			}
+		})
+	}
+}
+
+func TestIdempotencyRecords(t *testing.T) {
+	ctx := context.Background()
+	for _, storeType := range []string{"mem", "postgres", "sqlite"} {
+		t.Run(storeType, func(t *testing.T) {
+			db := storeFactory(t, storeType)
+			_, id := randomTestUser(t, db)
+			now := time.Now().UTC().Truncate(time.Microsecond)
+			record := IdempotencyRecord{UserID: id, Key: "key", RequestHash: []byte("hash"), CreatedAt: now.Add(-time.Hour)}
+
+			if err := db.SaveIdempotencyRecord(ctx, record, now.Add(-2*time.Hour), now.Add(-2*time.Hour)); err != nil {
+				t.Fatal(err)
+			}
+			if err := db.SaveIdempotencyRecord(ctx, record, now.Add(-2*time.Hour), now.Add(-2*time.Hour)); !errors.Is(err, ErrIdempotencyKeyExists) {
+				t.Errorf("got %v want %v", err, ErrIdempotencyKeyExists)
+			}
+			// still in progress after the deadline, the request was lost
+			if err := db.SaveIdempotencyRecord(ctx, record, now.Add(-2*time.Hour), now.Add(-30*time.Minute)); err != nil {
+				t.Fatal(err)
+			}
+			record.Status, record.ContentType, record.Response = 200, "application/json", []byte("{}")
+			if err := db.CompleteIdempotencyRecord(ctx, record); err != nil {
+				t.Fatal(err)
+			}
+			if err := db.SaveIdempotencyRecord(ctx, record, now.Add(-2*time.Hour), now.Add(-30*time.Minute)); !errors.Is(err, ErrIdempotencyKeyExists) {
+				t.Errorf("completed: got %v want %v", err, ErrIdempotencyKeyExists)
+			}
+			got, err := db.IdempotencyRecord(ctx, id, "key")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !got.CreatedAt.Equal(record.CreatedAt) || got.Status != 200 || string(got.Response) != "{}" {
+				t.Errorf("got %+v want %+v", got, record)
+			}
+
+			// the record is expired, it can be replaced
+			renewed := IdempotencyRecord{UserID: id, Key: "key", RequestHash: []byte("other"), CreatedAt: now}
+			if err := db.SaveIdempotencyRecord(ctx, renewed, now.Add(-30*time.Minute), now.Add(-30*time.Minute)); err != nil {
+				t.Fatal(err)
+			}
+			if got, _ := db.IdempotencyRecord(ctx, id, "key"); got.Status != 0 || string(got.RequestHash) != "other" {
+				t.Errorf("got %+v want %+v", got, renewed)
+			}
+
+			released := IdempotencyRecord{UserID: id, Key: "released", RequestHash: []byte("hash"), CreatedAt: now}
+			if err := db.SaveIdempotencyRecord(ctx, released, now.Add(-time.Hour), now.Add(-time.Hour)); err != nil {
+				t.Fatal(err)
+			}
+			if err := db.DeleteIdempotencyRecord(ctx, id, "released"); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := db.IdempotencyRecord(ctx, id, "released"); !errors.Is(err, ErrNotFound) {
+				t.Errorf("got %v want %v", err, ErrNotFound)
+			}
+
+			deleted, err := db.DeleteIdempotencyRecords(ctx, now.Add(time.Second))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if deleted != 1 {
+				t.Errorf("got %v deleted want 1", deleted)
+			}
+			if _, err := db.IdempotencyRecord(ctx, id, "key"); !errors.Is(err, ErrNotFound) {
+				t.Errorf("got %v want %v", err, ErrNotFound)
 			}
 		})
 	}
@@ -214,6 +477,8 @@ func storeFactory(t *testing.T, storeType string) store {
 		return newPostgresTest(t)
 	case "mem":
 		return newMem()
+	case "sqlite":
+		return newSQLiteTest(t)
 	}
 	t.Fatalf("unknown store type %s", storeType)
 	return nil
@@ -223,23 +488,17 @@ var letterRunes = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
 
 // randomTestUser create a random username and save it to the store. The username and the password are equal.
 func randomTestUser(t *testing.T, db store, assets ...Asset) (string, int) {
+	ctx := context.Background()
 	b := make([]rune, 10)
 	for i := range b {
 		b[i] = letterRunes[rand.Intn(len(letterRunes))]
 	}
 	user := string(b)
 	pwd := sha256.Sum256([]byte(user))
-	id, err := db.SaveUser(user, pwd[:])
+	id, err := db.SaveUser(ctx, user, pwd[:], assets...)
 	if err != nil {
 		t.Fatal(err)
 	}
-	for _, asset := range assets {
-		asset.userID = id
-		err := db.SaveAsset(asset)
-		if err != nil {
-			t.Fatal(err)
-		}
-	}
 	return user, id
 }
 
@@ -248,10 +507,13 @@ func newPostgresTest(t *testing.T) store {
 	if _, exists := os.LookupEnv("DB_URL"); !exists {
 		t.Skip("DB_URL not configured")
 	}
-	db, err := newPostgres(os.Getenv("DB_URL"))
+	db, err := newPostgres(databaseConfig{URL: os.Getenv("DB_URL")})
 	if err != nil {
 		t.Fatal(err)
 	}
+	if _, err := db.Migrate(); err != nil {
+		t.Fatal(err)
+	}
 	t.Cleanup(func() {
 		if _, err := db.pool.Exec(context.Background(), "TRUNCATE users CASCADE"); err != nil {
 			t.Fatal(err)
@@ -262,7 +524,38 @@ func newPostgresTest(t *testing.T) store {
 		if _, err := db.pool.Exec(context.Background(), "TRUNCATE orders CASCADE"); err != nil {
 			t.Fatal(err)
 		}
+		if _, err := db.pool.Exec(context.Background(), "TRUNCATE api_keys CASCADE"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.pool.Exec(context.Background(), "TRUNCATE audit_log CASCADE"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.pool.Exec(context.Background(), "TRUNCATE trades CASCADE"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.pool.Exec(context.Background(), "TRUNCATE candles CASCADE"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.pool.Exec(context.Background(), "TRUNCATE idempotency_keys CASCADE"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.pool.Exec(context.Background(), "TRUNCATE pair_states CASCADE"); err != nil {
+			t.Fatal(err)
+		}
 		db.Close()
 	})
 	return db
 }
+
+func newSQLiteTest(t *testing.T) store {
+	t.Helper()
+	db, err := newSQLite(filepath.Join(t.TempDir(), "tranched.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(db.Close)
+	return db
+}
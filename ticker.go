@@ -0,0 +1,110 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"time"
+)
+
+const tickerWindow = 24 * time.Hour
+
+// Execution is a trade between two matched orders.
+type Execution struct {
+	id     int
+	Pair   string    `json:"pair"`
+	Price  float64   `json:"price"`
+	Amount float64   `json:"amount"`
+	Time   time.Time `json:"time"`
+}
+
+// volumes returns the traded quantities of both assets, with the same convention as the settlement in FillOrders.
+func (e Execution) volumes() (base, quote float64) {
+	return e.Amount * e.Price, e.Amount
+}
+
+// executions converts the matched orders, that come by pairs, to executions.
+func executions(pair string, matches []Order, at time.Time) []Execution {
+	var execs []Execution
+	for i := 0; i+1 < len(matches); i += 2 {
+		execs = append(execs, Execution{
+			Pair:   pair,
+			Price:  matches[i].Price,
+			Amount: matches[i].Amount,
+			Time:   at,
+		})
+	}
+	return execs
+}
+
+// tickerStats keeps one candle per minute over the ticker window, so the statistics are updated on each execution
+// and aggregated over at most 1440 candles when read.
+type tickerStats struct {
+	last    float64
+	minutes []Candle
+}
+
+func (s *tickerStats) add(e Execution) {
+	s.last = e.Price
+	start := e.Time.Truncate(time.Minute)
+	if n := len(s.minutes); n == 0 || s.minutes[n-1].Start.Before(start) {
+		s.minutes = append(s.minutes, Candle{Start: start})
+	}
+	s.minutes[len(s.minutes)-1].add(e)
+	s.evict(e.Time)
+}
+
+func (s *tickerStats) evict(now time.Time) {
+	i := 0
+	for i < len(s.minutes) && now.Sub(s.minutes[i].Start) >= tickerWindow {
+		i++
+	}
+	s.minutes = s.minutes[i:]
+}
+
+// window aggregates the minute candles of the ticker window.
+func (s *tickerStats) window(now time.Time) (c Candle) {
+	s.evict(now)
+	for _, minute := range s.minutes {
+		if c.Open == 0 {
+			c = Candle{Start: minute.Start, Open: minute.Open, High: minute.High, Low: minute.Low}
+		}
+		c.High, c.Low, c.Close = max(c.High, minute.High), min(c.Low, minute.Low), minute.Close
+		c.BaseVolume += minute.BaseVolume
+		c.QuoteVolume += minute.QuoteVolume
+	}
+	return c
+}
+
+type Ticker struct {
+	Pair          string  `json:"pair"`
+	LastPrice     float64 `json:"last_price"`
+	BestBid       float64 `json:"best_bid"`
+	BestAsk       float64 `json:"best_ask"`
+	Open          float64 `json:"open"`
+	High          float64 `json:"high"`
+	Low           float64 `json:"low"`
+	Close         float64 `json:"close"`
+	BaseVolume    float64 `json:"base_volume"`
+	QuoteVolume   float64 `json:"quote_volume"`
+	ChangePercent float64 `json:"change_percent"`
+}
+
+func (api api) tickers(w http.ResponseWriter, r *http.Request) {
+	tickers := make([]Ticker, 0, len(api.engines))
+	for _, engine := range api.engines {
+		tickers = append(tickers, engine.Ticker())
+	}
+	sort.Slice(tickers, func(i, j int) bool {
+		return tickers[i].Pair < tickers[j].Pair
+	})
+	RespondWithJSON(w, http.StatusOK, tickers)
+}
+
+func (api api) ticker(w http.ResponseWriter, r *http.Request) {
+	engine, ok := api.engines[r.PathValue("pair")]
+	if !ok {
+		RespondWithError(w, http.StatusNotFound, ErrUnknownPair)
+		return
+	}
+	RespondWithJSON(w, http.StatusOK, engine.Ticker())
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTickerStats(t *testing.T) {
+	start := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	var stats tickerStats
+	for _, e := range []Execution{
+		{Price: 1.0, Amount: 10, Time: start},
+		{Price: 1.2, Amount: 10, Time: start.Add(30 * time.Second)},
+		{Price: 0.9, Amount: 20, Time: start.Add(2 * time.Hour)},
+		{Price: 1.1, Amount: 10, Time: start.Add(20 * time.Hour)},
+	} {
+		stats.add(e)
+	}
+
+	got := stats.window(start.Add(20 * time.Hour))
+	want := Candle{Start: start, Open: 1, High: 1.2, Low: 0.9, Close: 1.1, BaseVolume: 10 + 12 + 18 + 11, QuoteVolume: 50}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v want %+v", got, want)
+	}
+
+	// the first minute is out of the window
+	got = stats.window(start.Add(24*time.Hour + time.Minute))
+	want = Candle{Start: start.Add(2 * time.Hour), Open: 0.9, High: 1.1, Low: 0.9, Close: 1.1, BaseVolume: 18 + 11, QuoteVolume: 30}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v want %+v", got, want)
+	}
+	if got, want := stats.last, 1.1; got != want {
+		t.Errorf("got %v want %v", got, want)
+	}
+}
+
+func TestEngineTicker(t *testing.T) {
+	ctx := context.Background()
+	e := newEngine(Pair{Name: "EUR-USD"}, newMatchMaker(0.01, nil))
+	orders := []Order{
+		{ID: 0, Side: "BUY", Price: 2, Amount: 10},
+		{ID: 1, Side: "SELL", Price: 2, Amount: 10},
+		{ID: 2, Side: "BUY", Price: 2.5, Amount: 10},
+		{ID: 3, Side: "SELL", Price: 2.5, Amount: 10},
+		{ID: 4, Side: "BUY", Price: 2.4, Amount: 1},
+		{ID: 5, Side: "SELL", Price: 2.6, Amount: 1},
+	}
+	for _, order := range orders {
+		if _, _, err := e.Submit(ctx, order); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := Ticker{
+		Pair:          "EUR-USD",
+		LastPrice:     2.5,
+		BestBid:       2.4,
+		BestAsk:       2.6,
+		Open:          2,
+		High:          2.5,
+		Low:           2,
+		Close:         2.5,
+		BaseVolume:    45,
+		QuoteVolume:   20,
+		ChangePercent: 25,
+	}
+	if got := e.Ticker(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v want %+v", got, want)
+	}
+}
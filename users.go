@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+const (
+	minPasswordLength = 8
+	// maxPasswordLength is bcrypt's limit, longer passwords would be silently truncated by it.
+	maxPasswordLength = 72
+)
+
+var (
+	ErrInvalidUsername = errors.New("username must be 3 to 32 letters, digits, '.', '_' or '-'")
+	ErrWeakPassword    = fmt.Errorf("password must be %d to %d characters long, contain a letter and a digit, and not contain the username", minPasswordLength, maxPasswordLength)
+	ErrUserDisabled    = errors.New("user is disabled")
+
+	usernameRegexp = regexp.MustCompile(`^[a-zA-Z0-9_.-]{3,32}$`)
+
+	// supportedAssets are the balances every new user starts with.
+	supportedAssets = []string{"EUR", "USD"}
+)
+
+type credentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+func validateUsername(username string) error {
+	if !usernameRegexp.MatchString(username) {
+		return ErrInvalidUsername
+	}
+	return nil
+}
+
+func validatePassword(username, password string) error {
+	if len(password) < minPasswordLength || len(password) > maxPasswordLength {
+		return ErrWeakPassword
+	}
+	if username != "" && strings.Contains(strings.ToLower(password), strings.ToLower(username)) {
+		return ErrWeakPassword
+	}
+	var letter, digit bool
+	for _, r := range password {
+		letter = letter || unicode.IsLetter(r)
+		digit = digit || unicode.IsDigit(r)
+	}
+	if !letter || !digit {
+		return ErrWeakPassword
+	}
+	return nil
+}
+
+func (api api) register(w http.ResponseWriter, r *http.Request) {
+	var req credentials
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		RespondWithError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := validateUsername(req.Username); err != nil {
+		RespondWithError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := validatePassword(req.Username, req.Password); err != nil {
+		RespondWithError(w, http.StatusBadRequest, err)
+		return
+	}
+	hash, err := api.hasher.Hash(req.Password)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err)
+		return
+	}
+	assets := make([]Asset, len(supportedAssets))
+	for i, asset := range supportedAssets {
+		assets[i] = Asset{Asset: asset}
+	}
+	if _, err := api.db.SaveUser(r.Context(), req.Username, hash, assets...); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, ErrUserExists) {
+			status = http.StatusConflict
+		}
+		RespondWithError(w, status, err)
+		return
+	}
+	RespondWithJSON(w, http.StatusCreated, User{Username: req.Username, Role: roleUser})
+}
+
+func (api api) changePassword(w http.ResponseWriter, r *http.Request) {
+	userID, err := mustUserID(r)
+	if err != nil {
+		RespondWithError(w, http.StatusForbidden, err)
+		return
+	}
+	var req credentials
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		RespondWithError(w, http.StatusBadRequest, err)
+		return
+	}
+	user, err := api.db.UserByID(r.Context(), userID)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := validatePassword(user.Username, req.Password); err != nil {
+		RespondWithError(w, http.StatusBadRequest, err)
+		return
+	}
+	hash, err := api.hasher.Hash(req.Password)
+	if err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := api.db.UpdatePassword(r.Context(), userID, hash); err != nil {
+		RespondWithError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+const maxClientOrderIDSize = 64
+
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationError lists the invalid fields of the Subject, e.g. an order.
+type ValidationError struct {
+	Subject string
+	Fields  []FieldError
+}
+
+func (e ValidationError) Error() string {
+	messages := make([]string, 0, len(e.Fields))
+	for _, f := range e.Fields {
+		messages = append(messages, f.Field+": "+f.Message)
+	}
+	return "invalid " + e.Subject + ": " + strings.Join(messages, ", ")
+}
+
+func (e *ValidationError) add(field, format string, args ...any) {
+	e.Fields = append(e.Fields, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// validateOrder checks the order against the pair limits, reference is the price used for the price band, zero skips it.
+func validateOrder(order Order, pair Pair, reference float64) error {
+	v := ValidationError{Subject: "order"}
+	if len(order.ClientOrderID) > maxClientOrderIDSize {
+		v.add("client_order_id", "must be at most %d characters", maxClientOrderIDSize)
+	}
+	if order.Side != "BUY" && order.Side != "SELL" {
+		v.add("side", "must be BUY or SELL")
+	}
+
+	validPrice := order.Price > 0 && !math.IsInf(order.Price, 0)
+	if !validPrice {
+		v.add("price", "must be positive")
+	} else if !isMultiple(order.Price, pair.TickSize) {
+		v.add("price", "must be a multiple of the tick size %g", pair.TickSize)
+	} else if reference > 0 && pair.PriceBandPercent > 0 {
+		if math.Abs(order.Price-reference)/reference*100 > pair.PriceBandPercent {
+			v.add("price", "must be within %g%% of the reference price %g", pair.PriceBandPercent, reference)
+		}
+	}
+
+	validAmount := order.Amount > 0 && !math.IsInf(order.Amount, 0)
+	switch {
+	case !validAmount:
+		v.add("amount", "must be positive")
+	case !isMultiple(order.Amount, pair.LotSize):
+		v.add("amount", "must be a multiple of the lot size %g", pair.LotSize)
+	case pair.MinAmount > 0 && order.Amount < pair.MinAmount:
+		v.add("amount", "must be at least %g", pair.MinAmount)
+	case pair.MaxAmount > 0 && order.Amount > pair.MaxAmount:
+		v.add("amount", "must be at most %g", pair.MaxAmount)
+	}
+
+	if validPrice && validAmount {
+		notional := order.Amount * order.Price
+		switch {
+		case pair.MinNotional > 0 && notional < pair.MinNotional:
+			v.add("notional", "amount * price must be at least %g", pair.MinNotional)
+		case pair.MaxNotional > 0 && notional > pair.MaxNotional:
+			v.add("notional", "amount * price must be at most %g", pair.MaxNotional)
+		}
+	}
+
+	if len(v.Fields) != 0 {
+		return v
+	}
+	return nil
+}
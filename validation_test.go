@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func Test_validateOrder(t *testing.T) {
+	pair := Pair{
+		Name:             "EUR-USD",
+		TickSize:         0.01,
+		LotSize:          0.5,
+		PriceBandPercent: 10,
+		MinAmount:        1,
+		MaxAmount:        1000,
+		MinNotional:      10,
+		MaxNotional:      5000,
+	}
+	tests := []struct {
+		name      string
+		order     Order
+		reference float64
+		fields    []string
+	}{
+		{name: "valid", order: Order{Side: "BUY", Amount: 100, Price: 1}, reference: 1},
+		{name: "no reference price", order: Order{Side: "SELL", Amount: 100, Price: 30}},
+		{name: "unknown side", order: Order{Side: "buy", Amount: 100, Price: 1}, fields: []string{"side"}},
+		{name: "zero", order: Order{Side: "BUY"}, fields: []string{"price", "amount"}},
+		{name: "negative", order: Order{Side: "BUY", Amount: -100, Price: -1}, fields: []string{"price", "amount"}},
+		{name: "above band", order: Order{Side: "BUY", Amount: 100, Price: 1.11}, reference: 1, fields: []string{"price"}},
+		{name: "below band", order: Order{Side: "SELL", Amount: 100, Price: 0.89}, reference: 1, fields: []string{"price"}},
+		{name: "too small", order: Order{Side: "BUY", Amount: 0.5, Price: 100}, fields: []string{"amount"}},
+		{name: "tick size", order: Order{Side: "BUY", Amount: 100, Price: 1.2000000001}, fields: []string{"price"}},
+		{name: "lot size", order: Order{Side: "BUY", Amount: 100.2, Price: 1}, fields: []string{"amount"}},
+		{name: "float multiple", order: Order{Side: "BUY", Amount: 100.5, Price: 1.13}, reference: 1.1},
+		{name: "too big", order: Order{Side: "BUY", Amount: 1001, Price: 1}, fields: []string{"amount"}},
+		{name: "notional too small", order: Order{Side: "BUY", Amount: 5, Price: 1}, fields: []string{"notional"}},
+		{name: "notional too big", order: Order{Side: "BUY", Amount: 1000, Price: 6}, fields: []string{"notional"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateOrder(tt.order, pair, tt.reference)
+			if len(tt.fields) == 0 {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			var validation ValidationError
+			if !errors.As(err, &validation) {
+				t.Fatalf("got %v want a validation error", err)
+			}
+			var fields []string
+			for _, f := range validation.Fields {
+				fields = append(fields, f.Field)
+			}
+			if got, want := fields, tt.fields; !reflect.DeepEqual(got, want) {
+				t.Errorf("got %v want %v", got, want)
+			}
+		})
+	}
+}